@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"dialogue/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readingCookieName is the cookie holding the random tokens of the readings in progress, as "story:token" pairs
+// separated by dots, the latest reading last. Only the hash of a token is stored with the picks, and nothing ties
+// it to the user, so the analytics stay anonymous.
+const readingCookieName = "reading"
+
+// The reading cookie keeps the readings of the latest stories only, so it stays small, and is dropped after a while.
+const (
+	maxReadings         = 16
+	readingCookieMaxAge = 30 * 24 * time.Hour
+)
+
+// reading is the token of the reading of a story kept in the reading cookie.
+type reading struct {
+	StoryID int
+	Token   string
+}
+
+// crawlerMarks are parts of the user agents of crawlers, which read stories for search engines and feeds, not people.
+var crawlerMarks = []string{"bot", "crawl", "spider", "slurp", "fetch", "feed"}
+
+// optionStats is how often readers picked an option of a block.
+type optionStats struct {
+	To    int
+	Text  string
+	Picks int
+	Rate  float64 //Percent of the picks on the block.
+}
+
+// blockStats is how readers went through a block of the story, block 0 being the first one.
+type blockStats struct {
+	ID      int
+	Path    string
+	Reached int
+	Left    int
+	DropOff float64 //Percent of the readers who reached the block and picked no option, 0 for endings.
+	Ending  bool
+	Options []optionStats
+}
+
+// analyticsData is what the author sees about the readings of the story.
+type analyticsData struct {
+	Readings   int
+	Completion float64 //Percent of the readings which reached an ending.
+	PathLength float64 //Blocks an average reading went through, the first one included.
+	Blocks     []blockStats
+	ByBlock    map[int]blockStats
+}
+
+// readingID hashes the token of the reading, so the stored ID can't be matched with the cookie.
+func readingID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// percent returns part of whole in percent, 0 if whole is 0.
+func percent(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(whole)
+}
+
+// blockOptions decodes the options of a block, as the ID of the block each leads to and the text of the option.
+func blockOptions(raw models.JSON) []optionStats {
+	var decoded []map[int]string
+	json.Unmarshal(raw, &decoded)
+	var options []optionStats
+	for _, option := range decoded {
+		for to, text := range option {
+			options = append(options, optionStats{To: to, Text: text})
+		}
+	}
+	return options
+}
+
+// readings decodes the reading cookie, skipping malformed pairs.
+func readings(c *gin.Context) []reading {
+	value, err := c.Cookie(readingCookieName)
+	if err != nil {
+		return nil
+	}
+	var found []reading
+	for _, pair := range strings.Split(value, ".") {
+		id, token, ok := strings.Cut(pair, ":")
+		storyID, err := strconv.Atoi(id)
+		if ok && err == nil && token != "" {
+			found = append(found, reading{StoryID: storyID, Token: token})
+		}
+	}
+	return found
+}
+
+// readingToken returns the token of the reading of the story in progress, empty if there is none.
+func readingToken(c *gin.Context, storyID int) string {
+	for _, r := range readings(c) {
+		if r.StoryID == storyID {
+			return r.Token
+		}
+	}
+	return ""
+}
+
+// saveReadings writes the latest readings to the reading cookie.
+func (app *application) saveReadings(c *gin.Context, all []reading) {
+	if len(all) > maxReadings {
+		all = all[len(all)-maxReadings:]
+	}
+	pairs := make([]string, len(all))
+	for i, r := range all {
+		pairs[i] = strconv.Itoa(r.StoryID) + ":" + r.Token
+	}
+	app.setCookie(c, readingCookieName, strings.Join(pairs, "."), int(readingCookieMaxAge.Seconds()), "/")
+}
+
+// isCrawler reports whether the user agent is a crawler or doesn't say what it is.
+func isCrawler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	return userAgent == "" || slices.ContainsFunc(crawlerMarks, func(mark string) bool { return strings.Contains(userAgent, mark) })
+}
+
+// startReading begins an anonymous reading of the story, unless the browser is already reading it: going back to
+// the first block or reloading it goes on with the same reading. The oldest reading is forgotten once the cookie
+// is full. Crawlers don't read. Failures are logged only, the story is shown anyway.
+func (app *application) startReading(c *gin.Context, storyID int) {
+	if isCrawler(c.Request.UserAgent()) {
+		return
+	}
+	all := readings(c)
+	if slices.ContainsFunc(all, func(r reading) bool { return r.StoryID == storyID }) {
+		return
+	}
+	token := randomToken()
+	app.saveReadings(c, append(all, reading{StoryID: storyID, Token: token}))
+	if err := app.dialogues.StartReading(c, storyID, readingID(token)); err != nil {
+		app.logger.Error("Failed to start a reading", "story", storyID, "error", err)
+	}
+}
+
+// recordPick records that the reading in progress came to the block via an option of the block in the "from"
+// query parameter. Visits without the parameter, from a block not linking here or without a reading of the story
+// are not picks and aren't recorded.
+func (app *application) recordPick(c *gin.Context, blocks models.RelatedToStoryBlocks, blockID int) {
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		return
+	}
+	token := readingToken(c, blocks.FirstBlock.ID)
+	if token == "" || blocks.FirstBlock.UserID == app.getID(c) {
+		return
+	}
+	options := blocks.FirstBlock.FirstBlockOptions
+	if from != 0 {
+		i := slices.IndexFunc(blocks.OtherBlocks, func(b models.Block) bool { return b.ID == from })
+		if i < 0 {
+			return
+		}
+		options = blocks.OtherBlocks[i].BlockOptions
+	}
+	if !slices.ContainsFunc(blockOptions(options), func(o optionStats) bool { return o.To == blockID }) {
+		return
+	}
+	err = app.dialogues.RecordPick(c, readingID(token), blocks.FirstBlock.ID, from, blockID)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.logger.Error("Failed to record a pick", "story", blocks.FirstBlock.ID, "error", err)
+	}
+}
+
+// storyAnalytics sums up the readings of the story block by block.
+func (app *application) storyAnalytics(c *gin.Context, blocks models.RelatedToStoryBlocks) (data analyticsData, err error) {
+	all := []blockStats{{ID: 0, Path: blockPath(blocks.FirstBlock.ID, 0), Options: blockOptions(blocks.FirstBlock.FirstBlockOptions)}}
+	for _, block := range blocks.OtherBlocks {
+		all = append(all, blockStats{ID: block.ID, Path: blockPath(blocks.FirstBlock.ID, block.ID), Options: blockOptions(block.BlockOptions)})
+	}
+	var endings []int
+	for _, block := range all {
+		if len(block.Options) == 0 && block.ID != 0 {
+			endings = append(endings, block.ID)
+		}
+	}
+	stats, err := app.dialogues.ReadingStats(c, blocks.FirstBlock.ID, endings)
+	if err != nil {
+		return data, err
+	}
+
+	data.Readings = stats.Readings
+	data.Completion = percent(stats.Completed, stats.Readings)
+	if stats.Readings > 0 {
+		data.PathLength = 1 + float64(stats.Steps)/float64(stats.Readings)
+	}
+	data.ByBlock = make(map[int]blockStats, len(all))
+	for _, block := range all {
+		block.Reached, block.Left = stats.Reached[block.ID], stats.Left[block.ID]
+		block.Ending = len(block.Options) == 0
+		if !block.Ending {
+			block.DropOff = percent(block.Reached-block.Left, block.Reached)
+		}
+		picks := 0
+		for _, option := range block.Options {
+			picks += stats.Picks[[2]int{block.ID, option.To}]
+		}
+		for i, option := range block.Options {
+			block.Options[i].Picks = stats.Picks[[2]int{block.ID, option.To}]
+			block.Options[i].Rate = percent(block.Options[i].Picks, picks)
+		}
+		data.Blocks = append(data.Blocks, block)
+		data.ByBlock[block.ID] = block
+	}
+	return data, nil
+}
+
+// analytics shows the author how readers go through the story.
+func (app *application) analytics(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	storyID, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	blocks := app.dialogues.RetrieveBlocks(c, storyID)
+	if blocks.FirstBlock.ID == 0 {
+		app.notFound(c)
+		return
+	}
+	if blocks.FirstBlock.UserID != userID {
+		app.fail(c, errForbidden("Only the author sees the analytics of the story."))
+		return
+	}
+	data := app.newTemplateData(c)
+	data.DataDialogues.FirstBlock = blocks.FirstBlock
+	if data.Analytics, err = app.storyAnalytics(c, blocks); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.render(c, http.StatusOK, "analytics.html", data)
+}
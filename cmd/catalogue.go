@@ -0,0 +1,200 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// language is a language stories can be written in, Code is the ISO 639-1 code stored with the story.
+type language struct {
+	Code string
+	Name string
+}
+
+// languages are offered on the story forms and in the catalogue filters.
+var languages = []language{
+	{"de", "Deutsch"},
+	{"en", "English"},
+	{"es", "Español"},
+	{"fr", "Français"},
+	{"it", "Italiano"},
+	{"pl", "Polski"},
+	{"pt", "Português"},
+	{"ru", "Русский"},
+	{"uk", "Українська"},
+	{"ja", "日本語"},
+	{"zh", "中文"},
+}
+
+// knownLanguage reports whether code is one of the languages, or empty for an unknown language.
+func knownLanguage(code string) bool {
+	for _, l := range languages {
+		if l.Code == code {
+			return true
+		}
+	}
+	return code == ""
+}
+
+// languageName returns the name of the language with code, or the code itself if it isn't known.
+func languageName(code string) string {
+	for _, l := range languages {
+		if l.Code == code {
+			return l.Name
+		}
+	}
+	return code
+}
+
+// Tabs of the catalogue.
+const (
+	tabPublic = "public"
+	tabMine   = "mine"
+)
+
+// catalogueForm holds the tab, order and filters of the catalogue taken from the query string.
+type catalogueForm struct {
+	Tab      string `schema:"tab"`
+	Sort     string `schema:"sort"`
+	Author   int    `schema:"author"`
+	Language string `schema:"lang"`
+	Length   string `schema:"length"`
+	Genre    string `schema:"genre"`
+	Tag      string `schema:"tag"`
+	After    string `schema:"after"`
+	Limit    int    `schema:"limit"`
+}
+
+// catalogueData is a page of the catalogue with the link to the next one.
+type catalogueData struct {
+	Form    catalogueForm
+	Page    models.CataloguePage
+	NextURL string
+}
+
+// catalogueStory is a story of the catalogue as the JSON API returns it.
+type catalogueStory struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	AuthorID  int       `json:"author_id"`
+	Language  string    `json:"language,omitempty"`
+	Genre     string    `json:"genre,omitempty"`
+	Private   bool      `json:"private"`
+	Plays     int       `json:"plays"`
+	Rating    float64   `json:"rating"`
+	Ratings   int       `json:"ratings"`
+	Blocks    int       `json:"blocks"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// catalogue lists public stories, or the user's own ones, page by page. API clients asking for JSON get the same
+// page as JSON.
+func (app *application) catalogue(c *gin.Context) {
+	var form catalogueForm
+	if err := app.parseQuery(c, &form); err != nil {
+		return
+	}
+	//Tag pages are the catalogue of the stories with the tag.
+	if tag := c.Param("tag"); tag != "" {
+		normalized, ok := models.NormalizeTag(tag)
+		if !ok {
+			app.notFound(c)
+			return
+		}
+		form.Tag = normalized
+	}
+	if form.Tab == "" {
+		form.Tab = tabPublic
+	}
+	if form.Sort == "" {
+		form.Sort = models.SortNewest
+	}
+	if !validator.PermittedString(form.Tab, tabPublic, tabMine) ||
+		!validator.PermittedString(form.Sort, models.SortNewest, models.SortUpdated, models.SortPlayed, models.SortRated) ||
+		!validator.PermittedString(form.Length, "", models.LengthShort, models.LengthMedium, models.LengthLong) ||
+		!knownLanguage(form.Language) || form.Genre != "" && !slices.Contains(models.Genres, form.Genre) ||
+		form.Limit < 0 || form.Limit > models.MaxPageSize {
+		app.fail(c, errBadRequest("The catalogue doesn't have such a tab, order or filter.", nil))
+		return
+	}
+
+	userID := app.getID(c)
+	if form.Tab == tabMine && userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	query := models.CatalogueQuery{
+		UserID:   userID,
+		Mine:     form.Tab == tabMine,
+		Sort:     form.Sort,
+		AuthorID: form.Author,
+		Language: form.Language,
+		Length:   form.Length,
+		Genre:    form.Genre,
+		Tag:      form.Tag,
+		Cursor:   form.After,
+		Limit:    form.Limit,
+	}
+	//Readers don't see stories with the warnings they hide, except their own ones.
+	if !query.Mine {
+		hidden, err := app.hiddenFor(c, userID)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		query.HideWarnings = hidden
+	}
+	page, err := app.dialogues.Catalogue(c, query)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		app.fail(c, errBadRequest("The link to the page is broken, start from the first page.", err))
+		return
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	//The next page keeps the tab, order and filters of this one.
+	var nextURL string
+	if page.Next != "" {
+		values := c.Request.URL.Query()
+		values.Set("after", page.Next)
+		nextURL = c.Request.URL.Path + "?" + values.Encode()
+	}
+
+	if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		stories := make([]catalogueStory, len(page.Stories))
+		for i, story := range page.Stories {
+			stories[i] = catalogueStory{
+				ID:        story.ID,
+				URL:       "/firstblock?id=" + strconv.Itoa(story.ID),
+				Title:     story.StoryTitle,
+				AuthorID:  story.UserID,
+				Language:  story.Language,
+				Genre:     story.Genre,
+				Private:   story.Privacy,
+				Plays:     story.Plays,
+				Rating:    story.Rating,
+				Ratings:   story.Ratings,
+				Blocks:    story.Blocks,
+				CreatedAt: story.CreatedAt,
+				UpdatedAt: story.UpdatedAt,
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"stories": stories, "next": nextURL})
+		return
+	}
+
+	data := app.newTemplateData(c)
+	data.Catalogue = catalogueData{Form: form, Page: page, NextURL: nextURL}
+	app.render(c, http.StatusOK, "stories.html", data)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxCommentLength limits the text of a comment.
+const maxCommentLength = 2000
+
+// mentionRX matches a handle, e.g. "@Jane-Doe", whole and not within a word or an email address like
+// me@example.com. Handles are mentions when models.NicknameRX matches them, see findMentions.
+var mentionRX = regexp.MustCompile(`(?:^|[^a-zA-Z0-9_.@-])@([a-zA-Z0-9_-]+)`)
+
+// commentForm holds a new comment, Parent is the comment it replies to or 0 for a new thread.
+type commentForm struct {
+	Body   string `schema:"body"`
+	Parent int    `schema:"parent"`
+}
+
+// resolveForm tells whether to resolve the thread or to open it again.
+type resolveForm struct {
+	Resolved bool `schema:"resolved"`
+}
+
+// collaboratorForm names the user to invite or to remove, by nickname or by ID.
+type collaboratorForm struct {
+	Nickname string `schema:"nickname"`
+	User     int    `schema:"user"`
+}
+
+// comment is a comment shown with its writer, who is nil if the account is gone, and its text with the mentions
+// linked to the profiles.
+type comment struct {
+	models.Comment
+	Writer *models.User
+	Linked template.HTML
+}
+
+// thread is the comment starting a thread with the replies to it.
+type thread struct {
+	First   comment
+	Replies []comment
+}
+
+// reviewData is what collaborators see on a block: the comment threads, the comment counts of the story map by
+// block ID and, for the author, the collaborators.
+type reviewData struct {
+	Allowed       bool
+	StoryID       int
+	BlockID       int
+	Threads       []thread
+	Counts        map[int]models.CommentCount
+	Collaborators []*models.User
+}
+
+// blockPath returns the address of the block of the story, block 0 being the first one.
+func blockPath(storyID, blockID int) string {
+	if blockID == 0 {
+		return "/firstblock?id=" + strconv.Itoa(storyID)
+	}
+	return "/block?id=" + strconv.Itoa(blockID)
+}
+
+// findMentions returns where the mentions in the text start and end, "@" included.
+func findMentions(body string) [][2]int {
+	var found [][2]int
+	for _, match := range mentionRX.FindAllStringSubmatchIndex(body, -1) {
+		if models.NicknameRX.MatchString(body[match[2]:match[3]]) {
+			found = append(found, [2]int{match[2] - 1, match[3]})
+		}
+	}
+	return found
+}
+
+// linkMentions escapes the comment and links the mentions of existing users in it to their profiles. Users are
+// looked up once per nickname in any case, users keeps them across the comments of a page.
+func (app *application) linkMentions(c *gin.Context, body string, users map[string]*models.User) (template.HTML, error) {
+	var linked strings.Builder
+	last := 0
+	for _, mention := range findMentions(body) {
+		nickname := body[mention[0]+1 : mention[1]]
+		user, ok := users[strings.ToLower(nickname)]
+		if !ok {
+			var err error
+			user, err = app.users.GetByNickname(c, nickname)
+			if err != nil && !errors.Is(err, models.ErrNoRecord) {
+				return "", err
+			}
+			users[strings.ToLower(nickname)] = user
+		}
+		if user == nil {
+			continue
+		}
+		linked.WriteString(template.HTMLEscapeString(body[last:mention[0]]))
+		linked.WriteString(`<a href="/u/` + user.NickName + `">@` + nickname + `</a>`)
+		last = mention[1]
+	}
+	linked.WriteString(template.HTMLEscapeString(body[last:]))
+	return template.HTML(linked.String()), nil
+}
+
+// canReview reports whether the user wrote the story or collaborates on it.
+func (app *application) canReview(c *gin.Context, story models.FirstBlock, userID int) (bool, error) {
+	if story.ID == 0 || userID == 0 {
+		return false, nil
+	}
+	if story.UserID == userID {
+		return true, nil
+	}
+	return app.dialogues.IsCollaborator(c, story.ID, userID)
+}
+
+// storyReview loads the comments on the block of the story, if the user may see them.
+func (app *application) storyReview(c *gin.Context, story models.FirstBlock, blockID int) (data reviewData, err error) {
+	userID := app.getID(c)
+	data.Allowed, err = app.canReview(c, story, userID)
+	if err != nil || !data.Allowed {
+		return data, err
+	}
+	data.StoryID, data.BlockID = story.ID, blockID
+
+	comments, err := app.dialogues.Comments(c, story.ID, blockID)
+	if err != nil {
+		return data, err
+	}
+	writers := make(map[int]*models.User)
+	mentioned := make(map[string]*models.User)
+	for _, stored := range comments {
+		writer, ok := writers[stored.UserID]
+		if !ok {
+			writer, err = app.users.GetUser(c, stored.UserID)
+			if err != nil && !errors.Is(err, models.ErrNoRecord) {
+				return data, err
+			}
+			writers[stored.UserID] = writer
+		}
+		shown := comment{Comment: stored, Writer: writer}
+		if shown.Linked, err = app.linkMentions(c, stored.Body, mentioned); err != nil {
+			return data, err
+		}
+		if stored.ParentID == 0 {
+			data.Threads = append(data.Threads, thread{First: shown})
+			continue
+		}
+		for i := range data.Threads {
+			if data.Threads[i].First.ID == stored.ParentID {
+				data.Threads[i].Replies = append(data.Threads[i].Replies, shown)
+			}
+		}
+	}
+	if data.Counts, err = app.dialogues.CommentCounts(c, story.ID); err != nil {
+		return data, err
+	}
+
+	//The author manages who collaborates.
+	if story.UserID == userID {
+		ids, err := app.dialogues.Collaborators(c, story.ID)
+		if err != nil {
+			return data, err
+		}
+		for _, id := range ids {
+			user, err := app.users.GetUser(c, id)
+			if err != nil && !errors.Is(err, models.ErrNoRecord) {
+				return data, err
+			}
+			if user != nil {
+				data.Collaborators = append(data.Collaborators, user)
+			}
+		}
+	}
+	return data, nil
+}
+
+// mentioned returns the IDs of the users mentioned in the comment who can read it, as JSON.
+func (app *application) mentioned(c *gin.Context, story models.FirstBlock, body string) (models.JSON, error) {
+	ids := []int{}
+	for _, mention := range findMentions(body) {
+		user, err := app.users.GetByNickname(c, body[mention[0]+1:mention[1]])
+		if errors.Is(err, models.ErrNoRecord) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		allowed, err := app.canReview(c, story, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if allowed && !slices.Contains(ids, user.ID) {
+			ids = append(ids, user.ID)
+		}
+	}
+	return json.Marshal(ids)
+}
+
+// addComment adds a comment on the block of the story, starting a thread or replying in one.
+func (app *application) addComment(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	storyID, err := strconv.Atoi(c.Query("story"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	blockID, err := strconv.Atoi(c.DefaultQuery("block", "0"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	story := app.dialogues.RetrieveBlocks(c, storyID)
+	if story.FirstBlock.ID == 0 ||
+		blockID != 0 && !slices.ContainsFunc(story.OtherBlocks, func(b models.Block) bool { return b.ID == blockID }) {
+		app.notFound(c)
+		return
+	}
+	allowed, err := app.canReview(c, story.FirstBlock, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if !allowed {
+		app.fail(c, errForbidden("Only the author and collaborators comment on the story."))
+		return
+	}
+
+	var form commentForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if !validator.NotBlank(form.Body) || !validator.MaxChars(form.Body, maxCommentLength) {
+		app.fail(c, errUnprocessable(fmt.Sprintf("Write a comment of up to %d characters.", maxCommentLength), nil))
+		return
+	}
+	mentions, err := app.mentioned(c, story.FirstBlock, form.Body)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	newComment := models.Comment{StoryID: storyID, BlockID: blockID, ParentID: form.Parent, UserID: userID, Body: form.Body, Mentions: mentions}
+	err = app.dialogues.AddComment(c, &newComment)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.fail(c, errUnprocessable("The comment you reply to isn't on this block.", err))
+		return
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	//The author learns about comments, mentioned users about mentions instead.
+	mentionedIDs := newComment.Mentioned()
+	app.notify(c, models.NotifyMention, story.FirstBlock, blockID, mentionedIDs...)
+	if !slices.Contains(mentionedIDs, story.FirstBlock.UserID) {
+		app.notify(c, models.NotifyComment, story.FirstBlock, blockID, story.FirstBlock.UserID)
+	}
+	c.Redirect(http.StatusFound, blockPath(storyID, blockID)+"#comment-"+strconv.Itoa(newComment.ID))
+}
+
+// resolveComment resolves the thread started by the comment, or opens it again.
+func (app *application) resolveComment(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	commentID, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	target, err := app.dialogues.GetComment(c, commentID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(c)
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+	allowed, err := app.canReview(c, app.dialogues.RetrieveBlocks(c, target.StoryID).FirstBlock, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if !allowed {
+		app.fail(c, errForbidden("Only the author and collaborators resolve comments."))
+		return
+	}
+
+	var form resolveForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if err := app.dialogues.SetResolved(c, commentID, form.Resolved); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, blockPath(target.StoryID, target.BlockID)+"#comment-"+strconv.Itoa(commentID))
+}
+
+// collaborators invites a user by nickname to review the story, or removes a collaborator by ID. Only the author
+// manages collaborators.
+func (app *application) collaborators(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	storyID, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	story := app.dialogues.RetrieveBlocks(c, storyID).FirstBlock
+	if story.ID == 0 {
+		app.notFound(c)
+		return
+	}
+	if story.UserID != userID {
+		app.fail(c, errForbidden("Only the author invites collaborators."))
+		return
+	}
+
+	var form collaboratorForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if form.User != 0 {
+		if err := app.dialogues.RemoveCollaborator(c, storyID, form.User); err != nil {
+			app.serverError(c, err)
+			return
+		}
+		c.Redirect(http.StatusFound, blockPath(storyID, 0))
+		return
+	}
+	user, err := app.users.GetByNickname(c, form.Nickname)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.fail(c, errUnprocessable("Nobody has this nickname.", nil))
+		return
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if user.ID == userID {
+		app.fail(c, errUnprocessable("You already review your own story.", nil))
+		return
+	}
+	if err := app.dialogues.AddCollaborator(c, storyID, user.ID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.notify(c, models.NotifyInvite, story, 0, user.ID)
+	app.setFlash(c, user.NickName+" can now comment on the story.")
+	c.Redirect(http.StatusFound, blockPath(storyID, 0))
+}
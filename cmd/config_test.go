@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"addr": ":4000", "postgres": {"host": "file-db", "name": "file"}, "cookie": {"sessionIdleTimeout": "30m"}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"DIALOGUE_CONFIG":  path,
+		"DIALOGUE_PG_HOST": "env-db",
+		"DIALOGUE_SIGNUP":  "false",
+	}
+
+	cfg, err := loadConfig([]string{"-pg-host", "flag-db"}, func(k string) string { return env[k] }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":4000" {
+		t.Errorf("addr from file: got %q", cfg.Addr)
+	}
+	if cfg.Postgres.Name != "file" || cfg.Postgres.Port != 5432 {
+		t.Errorf("file should override only the fields it sets: got %+v", cfg.Postgres)
+	}
+	if cfg.Postgres.Host != "flag-db" {
+		t.Errorf("flag should win over env and file: got %q", cfg.Postgres.Host)
+	}
+	if cfg.Features.Signup {
+		t.Error("env should override the default")
+	}
+	if time.Duration(cfg.Cookie.SessionIdleTimeout) != 30*time.Minute {
+		t.Errorf("session idle timeout from file: got %v", time.Duration(cfg.Cookie.SessionIdleTimeout))
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"invalid env value", nil, map[string]string{"DIALOGUE_PG_PORT": "x"}, "DIALOGUE_PG_PORT"},
+		{"invalid flag value", []string{"-session-max-age", "forever"}, nil, "-session-max-age"},
+		{"short secret", []string{"-secret", "short"}, nil, "secret must be"},
+		{"relative base URL", []string{"-base-url", "/app"}, nil, "base-url"},
+		{"max age shorter than idle timeout", []string{"-session-max-age", "1m"}, nil, "session-max-age must not"},
+		{"missing file", []string{"-config", "/nonexistent.json"}, nil, "nonexistent"},
+		{"unknown database", []string{"-database", "mysql"}, nil, "database \"mysql\""},
+		{"sqlite without a path", []string{"-database", "sqlite", "-sqlite-path", ""}, nil, "sqlite-path"},
+		{"unknown throttle store", []string{"-throttle", "memcached"}, nil, "throttle \"memcached\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(tt.args, func(k string) string { return tt.env[k] }, io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v; want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Secret = "a-very-long-secret-nobody-should-ever-see"
+	cfg.Postgres.Password = "pg-pass"
+	cfg.OIDCProviders = []OIDCProviderConfig{{Name: "mock", ClientSecret: "client-pass"}}
+
+	s := cfg.String()
+	for _, secret := range []string{cfg.Secret, "pg-pass", "client-pass"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("%q leaked into %s", secret, s)
+		}
+	}
+	if cfg.OIDCProviders[0].ClientSecret != "client-pass" {
+		t.Error("redacting modified the original config")
+	}
+}
@@ -1,11 +1,127 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dialogue/internal/logging"
+	"dialogue/internal/mailer"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/glebarez/sqlite"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
 )
 
+// Config is the whole configuration of the app. It is loaded by loadConfig from, in order of increasing
+// precedence: built-in defaults, a JSON file, DIALOGUE_* environment variables and command line flags.
+type Config struct {
+	Addr    string `json:"addr"`
+	BaseURL string `json:"baseURL"`
+
+	// Secret signs CSRF and email tokens. If it is empty a random one is generated on every start, which
+	// invalidates links in emails sent before a restart.
+	Secret string `json:"secret"`
+
+	BcryptCost int `json:"bcryptCost"`
+
+	// DebugPassword protects the /debug section with basic authentication. The section is disabled if it is empty.
+	DebugPassword string `json:"debugPassword"`
+
+	// Database selects where stories and users are stored: "postgres" or "sqlite", which needs no server and suits
+	// a single writer.
+	Database string `json:"database"`
+
+	// Throttle selects where login throttling is counted: "redis", shared by all replicas, or "memory", which suits a
+	// single instance.
+	Throttle string `json:"throttle"`
+
+	// Dev reads templates and static files from ./ui instead of the copies compiled into the binary and reloads
+	// templates when they change.
+	Dev bool `json:"dev"`
+
+	Log           LogConfig            `json:"log"`
+	Server        ServerConfig         `json:"server"`
+	Tracing       TracingConfig        `json:"tracing"`
+	Postgres      PostgresConfig       `json:"postgres"`
+	SQLite        SQLiteConfig         `json:"sqlite"`
+	Redis         RedisConfig          `json:"redis"`
+	Cookie        CookieConfig         `json:"cookie"`
+	Mailer        MailerConfig         `json:"mailer"`
+	OIDCProviders []OIDCProviderConfig `json:"oidcProviders"`
+	Features      FeatureConfig        `json:"features"`
+}
+
+// LogConfig selects the format ("text" or "json") and the minimum level ("debug", "info", "warn" or "error")
+// of logs. SQL statements are logged at debug level, those slower than SlowQuery as warnings.
+type LogConfig struct {
+	Format    string   `json:"format"`
+	Level     string   `json:"level"`
+	SlowQuery Duration `json:"slowQuery"`
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Format:    "text",
+		Level:     "info",
+		SlowQuery: Duration(200 * time.Millisecond),
+	}
+}
+
+// ServerConfig holds settings of the HTTP server. TLS is served if both TLSCertFile and TLSKeyFile are set, or with
+// a self-signed certificate generated on start if TLSSelfSigned is set, which is meant for development only.
+type ServerConfig struct {
+	ReadTimeout  Duration `json:"readTimeout"`
+	WriteTimeout Duration `json:"writeTimeout"`
+	IdleTimeout  Duration `json:"idleTimeout"`
+
+	// ShutdownDelay is how long the app keeps serving after it reported not being ready, so load balancers
+	// stop sending new requests before the listener is closed.
+	ShutdownDelay Duration `json:"shutdownDelay"`
+
+	// ShutdownTimeout limits how long in-flight requests are waited for on shutdown.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	TLSCertFile   string `json:"tlsCertFile"`
+	TLSKeyFile    string `json:"tlsKeyFile"`
+	TLSSelfSigned bool   `json:"tlsSelfSigned"`
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:     Duration(5 * time.Second),
+		WriteTimeout:    Duration(10 * time.Second),
+		IdleTimeout:     Duration(time.Minute),
+		ShutdownTimeout: Duration(30 * time.Second),
+	}
+}
+
+// TracingConfig selects where OpenTelemetry spans are exported to: "otlp" sends them to the OTLP/HTTP collector
+// at Endpoint, "stdout" prints them and an empty exporter disables tracing.
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+func DefaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Endpoint:    "http://localhost:4318",
+		SampleRatio: 1,
+	}
+}
+
 type PostgresConfig struct {
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
@@ -16,11 +132,10 @@ type PostgresConfig struct {
 
 func DefaultPostgresConfig() PostgresConfig {
 	return PostgresConfig{
-		Host:     "localhost",
-		Port:     5431,
-		User:     "postgres",
-		Password: "world555",
-		Name:     "rpg",
+		Host: "localhost",
+		Port: 5432,
+		User: "postgres",
+		Name: "rpg",
 	}
 }
 
@@ -34,12 +149,467 @@ func (c PostgresConfig) ConnectionInfo() string {
 		c.Password, c.Name)
 }
 
-func DefaultRedisConfig() *redis.Options {
+// SQLiteConfig holds the path of the SQLite database file, which is created if it doesn't exist.
+type SQLiteConfig struct {
+	Path string `json:"path"`
+}
+
+func DefaultSQLiteConfig() SQLiteConfig {
+	return SQLiteConfig{
+		Path: "./dialogue.db",
+	}
+}
+
+// DSN waits for locks instead of failing, as requests write concurrently, and lets readers go on during writes.
+func (c SQLiteConfig) DSN() string {
+	return c.Path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// dialector returns the dialector of the selected database and the name of the database system in traces.
+func (c *Config) dialector() (gorm.Dialector, string) {
+	if c.Database == "sqlite" {
+		return sqlite.Open(c.SQLite.DSN()), "sqlite"
+	}
+	return postgres.Open(c.Postgres.ConnectionInfo()), "postgresql"
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+}
+
+func DefaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		Addr: "localhost:6379",
+	}
+}
+
+func (c RedisConfig) Options() *redis.Options {
 	return &redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
+		Addr:     c.Addr,
+		Password: c.Password,
+		DB:       c.DB,
+	}
+}
+
+// CookieConfig holds attributes of the cookies set by the app and the lifetime of sessions.
+type CookieConfig struct {
+	Domain string `json:"domain"`
+	Secure bool   `json:"secure"`
+
+	// SessionIdleTimeout is how long a session survives without any request (sliding expiry).
+	SessionIdleTimeout Duration `json:"sessionIdleTimeout"`
+
+	// SessionMaxAge is the absolute lifetime of a session regardless of activity.
+	SessionMaxAge Duration `json:"sessionMaxAge"`
+}
+
+func DefaultCookieConfig() CookieConfig {
+	return CookieConfig{
+		SessionIdleTimeout: Duration(2 * time.Hour),
+		SessionMaxAge:      Duration(7 * 24 * time.Hour),
+	}
+}
+
+type MailerConfig struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	From      string `json:"from"`
+	OutboxDir string `json:"outboxDir"`
+
+	// DigestInterval is how often users who asked for it get their unread notifications by email, 0 disables
+	// digests.
+	DigestInterval Duration `json:"digestInterval"`
+}
+
+// DefaultMailerConfig writes emails into a local outbox, set Host to deliver them through SMTP.
+func DefaultMailerConfig() MailerConfig {
+	return MailerConfig{
+		Port:           587,
+		From:           "Dialogue <no-reply@localhost>",
+		OutboxDir:      "./outbox",
+		DigestInterval: Duration(24 * time.Hour),
+	}
+}
+
+func (c MailerConfig) Mailer() mailer.Mailer {
+	if c.Host == "" {
+		return &mailer.OutboxMailer{Dir: c.OutboxDir, From: c.From}
+	}
+	return &mailer.SMTPMailer{
+		Host:     c.Host,
+		Port:     c.Port,
+		Username: c.Username,
+		Password: c.Password,
+		From:     c.From,
+	}
+}
+
+// OIDCProviderConfig describes an OpenID Connect provider users can log in with. Providers can only be
+// configured in the config file; to try single sign-on locally run cmd/mockoidc and add:
+//
+//	{"name": "mock", "displayName": "Mock SSO", "issuerURL": "http://localhost:9999", "clientID": "dialogue", "clientSecret": "dialogue-secret"}
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"displayName"`
+	IssuerURL    string   `json:"issuerURL"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// FeatureConfig toggles optional behaviour.
+type FeatureConfig struct {
+	// Signup allows new accounts to be created with the signup form.
+	Signup bool `json:"signup"`
+
+	// RequireVerifiedEmail makes login refuse accounts with unverified email addresses.
+	RequireVerifiedEmail bool `json:"requireVerifiedEmail"`
+
+	// TOTPForPopularAuthors requires two-factor authentication from authors of popular stories.
+	TOTPForPopularAuthors bool `json:"totpForPopularAuthors"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:       ":3000",
+		BaseURL:    "http://localhost:3000",
+		BcryptCost: 12,
+		Log:        DefaultLogConfig(),
+		Server:     DefaultServerConfig(),
+		Tracing:    DefaultTracingConfig(),
+		Database:   "postgres",
+		Throttle:   "redis",
+		Postgres:   DefaultPostgresConfig(),
+		SQLite:     DefaultSQLiteConfig(),
+		Redis:      DefaultRedisConfig(),
+		Cookie:     DefaultCookieConfig(),
+		Mailer:     DefaultMailerConfig(),
+		Features: FeatureConfig{
+			Signup:                true,
+			TOTPForPopularAuthors: true,
+		},
 	}
 }
 
-const srvArrd = ":3000"
+// Duration is a time.Duration written as "90s" or "2h" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// setting is a configuration value which can be set by an environment variable and a command line flag.
+type setting struct {
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// env returns the name of the environment variable for the setting, e.g. DIALOGUE_PG_HOST for pg-host.
+func (s setting) env() string {
+	return "DIALOGUE_" + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+func stringSetting(name, usage string, field func(c *Config) *string) setting {
+	return setting{name, usage, func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(name, usage string, field func(c *Config) *int) setting {
+	return setting{name, usage, func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(name, usage string, field func(c *Config) *bool) setting {
+	return setting{name, usage, func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func floatSetting(name, usage string, field func(c *Config) *float64) setting {
+	return setting{name, usage, func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = f
+		return nil
+	}}
+}
+
+func durationSetting(name, usage string, field func(c *Config) *Duration) setting {
+	return setting{name, usage, func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = Duration(d)
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("addr", "HTTP network address", func(c *Config) *string { return &c.Addr }),
+	stringSetting("base-url", "public URL of the app used in emails and redirects", func(c *Config) *string { return &c.BaseURL }),
+	stringSetting("secret", "key signing CSRF and email tokens", func(c *Config) *string { return &c.Secret }),
+	intSetting("bcrypt-cost", "bcrypt cost of password hashes", func(c *Config) *int { return &c.BcryptCost }),
+	stringSetting("debug-password", "password of the /debug section, which is disabled if empty", func(c *Config) *string { return &c.DebugPassword }),
+	boolSetting("dev", "serve templates and static files from ./ui and reload templates on change", func(c *Config) *bool { return &c.Dev }),
+
+	stringSetting("log-format", "log format, text or json", func(c *Config) *string { return &c.Log.Format }),
+	stringSetting("log-level", "minimum log level: debug, info, warn or error", func(c *Config) *string { return &c.Log.Level }),
+	durationSetting("log-slow-query", "log SQL statements slower than this as warnings", func(c *Config) *Duration { return &c.Log.SlowQuery }),
+
+	durationSetting("read-timeout", "maximum duration for reading a whole request", func(c *Config) *Duration { return &c.Server.ReadTimeout }),
+	durationSetting("write-timeout", "maximum duration for writing a response", func(c *Config) *Duration { return &c.Server.WriteTimeout }),
+	durationSetting("idle-timeout", "how long idle keep-alive connections are kept open", func(c *Config) *Duration { return &c.Server.IdleTimeout }),
+	durationSetting("shutdown-delay", "how long to keep serving after reporting not ready on shutdown", func(c *Config) *Duration { return &c.Server.ShutdownDelay }),
+	durationSetting("shutdown-timeout", "how long to wait for in-flight requests on shutdown", func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	stringSetting("tls-cert", "TLS certificate file", func(c *Config) *string { return &c.Server.TLSCertFile }),
+	stringSetting("tls-key", "TLS private key file", func(c *Config) *string { return &c.Server.TLSKeyFile }),
+	boolSetting("tls-self-signed", "serve TLS with a generated self-signed certificate (development only)", func(c *Config) *bool { return &c.Server.TLSSelfSigned }),
+
+	stringSetting("tracing-exporter", "export spans to otlp or stdout, tracing is disabled if empty", func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringSetting("tracing-endpoint", "URL of the OTLP/HTTP collector", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	floatSetting("tracing-sample-ratio", "fraction of traces recorded, from 0 to 1", func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+
+	stringSetting("database", "database storing stories and users: postgres or sqlite", func(c *Config) *string { return &c.Database }),
+	stringSetting("sqlite-path", "SQLite database file", func(c *Config) *string { return &c.SQLite.Path }),
+	stringSetting("pg-host", "PostgreSQL host", func(c *Config) *string { return &c.Postgres.Host }),
+	intSetting("pg-port", "PostgreSQL port", func(c *Config) *int { return &c.Postgres.Port }),
+	stringSetting("pg-user", "PostgreSQL user", func(c *Config) *string { return &c.Postgres.User }),
+	stringSetting("pg-password", "PostgreSQL password", func(c *Config) *string { return &c.Postgres.Password }),
+	stringSetting("pg-name", "PostgreSQL database name", func(c *Config) *string { return &c.Postgres.Name }),
+
+	stringSetting("throttle", "store counting login attempts: redis or memory", func(c *Config) *string { return &c.Throttle }),
+	stringSetting("redis-addr", "Redis address", func(c *Config) *string { return &c.Redis.Addr }),
+	stringSetting("redis-password", "Redis password", func(c *Config) *string { return &c.Redis.Password }),
+	intSetting("redis-db", "Redis database number", func(c *Config) *int { return &c.Redis.DB }),
+
+	stringSetting("cookie-domain", "domain attribute of cookies", func(c *Config) *string { return &c.Cookie.Domain }),
+	boolSetting("cookie-secure", "send cookies over HTTPS only", func(c *Config) *bool { return &c.Cookie.Secure }),
+	durationSetting("session-idle-timeout", "sign out sessions inactive for this long", func(c *Config) *Duration { return &c.Cookie.SessionIdleTimeout }),
+	durationSetting("session-max-age", "sign out sessions older than this", func(c *Config) *Duration { return &c.Cookie.SessionMaxAge }),
+
+	stringSetting("smtp-host", "SMTP host, emails are written to the outbox if empty", func(c *Config) *string { return &c.Mailer.Host }),
+	intSetting("smtp-port", "SMTP port", func(c *Config) *int { return &c.Mailer.Port }),
+	stringSetting("smtp-username", "SMTP username", func(c *Config) *string { return &c.Mailer.Username }),
+	stringSetting("smtp-password", "SMTP password", func(c *Config) *string { return &c.Mailer.Password }),
+	stringSetting("mail-from", "sender of emails", func(c *Config) *string { return &c.Mailer.From }),
+	stringSetting("outbox-dir", "directory emails are written to without SMTP", func(c *Config) *string { return &c.Mailer.OutboxDir }),
+	durationSetting("digest-interval", "how often notification digests are emailed, 0 disables them", func(c *Config) *Duration { return &c.Mailer.DigestInterval }),
+
+	boolSetting("signup", "allow new signups", func(c *Config) *bool { return &c.Features.Signup }),
+	boolSetting("require-verified-email", "refuse login to accounts with unverified email", func(c *Config) *bool { return &c.Features.RequireVerifiedEmail }),
+	boolSetting("totp-for-popular-authors", "require two-factor authentication from authors of popular stories", func(c *Config) *bool { return &c.Features.TOTPForPopularAuthors }),
+}
+
+// rawFlag records the value of a command line flag, which is applied after the file and the environment.
+type rawFlag struct {
+	value *string
+}
+
+func (f rawFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f rawFlag) Set(v string) error {
+	*f.value = v
+	return nil
+}
+
+// loadConfig builds the configuration from defaults, the file given by -config or DIALOGUE_CONFIG, the
+// environment and the command line args, then validates it.
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet("dialogue", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configPath := fs.String("config", getenv("DIALOGUE_CONFIG"), "path to a JSON config file (env DIALOGUE_CONFIG)")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = new(string)
+		fs.Var(rawFlag{flagValues[s.flag]}, s.flag, s.usage+" (env "+s.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	if *configPath != "" {
+		content, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(strings.NewReader(string(content)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.env()); v != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env(), err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(&cfg, f.Value.String()); setErr != nil {
+					err = fmt.Errorf("-%s: %w", s.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, cfg.Validate()
+}
+
+// Validate checks the configuration and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Addr != "", "addr must not be empty")
+	u, err := url.Parse(c.BaseURL)
+	check(err == nil && u.IsAbs() && u.Host != "", "base-url %q must be an absolute URL", c.BaseURL)
+	check(c.Secret == "" || len(c.Secret) >= 32, "secret must be at least 32 characters long")
+	check(c.DebugPassword == "" || len(c.DebugPassword) >= 16, "debug-password must be at least 16 characters long")
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+	_, err = logging.New(io.Discard, c.Log.Format, c.Log.Level)
+	check(err == nil, "%v", err)
+
+	check(c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0, "server timeouts must be positive")
+	check(c.Server.ShutdownDelay >= 0 && c.Server.ShutdownTimeout >= 0, "shutdown-delay and shutdown-timeout must not be negative")
+	check((c.Server.TLSCertFile == "") == (c.Server.TLSKeyFile == ""), "tls-cert and tls-key must be set together")
+	check(!c.Server.TLSSelfSigned || c.Server.TLSCertFile == "", "tls-self-signed can't be combined with tls-cert")
+
+	check(c.Tracing.Exporter == "" || c.Tracing.Exporter == "otlp" || c.Tracing.Exporter == "stdout", "tracing-exporter %q is neither otlp nor stdout", c.Tracing.Exporter)
+	if c.Tracing.Exporter == "otlp" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && u.IsAbs() && u.Host != "", "tracing-endpoint %q must be an absolute URL", c.Tracing.Endpoint)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing-sample-ratio must be between 0 and 1")
+
+	check(c.Database == "postgres" || c.Database == "sqlite", "database %q is neither postgres nor sqlite", c.Database)
+	if c.Database == "postgres" {
+		check(c.Postgres.Host != "", "pg-host must not be empty")
+		check(c.Postgres.Port > 0 && c.Postgres.Port < 65536, "pg-port %d is out of range", c.Postgres.Port)
+		check(c.Postgres.Name != "", "pg-name must not be empty")
+	} else if c.Database == "sqlite" {
+		check(c.SQLite.Path != "", "sqlite-path must not be empty")
+	}
+	check(c.Redis.Addr != "", "redis-addr must not be empty")
+	check(c.Throttle == "redis" || c.Throttle == "memory", "throttle %q is neither redis nor memory", c.Throttle)
+
+	check(c.Cookie.SessionIdleTimeout > 0, "session-idle-timeout must be positive")
+	check(c.Cookie.SessionMaxAge >= c.Cookie.SessionIdleTimeout, "session-max-age must not be shorter than session-idle-timeout")
+
+	if c.Mailer.Host != "" {
+		check(c.Mailer.Port > 0 && c.Mailer.Port < 65536, "smtp-port %d is out of range", c.Mailer.Port)
+	} else {
+		check(c.Mailer.OutboxDir != "", "outbox-dir must be set when smtp-host is empty")
+	}
+	check(c.Mailer.From != "", "mail-from must not be empty")
+	check(c.Mailer.DigestInterval >= 0, "digest-interval must not be negative")
+
+	names := make(map[string]bool)
+	for i, p := range c.OIDCProviders {
+		check(p.Name != "" && p.IssuerURL != "" && p.ClientID != "", "oidcProviders[%d] needs name, issuerURL and clientID", i)
+		check(!names[p.Name], "oidcProviders[%d]: duplicate name %q", i, p.Name)
+		names[p.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// secret returns the configured secret as bytes, or a random one if none is configured.
+func (c *Config) secret() ([]byte, bool) {
+	if c.Secret != "" {
+		return []byte(c.Secret), true
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b, false
+}
+
+// deriveKey derives a key for one purpose from the secret, so every purpose gets a different key.
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the configuration safe to be logged.
+func (c Config) Redacted() Config {
+	redact := func(v *string) {
+		if *v != "" {
+			*v = redactedValue
+		}
+	}
+	redact(&c.Secret)
+	redact(&c.DebugPassword)
+	redact(&c.Postgres.Password)
+	redact(&c.Redis.Password)
+	redact(&c.Mailer.Password)
+	providers := make([]OIDCProviderConfig, len(c.OIDCProviders))
+	copy(providers, c.OIDCProviders)
+	for i := range providers {
+		redact(&providers[i].ClientSecret)
+	}
+	c.OIDCProviders = providers
+	return c
+}
+
+// String renders the configuration with secrets redacted, so it is safe to print it anywhere.
+func (c Config) String() string {
+	jsonData, _ := json.Marshal(c.Redacted())
+	return string(jsonData)
+}
@@ -1,3 +1,8 @@
 package main
 
-const isAuthenticatedContextKey string = "isAuthenticated"
+const (
+	isAuthenticatedContextKey string = "isAuthenticated"
+	userIDContextKey          string = "userID"
+	sessionIDContextKey       string = "sessionID"
+	csrfTokenContextKey       string = "csrfToken"
+)
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+
+	// csrfCookieName holds a random ID for visitors without a session, so forms like login and signup are
+	// protected as well.
+	csrfCookieName = "csrf_id"
+)
+
+// csrfToken derives the token for the session (or anonymous visitor) with key. Tokens are not stored anywhere:
+// they are HMACs of the key, so they live exactly as long as the session does.
+func (app *application) csrfToken(key string) string {
+	mac := hmac.New(sha256.New, app.csrfSecret)
+	mac.Write([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfKey returns the value the CSRF token is bound to, issuing an anonymous ID cookie if the request has neither
+// a session nor such a cookie yet.
+func (app *application) csrfKey(c *gin.Context) string {
+	if sessionID := c.GetString(sessionIDContextKey); sessionID != "" {
+		return sessionID
+	}
+	if id, err := c.Cookie(csrfCookieName); err == nil && id != "" {
+		return id
+	}
+	id := randomToken()
+	app.setCookie(c, csrfCookieName, id, 0, "/")
+	return id
+}
+
+// csrfMiddleware puts the CSRF token of the request into the context and rejects state-changing requests
+// which do not carry it back either as a form field or as a header.
+func (app *application) csrfMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := app.csrfToken(app.csrfKey(c))
+		c.Set(csrfTokenContextKey, token)
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			c.Next()
+			return
+		}
+
+		//Browsers never attach bearer tokens on their own, so such API requests can't be forged cross-site.
+		if hasBearerToken(c) {
+			c.Next()
+			return
+		}
+
+		sent := c.GetHeader(csrfHeaderName)
+		if sent == "" {
+			sent = c.PostForm(csrfFieldName)
+		}
+		if !hmac.Equal([]byte(sent), []byte(token)) {
+			app.fail(c, errForbidden("The form has expired. Please reload the page and try again."))
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasBearerToken checks whether the request is authorized with a bearer token instead of cookies.
+func hasBearerToken(c *gin.Context) bool {
+	scheme, _, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	return ok && strings.EqualFold(scheme, "Bearer")
+}
+
+// csrfField renders the hidden input which every form posting to the app has to include.
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type='hidden' name='` + csrfFieldName + `' value='` + template.HTMLEscapeString(token) + `'>`)
+}
+
+// randomToken returns 32 random bytes encoded to be safe in cookies and URLs.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"dialogue/internal/metrics"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newCSRFTestApp() *application {
+	gin.SetMode(gin.TestMode)
+	cfg := DefaultConfig()
+	return &application{config: &cfg, csrfSecret: []byte("test-secret"), metrics: metrics.New(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)), templates: &templateCache{}}
+}
+
+// getCSRF performs a GET against the router and returns the anonymous CSRF cookie and the token bound to it.
+func getCSRF(t *testing.T, app *application, router http.Handler) (*http.Cookie, string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/about", nil))
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == csrfCookieName {
+			return cookie, app.csrfToken(cookie.Value)
+		}
+	}
+	t.Fatal("no CSRF cookie issued")
+	return nil, ""
+}
+
+func TestCSRFRejectsForgedRequests(t *testing.T) {
+	app := newCSRFTestApp()
+	router := app.routes()
+	cookie, token := getCSRF(t, app, router)
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		token  string
+	}{
+		{"delete story without token", "/firstblock?id=1", cookie, ""},
+		{"delete story with wrong token", "/firstblock?id=1", cookie, "forged"},
+		{"delete block without cookie", "/block?id=1", nil, token},
+		{"edit block with token of other visitor", "/editblock?id=1", &http.Cookie{Name: csrfCookieName, Value: "other"}, token},
+		{"logout without token", "/user/logout", cookie, ""},
+		{"password update without token", "/account/password/update", cookie, ""},
+		{"login without token", "/user/login", cookie, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.token != "" {
+				form.Set(csrfFieldName, tt.token)
+			}
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestCSRFAcceptsValidRequests(t *testing.T) {
+	app := newCSRFTestApp()
+	router := gin.New()
+	router.Use(app.csrfMiddleware())
+	router.POST("/submit", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	cookie, token := getCSRF(t, app, router)
+
+	t.Run("form field", func(t *testing.T) {
+		form := url.Values{csrfFieldName: {token}}
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("got status %d; want %d", rr.Code, http.StatusNoContent)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/submit", nil)
+		req.Header.Set(csrfHeaderName, token)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("got status %d; want %d", rr.Code, http.StatusNoContent)
+		}
+	})
+
+	t.Run("bearer API request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/submit", nil)
+		req.Header.Set("Authorization", "Bearer api-token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("got status %d; want %d", rr.Code, http.StatusNoContent)
+		}
+	})
+}
+
+func TestCSRFField(t *testing.T) {
+	got := string(csrfField(`a'b"c`))
+	want := `<input type='hidden' name='csrf_token' value='a&#39;b&#34;c'>`
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
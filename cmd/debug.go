@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// debugUser is the user name of the basic authentication of the /debug section. With it profiles can be fetched
+// directly, e.g. go tool pprof http://debug:<password>@localhost:3000/debug/pprof/heap.
+const debugUser = "debug"
+
+// requireDebugAuth lets only requests authenticated with the debug password through. The whole section is
+// hidden if no password is configured.
+func (app *application) requireDebugAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.config.DebugPassword == "" {
+			app.notFound(c)
+			return
+		}
+		user, password, ok := c.Request.BasicAuth()
+		//Hashes have equal length, so the comparison doesn't leak the length of the password.
+		userHash, wantUser := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(debugUser))
+		passwordHash, wantPassword := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(app.config.DebugPassword))
+		if !ok || subtle.ConstantTimeCompare(userHash[:], wantUser[:])&subtle.ConstantTimeCompare(passwordHash[:], wantPassword[:]) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// debugVars shows build info, the configuration with secrets redacted and connection pool stats.
+func (app *application) debugVars(c *gin.Context) {
+	build := gin.H{"goVersion": runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build["path"] = info.Path
+		build["version"] = info.Main.Version
+		for _, s := range info.Settings {
+			if strings.HasPrefix(s.Key, "vcs.") {
+				build[s.Key] = s.Value
+			}
+		}
+	}
+
+	pools := gin.H{"redis": app.redisClient.PoolStats()}
+	if sqlDB, err := app.db.DB(); err == nil {
+		pools["database"] = sqlDB.Stats()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"build":      build,
+		"startedAt":  app.startedAt,
+		"uptime":     time.Since(app.startedAt).Round(time.Second).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"config":     app.config.Redacted(),
+		"pools":      pools,
+	})
+}
+
+// profileWriteMargin is the time a profile gets to be written after it has been collected.
+const profileWriteMargin = 10 * time.Second
+
+// debugPprof serves the runtime profiles of net/http/pprof.
+func debugPprof(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		extendWriteDeadline(c, 30*time.Second)
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		extendWriteDeadline(c, time.Second)
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// extendWriteDeadline lets the response outlast the write timeout of the server by the time the profile is
+// collected for, the "seconds" parameter or fallback, as pprof does.
+func extendWriteDeadline(c *gin.Context, fallback time.Duration) {
+	duration := fallback
+	if seconds, err := strconv.ParseFloat(c.Query("seconds"), 64); err == nil && seconds > 0 {
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	//Writers without deadlines, like test recorders, have nothing to extend.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(duration + profileWriteMargin))
+}
+
+// buildVersion identifies the running build by its VCS revision, or by the module version if it has none.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return s.Value[:12]
+		}
+	}
+	return info.Main.Version
+}
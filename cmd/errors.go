@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpError is an error which is answered with its status and a message safe to be shown to the user.
+type httpError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *httpError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+func (e *httpError) Unwrap() error {
+	return e.Err
+}
+
+func errBadRequest(message string, err error) error {
+	return &httpError{Status: http.StatusBadRequest, Message: message, Err: err}
+}
+
+func errForbidden(message string) error {
+	return &httpError{Status: http.StatusForbidden, Message: message}
+}
+
+func errNotFound(message string) error {
+	return &httpError{Status: http.StatusNotFound, Message: message}
+}
+
+func errUnprocessable(message string, err error) error {
+	return &httpError{Status: http.StatusUnprocessableEntity, Message: message, Err: err}
+}
+
+// errorData is passed to the error page.
+type errorData struct {
+	Status  int
+	Title   string
+	Message string
+}
+
+// fail answers the request with the error page for err. Errors other than httpError are unexpected, they are
+// logged and answered with 500 Internal Server Error without details.
+func (app *application) fail(c *gin.Context, err error) {
+	var httpErr *httpError
+	if !errors.As(err, &httpErr) {
+		app.logServerError(c, err)
+		app.errorPage(c, http.StatusInternalServerError, internalErrorMessage)
+		return
+	}
+	if httpErr.Err != nil {
+		app.logger.InfoContext(c, "Client error", "status", httpErr.Status, "error", httpErr.Err)
+	}
+	app.errorPage(c, httpErr.Status, httpErr.Message)
+}
+
+const internalErrorMessage = "An unexpected error occurred."
+
+// serverError handles some unexpected errors.
+func (app *application) serverError(c *gin.Context, err error) {
+	app.logServerError(c, err)
+	app.errorPage(c, http.StatusInternalServerError, internalErrorMessage)
+}
+
+// logServerError logs the error with the place in the handler it was handled at, request attributes like the
+// request ID come from the context.
+func (app *application) logServerError(c *gin.Context, err error) {
+	attrs := []any{"error", err}
+	//Skip logServerError and serverError or fail to get to the handler.
+	if _, file, line, ok := runtime.Caller(2); ok {
+		attrs = append(attrs, "at", fmt.Sprintf("%s:%d", filepath.Base(file), line))
+	}
+	app.logger.ErrorContext(c, "Server error", attrs...)
+}
+
+// notFound answers that the requested page or story doesn't exist.
+func (app *application) notFound(c *gin.Context) {
+	app.fail(c, errNotFound("The page you are looking for doesn't exist."))
+}
+
+// errorPage aborts the request with the status and renders the error as JSON for API clients and as a page for
+// browsers. Nothing is written if the response has already been started.
+func (app *application) errorPage(c *gin.Context, status int, message string) {
+	c.Abort()
+	if c.Writer.Written() {
+		return
+	}
+	title := http.StatusText(status)
+
+	if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(status, gin.H{"error": title, "message": message})
+		return
+	}
+
+	ts, ok := app.templates.get("error.html")
+	if !ok {
+		c.String(status, "%s\n%s", title, message)
+		return
+	}
+	data := app.newTemplateData(c)
+	data.Error = errorData{Status: status, Title: title, Message: message}
+	//The page is rendered into a buffer first, so a failing template can still be answered with plain text.
+	var buf bytes.Buffer
+	if err := ts.ExecuteTemplate(&buf, "base", data); err != nil {
+		app.logger.ErrorContext(c, "Failed to render the error page", "error", err)
+		c.String(status, "%s\n%s", title, message)
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
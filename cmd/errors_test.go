@@ -0,0 +1,151 @@
+package main
+
+import (
+	"dialogue/ui"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newErrorTestApp returns an app with the embedded templates and static files.
+func newErrorTestApp(t *testing.T) *application {
+	t.Helper()
+	app := newCSRFTestApp()
+	staticFS, err := fs.Sub(ui.Files, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.assets, err = newStaticAssets(staticFS, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.templates, err = newTemplateCache(ui.Files, app.assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestErrorPagesNegotiateFormat(t *testing.T) {
+	app := newErrorTestApp(t)
+	router := app.routes()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		accept string
+		status int
+		json   bool
+	}{
+		{"unknown route as page", http.MethodGet, "/nowhere", "text/html", http.StatusNotFound, false},
+		{"unknown route as JSON", http.MethodGet, "/nowhere", "application/json", http.StatusNotFound, true},
+		{"invalid story ID", http.MethodGet, "/firstblock?id=abc", "text/html", http.StatusNotFound, false},
+		{"forged form as page", http.MethodPost, "/user/logout", "text/html", http.StatusForbidden, false},
+		{"forged form as JSON", http.MethodPost, "/user/logout", "application/json", http.StatusForbidden, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("got status %d; want %d", rr.Code, tt.status)
+			}
+			if tt.json {
+				var body struct{ Error, Message string }
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error != http.StatusText(tt.status) || body.Message == "" {
+					t.Errorf("unexpected JSON body %q", rr.Body.String())
+				}
+				return
+			}
+			if !strings.Contains(rr.Body.String(), "<h2>"+strconv.Itoa(tt.status)+" "+http.StatusText(tt.status)+"</h2>") {
+				t.Errorf("error page not rendered: %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRecoveryRendersErrorPage(t *testing.T) {
+	app := newErrorTestApp(t)
+	router := app.routes()
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), internalErrorMessage) {
+		t.Errorf("got status %d and body %q", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "boom") {
+		t.Error("panic value leaked into the page")
+	}
+}
+
+// TestRenderFailureIsAnError renders a page its data can't fill: the client gets the error page, not the part of
+// the page rendered before the failure with the status meant for success.
+func TestRenderFailureIsAnError(t *testing.T) {
+	app := newErrorTestApp(t)
+	router := app.routes()
+	router.GET("/broken", func(c *gin.Context) { app.render(c, http.StatusOK, "profile.html", app.newTemplateData(c)) })
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/broken", nil))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), internalErrorMessage) {
+		t.Errorf("got status %d and body %q", rr.Code, rr.Body.String())
+	}
+}
+
+// TestRenderedPagesAreChecked finds every page name handlers pass to render and checks that it is in pages, which
+// newTemplateCache makes sure exist.
+func TestRenderedPagesAreChecked(t *testing.T) {
+	listed := make(map[string]bool)
+	for _, page := range pages {
+		listed[page] = true
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "render" || len(call.Args) < 3 {
+				return true
+			}
+			if lit, ok := call.Args[2].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				page, _ := strconv.Unquote(lit.Value)
+				if !listed[page] {
+					t.Errorf("%s: page %s is rendered but not listed in pages", fset.Position(lit.Pos()), page)
+				}
+			}
+			return true
+		})
+	}
+
+	newErrorTestApp(t)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feeds list the latest stories, summaries are cut to summaryLength characters.
+const (
+	feedSize      = 20
+	summaryLength = 300
+)
+
+// atomFeed is an Atom 1.0 feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Link      atomLink   `xml:"link"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Summary   string     `xml:"summary"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// rssFeed is an RSS 2.0 feed.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// sitemap is a sitemap of the Sitemaps 0.9 protocol.
+type sitemap struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// feedSource is what a feed lists: its title, the page it mirrors and the stories.
+type feedSource struct {
+	Title   string
+	Path    string
+	Stories []models.CatalogueStory
+}
+
+// writeXML writes the document with the XML declaration.
+func writeXML(c *gin.Context, contentType string, v any) {
+	c.Header("Content-Type", contentType+"; charset=utf-8")
+	c.Status(http.StatusOK)
+	c.Writer.WriteString(xml.Header)
+	if err := xml.NewEncoder(c.Writer).Encode(v); err != nil {
+		c.Error(err)
+	}
+}
+
+// summary cuts the text of the first block to summaryLength characters.
+func summary(content string) string {
+	content = strings.TrimSpace(content)
+	if utf8.RuneCountInString(content) <= summaryLength {
+		return content
+	}
+	runes := []rune(content)
+	return strings.TrimSpace(string(runes[:summaryLength])) + "…"
+}
+
+// writeFeed writes the stories as RSS if the path asks for it, as Atom otherwise. Authors are looked up by ID
+// once per feed.
+func (app *application) writeFeed(c *gin.Context, source feedSource) {
+	base := app.config.BaseURL
+	authors := make(map[int]*models.User)
+	for _, story := range source.Stories {
+		if _, ok := authors[story.UserID]; ok {
+			continue
+		}
+		author, err := app.users.GetUser(c, story.UserID)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(c, err)
+			return
+		}
+		authors[story.UserID] = author
+	}
+	author := func(id int) atomAuthor {
+		if user := authors[id]; user != nil {
+			return atomAuthor{Name: user.NickName, URI: base + "/u/" + user.NickName}
+		}
+		return atomAuthor{Name: "Unknown author"}
+	}
+	//The feed is as new as its latest story, the start of the app stands in for an empty one.
+	updated := app.startedAt
+	for i, story := range source.Stories {
+		if i == 0 || story.UpdatedAt.After(updated) {
+			updated = story.UpdatedAt
+		}
+	}
+
+	if strings.HasSuffix(c.Request.URL.Path, ".rss") {
+		feed := rssFeed{Version: "2.0", Channel: rssChannel{
+			Title:         source.Title,
+			Link:          base + source.Path,
+			Description:   source.Title + " on Dialogue",
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+		}}
+		for _, story := range source.Stories {
+			link := base + "/firstblock?id=" + strconv.Itoa(story.ID)
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       story.StoryTitle + " by " + author(story.UserID).Name,
+				Link:        link,
+				GUID:        rssGUID{IsPermaLink: true, Value: link},
+				PubDate:     story.CreatedAt.UTC().Format(time.RFC1123Z),
+				Description: summary(story.FirstBlockContent),
+			})
+		}
+		writeXML(c, "application/rss+xml", feed)
+		return
+	}
+
+	feed := atomFeed{
+		Title:   source.Title,
+		ID:      base + c.Request.URL.Path,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + c.Request.URL.Path},
+			{Rel: "alternate", Type: "text/html", Href: base + source.Path},
+		},
+	}
+	for _, story := range source.Stories {
+		link := base + "/firstblock?id=" + strconv.Itoa(story.ID)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     story.StoryTitle,
+			ID:        link,
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+			Published: story.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   story.UpdatedAt.UTC().Format(time.RFC3339),
+			Author:    author(story.UserID),
+			Summary:   summary(story.FirstBlockContent),
+		})
+	}
+	writeXML(c, "application/atom+xml", feed)
+}
+
+// feedStories returns the latest public stories matching the query.
+func (app *application) feedStories(c *gin.Context, q models.CatalogueQuery) ([]models.CatalogueStory, error) {
+	q.Sort, q.Limit = models.SortNewest, feedSize
+	page, err := app.dialogues.Catalogue(c, q)
+	return page.Stories, err
+}
+
+// latestFeed serves the latest public stories of everyone.
+func (app *application) latestFeed(c *gin.Context) {
+	stories, err := app.feedStories(c, models.CatalogueQuery{})
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.writeFeed(c, feedSource{Title: "Latest stories", Path: "/stories", Stories: stories})
+}
+
+// authorFeed serves the latest public stories of the author with the nickname.
+func (app *application) authorFeed(c *gin.Context) {
+	author, err := app.users.GetByNickname(c, c.Param("nickname"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(c)
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+	stories, err := app.feedStories(c, models.CatalogueQuery{AuthorID: author.ID})
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.writeFeed(c, feedSource{Title: "Stories by " + author.NickName, Path: "/u/" + author.NickName, Stories: stories})
+}
+
+// tagFeed serves the latest public stories with the tag.
+func (app *application) tagFeed(c *gin.Context) {
+	tag, ok := models.NormalizeTag(c.Param("tag"))
+	if !ok {
+		app.notFound(c)
+		return
+	}
+	stories, err := app.feedStories(c, models.CatalogueQuery{Tag: tag})
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.writeFeed(c, feedSource{Title: "Stories tagged #" + tag, Path: "/tags/" + tag, Stories: stories})
+}
+
+// sitemap lists the catalogue and the pages of public stories for search engines.
+func (app *application) sitemap(c *gin.Context) {
+	stories, err := app.dialogues.SitemapStories(c, models.MaxSitemapStories)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	base := app.config.BaseURL
+	urls := sitemap{URLs: []sitemapURL{{Loc: base + "/home"}, {Loc: base + "/stories"}}}
+	for _, story := range stories {
+		urls.URLs = append(urls.URLs, sitemapURL{
+			Loc:     base + "/firstblock?id=" + strconv.Itoa(story.ID),
+			LastMod: story.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writeXML(c, "application/xml", urls)
+}
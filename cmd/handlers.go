@@ -7,16 +7,19 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type StoryForm struct {
-	Title   string `schema:"title"`
-	Content string `schema:"content"`
-	Options string `schema:"options"`
-	Privacy bool   `schema:"privacy"`
+	Title    string   `schema:"title"`
+	Content  string   `schema:"content"`
+	Options  string   `schema:"options"`
+	Privacy  bool     `schema:"privacy"`
+	Language string   `schema:"language"`
+	Genre    string   `schema:"genre"`
+	Tags     string   `schema:"tags"`
+	Warnings []string `schema:"warnings"`
 	validator.Validator
 }
 
@@ -40,10 +43,22 @@ type accountPasswordUpdateForm struct {
 	validator.Validator
 }
 
+type emailForm struct {
+	Email string `schema:"email"`
+	validator.Validator
+}
+
+type passwordResetForm struct {
+	Token                   string `schema:"token"`
+	NewPassword             string `schema:"newPassword"`
+	NewPasswordConfirmation string `schema:"newPasswordConfirmation"`
+	validator.Validator
+}
+
 // redirectHome redirects default query to the home page.
 func (app *application) redirectHomePage(c *gin.Context) {
 	if c.Request.URL.Path != "/" {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
 		return
 	}
 	c.Redirect(http.StatusFound, "/home")
@@ -54,9 +69,15 @@ func (app *application) homePage(c *gin.Context) {
 	//Get user ID from context.
 	userID := app.getID(c)
 
+	hidden, err := app.hiddenFor(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
 	//Pass related data and stories and render the page.
 	data := app.newTemplateData(c)
-	data.DataDialogues.DialoguesToDisplay = app.dialogues.Latest(userID)
+	data.DataDialogues.DialoguesToDisplay = app.dialogues.Latest(c, userID, hidden)
 	app.render(c, http.StatusOK, "home.html", data)
 }
 
@@ -72,11 +93,14 @@ func (app *application) createFB(c *gin.Context) {
 
 	//Get values from the form and store them into form variable.
 	var storyForm StoryForm
-	app.parse(c, &storyForm)
+	if err := app.parse(c, &storyForm); err != nil {
+		return
+	}
 
 	//Basic validations checks.
 	storyForm.CheckField(validator.NotBlank(storyForm.Title), "title", "This field cannot be blank")
 	storyForm.CheckField(validator.NotBlank(storyForm.Content), "content", "This field cannot be blank")
+	details := detailsFromForm(&storyForm)
 	if !storyForm.Valid() {
 		data := app.newTemplateData(c)
 		data.StoryForm = storyForm
@@ -89,7 +113,22 @@ func (app *application) createFB(c *gin.Context) {
 
 	//Get user ID from context and put gathered data into DB, then get the ID of fresh created first block of the story.
 	userID := app.getID(c)
-	newStoryID := app.dialogues.CreateFB(userID, storyForm.Title, storyForm.Content, optionsSlice, storyForm.Privacy)
+	newStoryID := app.dialogues.CreateFB(c, userID, storyForm.Title, storyForm.Content, optionsSlice, storyForm.Privacy)
+	if err := app.dialogues.SetDetails(c, newStoryID, details); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.metrics.StoriesCreated.Inc()
+
+	//Followers of the author learn about public stories.
+	if !storyForm.Privacy {
+		followers, err := app.users.Followers(c, userID)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		app.notify(c, models.NotifyStory, models.FirstBlock{ID: newStoryID, StoryTitle: storyForm.Title}, 0, followers...)
+	}
 
 	app.setFlash(c, "First step is done, and the story have been created!")
 	path := "firstblock?id=" + strconv.Itoa(int(newStoryID))
@@ -102,12 +141,48 @@ func (app *application) createdFBView(c *gin.Context) {
 	//Get the ID of fresh story.
 	storyID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
+		app.notFound(c)
 		return
 	}
 
 	//Get the data related to the story with ID and pass it to the view.
 	data := app.newTemplateData(c)
-	data.DataDialogues = app.dialogues.CreatedFBView(storyID)
+	data.DataDialogues = app.dialogues.CreatedFBView(c, storyID)
+	if data.DataDialogues.FirstBlock.ID == 0 {
+		app.notFound(c)
+		return
+	}
+	data.Details, err = app.dialogues.Details(c, storyID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	data.Author, err = app.users.GetUser(c, data.DataDialogues.FirstBlock.UserID)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(c, err)
+		return
+	}
+	data.Ratings, err = app.storyRatings(c, storyID, app.getID(c))
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	data.Review, err = app.storyReview(c, data.DataDialogues.FirstBlock, 0)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	//Opening the story by anybody but the author counts as a play and starts a reading, the author sees how
+	//readings went on the story map instead.
+	if story := data.DataDialogues.FirstBlock; story.UserID != app.getID(c) {
+		app.dialogues.CountPlay(c, story.ID)
+		app.metrics.PlaythroughsStarted.Inc()
+		app.startReading(c, story.ID)
+	} else if data.Analytics, err = app.storyAnalytics(c, data.DataDialogues.RelatedToStoryBlocks); err != nil {
+		app.serverError(c, err)
+		return
+	}
 	app.render(c, http.StatusOK, "renderFB.html", data)
 }
 
@@ -117,12 +192,22 @@ func (app *application) editFBView(c *gin.Context) {
 	//get the ID of the story and data of the first block.
 	storyID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
 
 	// Render the form for editing with existing data.
 	data := app.newTemplateData(c)
-	data.DataDialogues = app.dialogues.CreatedFBView(storyID)
+	data.DataDialogues = app.dialogues.CreatedFBView(c, storyID)
+	if data.DataDialogues.FirstBlock.ID == 0 {
+		app.notFound(c)
+		return
+	}
+	data.Details, err = app.dialogues.Details(c, storyID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
 	app.render(c, http.StatusOK, "editFB.html", data)
 }
 
@@ -131,17 +216,35 @@ func (app *application) editFB(c *gin.Context) {
 
 	//Parse edited data for the first block of a story.
 	var storyForm StoryForm
-	app.parse(c, &storyForm)
+	if err := app.parse(c, &storyForm); err != nil {
+		return
+	}
 	optionsSlice := strings.Split(storyForm.Options, "\r\n")
 
 	//Get ID of the story and update it's data with a new one.
 	storyID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
+	}
+
+	details := detailsFromForm(&storyForm)
+	if !storyForm.Valid() {
+		data := app.newTemplateData(c)
+		data.DataDialogues = app.dialogues.CreatedFBView(c, storyID)
+		data.Details = details
+		data.StoryForm = storyForm
+		app.render(c, http.StatusUnprocessableEntity, "editFB.html", data)
+		return
 	}
 
 	userID := app.getID(c)
-	app.dialogues.EditFB(storyID, userID, storyForm.Title, storyForm.Content, optionsSlice)
+	app.dialogues.EditFB(c, storyID, userID, storyForm.Title, storyForm.Content, optionsSlice)
+	if err := app.dialogues.SetDetails(c, storyID, details); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.metrics.BlocksEdited.Inc()
 	path := "firstblock?id=" + strconv.Itoa(storyID)
 	c.Redirect(http.StatusFound, path)
 }
@@ -150,9 +253,10 @@ func (app *application) editFB(c *gin.Context) {
 func (app *application) deleteFB(c *gin.Context) {
 	id, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
-	app.dialogues.DeleteFB(id)
+	app.dialogues.DeleteFB(c, id)
 	c.Redirect(http.StatusFound, "/home")
 }
 
@@ -162,12 +266,30 @@ func (app *application) createdBView(c *gin.Context) {
 	//Get ID of a block.
 	blockID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
 
 	//Retrieve data from database and render the block.
 	data := app.newTemplateData(c)
-	data.DataDialogues = app.dialogues.EditBView(blockID)
+	data.DataDialogues = app.dialogues.EditBView(c, blockID)
+	if data.DataDialogues.Block.ID == 0 {
+		app.notFound(c)
+		return
+	}
+	data.Review, err = app.storyReview(c, data.DataDialogues.RelatedToStoryBlocks.FirstBlock, blockID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.recordPick(c, data.DataDialogues.RelatedToStoryBlocks, blockID)
+	if data.DataDialogues.RelatedToStoryBlocks.FirstBlock.UserID == app.getID(c) {
+		data.Analytics, err = app.storyAnalytics(c, data.DataDialogues.RelatedToStoryBlocks)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+	}
 	app.render(c, http.StatusOK, "renderB.html", data)
 }
 
@@ -177,12 +299,17 @@ func (app *application) editBView(c *gin.Context) {
 	//Get ID of a block.
 	blockID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
 
 	// Render the form for editing with existing data.
 	data := app.newTemplateData(c)
-	data.DataDialogues = app.dialogues.EditBView(blockID)
+	data.DataDialogues = app.dialogues.EditBView(c, blockID)
+	if data.DataDialogues.Block.ID == 0 {
+		app.notFound(c)
+		return
+	}
 	app.render(c, http.StatusOK, "editB.html", data)
 }
 
@@ -191,7 +318,9 @@ func (app *application) editB(c *gin.Context) {
 
 	//Parse form and store it.
 	var blockForm StoryForm
-	app.parse(c, &blockForm)
+	if err := app.parse(c, &blockForm); err != nil {
+		return
+	}
 
 	//Parse options from the form and store them into the slice of strings.
 	optionsSlice := strings.Split(blockForm.Options, "\r\n")
@@ -199,11 +328,13 @@ func (app *application) editB(c *gin.Context) {
 	//Get ID of the editing block and update it's data with a new one.
 	blockID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
 
 	userID := app.getID(c)
-	app.dialogues.EditB(blockID, userID, blockForm.Title, blockForm.Content, optionsSlice)
+	app.dialogues.EditB(c, blockID, userID, blockForm.Title, blockForm.Content, optionsSlice)
+	app.metrics.BlocksEdited.Inc()
 	path := "block?id=" + strconv.Itoa(blockID)
 	c.Redirect(http.StatusFound, path)
 }
@@ -218,27 +349,39 @@ func (app *application) redirectBlock(c *gin.Context) {
 func (app *application) deleteB(c *gin.Context) {
 	blockID, err := strconv.Atoi(c.Request.URL.Query().Get("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		app.notFound(c)
+		return
 	}
-	app.dialogues.DeleteB(blockID)
+	app.dialogues.DeleteB(c, blockID)
 	c.Redirect(http.StatusFound, "/home")
 }
 
 // userSignupView renders the page for signing user up.
 func (app *application) userSignupView(c *gin.Context) {
+	if !app.config.Features.Signup {
+		app.notFound(c)
+		return
+	}
 	data := app.newTemplateData(c)
 	app.render(c, http.StatusOK, "signup.html", data)
 }
 
 // userSignup signs up a new user with provided data.
 func (app *application) userSignup(c *gin.Context) {
+	if !app.config.Features.Signup {
+		app.notFound(c)
+		return
+	}
 
 	//Parse provided form.
 	var userForm UserForm
-	app.parse(c, &userForm)
+	if err := app.parse(c, &userForm); err != nil {
+		return
+	}
 
 	//Basic validation checks.
 	userForm.CheckField(validator.NotBlank(userForm.Nickname), "nickname", "This field cannot be blank")
+	userForm.CheckField(validator.Matches(userForm.Nickname, models.NicknameRX), "nickname", "Use 3 to 30 letters, digits, dashes or underscores")
 	userForm.CheckField(validator.NotBlank(userForm.Email), "email", "This field cannot be blank")
 	userForm.CheckField(validator.Matches(userForm.Email, validator.EmailRX), "email", "This field must be a valid email address")
 	userForm.CheckField(validator.NotBlank(userForm.Password), "password", "This field cannot be blank")
@@ -250,85 +393,155 @@ func (app *application) userSignup(c *gin.Context) {
 		return
 	}
 
+	//Limit how often new accounts can be created from one address.
+	throttled, err := app.throttled(c, &userForm.Validator, "signup:ip:"+c.ClientIP())
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if throttled {
+		data := app.newTemplateData(c)
+		data.UserForm = userForm
+		app.render(c, http.StatusTooManyRequests, "signup.html", data)
+		return
+	}
+
 	//Save new user into the data base.
-	err := app.users.Insert(userForm.Nickname, userForm.Email, userForm.Password)
+	userID, err := app.users.Insert(c, userForm.Nickname, userForm.Email, userForm.Password)
 	if err != nil {
-		if errors.Is(err, models.ErrDuplicateEmail) {
+		switch {
+		case errors.Is(err, models.ErrDuplicateEmail):
 			userForm.AddFieldError("email", "Email address is already in use")
-			data := app.newTemplateData(c)
-			data.UserForm = userForm
-			app.render(c, http.StatusUnprocessableEntity, "signup.html", data)
-		} else {
+		case errors.Is(err, models.ErrDuplicateNickname):
+			userForm.AddFieldError("nickname", "Nickname is already taken")
+		default:
 			app.serverError(c, err)
+			return
 		}
+		data := app.newTemplateData(c)
+		data.UserForm = userForm
+		app.render(c, http.StatusUnprocessableEntity, "signup.html", data)
+		return
+	}
+
+	//Send the link confirming the email address. The account is kept if it fails, the user can ask for a new link.
+	err = app.sendVerificationEmail(c, &models.User{ID: userID, NickName: userForm.Nickname, Email: userForm.Email})
+	if err != nil {
+		app.logger.ErrorContext(c, "Failed to send the confirmation email", "user", userID, "error", err)
+		app.setFlash(c, "You successfully signed up, but we couldn't send the confirmation email. Please, ask for a new link.")
+		c.Redirect(http.StatusFound, "/user/verify/resend")
 		return
 	}
 
-	app.setFlash(c, "You successfully signed up. Please, log in for more content.")
+	app.setFlash(c, "You successfully signed up. Please, confirm your email and log in for more content.")
 	c.Redirect(http.StatusFound, "/user/login")
 }
 
 // userLoginView renders the page for logging user in.
 func (app *application) userLoginView(c *gin.Context) {
+	app.render(c, http.StatusOK, "login.html", app.loginData(c, UserLoginForm{}))
+}
+
+// loginData returns the data of the login page showing the form and the single sign-on providers.
+func (app *application) loginData(c *gin.Context, form UserLoginForm) *data {
 	data := app.newTemplateData(c)
-	app.render(c, http.StatusOK, "login.html", data)
+	data.UserLoginForm = form
+	data.LoginProviders = app.loginProviders()
+	return data
 }
 
 // userLogin logs user in.
 func (app *application) userLogin(c *gin.Context) {
-	app.setFlash(c, "You logged in with a geat success.")
 
 	//Parse provided form.
 	var userForm UserLoginForm
-	app.parse(c, &userForm)
+	if err := app.parse(c, &userForm); err != nil {
+		return
+	}
 
 	//Basic validations check.
 	userForm.CheckField(validator.NotBlank(userForm.Email), "email", "This field cannot be blank")
 	userForm.CheckField(validator.Matches(userForm.Email, validator.EmailRX), "email", "This field must be a valid email address")
 	userForm.CheckField(validator.NotBlank(userForm.Password), "password", "This field cannot be blank")
 	if !userForm.Valid() {
-		data := app.newTemplateData(c)
-		data.UserLoginForm = userForm
-		app.render(c, http.StatusUnprocessableEntity, "login.html", data)
+		app.render(c, http.StatusUnprocessableEntity, "login.html", app.loginData(c, userForm))
+		return
+	}
+
+	//Throttle attempts by address and by account before doing any expensive work.
+	emailKey := "login:email:" + strings.ToLower(userForm.Email)
+	throttled, err := app.throttled(c, &userForm.Validator, "login:ip:"+c.ClientIP(), emailKey)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if throttled {
+		app.render(c, http.StatusTooManyRequests, "login.html", app.loginData(c, userForm))
 		return
 	}
 
 	//Authenticate user and log him in if no errors.
-	userID, err := app.users.Authenticate(userForm.Email, userForm.Password)
+	userID, err := app.users.Authenticate(c, userForm.Email, userForm.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
+			app.metrics.LoginFailures.WithLabelValues("password").Inc()
+			if err := app.recordFailure(c, emailKey, 0, userForm.Email); err != nil {
+				app.serverError(c, err)
+				return
+			}
 			userForm.AddNonFieldError("Email or password is incorrect")
-			data := app.newTemplateData(c)
-			data.UserLoginForm = userForm
-			app.render(c, http.StatusUnprocessableEntity, "login.html", data)
+			app.render(c, http.StatusUnprocessableEntity, "login.html", app.loginData(c, userForm))
+		} else if errors.Is(err, models.ErrUnverifiedEmail) {
+			userForm.AddNonFieldError("Please confirm your email address first")
+			data := app.loginData(c, userForm)
+			data.ShowResendVerification = true
+			app.render(c, http.StatusForbidden, "login.html", data)
 		} else {
 			app.serverError(c, err)
 		}
 		return
 	}
 
-	//Generate new session ID for the user and save related data via cookies.
-	sessionID := generateSessionID()
-	c.SetCookie("session_id", sessionID, 3600, "/", "", false, true)
-	sessionData := map[string]any{
-		"userID":       userID,
-		"createdAt":    time.Now().Unix(),
-		"lastActiveAt": time.Now().Unix(),
+	if err := app.throttle.Succeed(c, emailKey); err != nil {
+		app.serverError(c, err)
+		return
 	}
-	app.redisClient.Set(c, sessionID, serialize(sessionData), 12*time.Hour)
-	app.redisClient.Set(c, sessionID+":userID", userID, 12*time.Hour)
 
+	//Users with two-factor authentication have to pass the second step first.
+	user, err := app.users.GetUser(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if user.TOTPEnabled {
+		if err := app.startTOTPLogin(c, userID); err != nil {
+			app.serverError(c, err)
+			return
+		}
+		c.Redirect(http.StatusFound, "/user/login/totp")
+		return
+	}
+
+	//Start a new session for the user, the one the request may carry is dropped.
+	if err := app.newSession(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	app.setFlash(c, "You logged in with a geat success.")
 	c.Redirect(http.StatusFound, "/home")
 }
 
 // userLogoutPost logouts the user and destroy current session.
 func (app *application) userLogout(c *gin.Context) {
-	sessionID, err := c.Cookie("session_id")
-	if err == nil {
-		app.redisClient.Del(c, sessionID)
+	if sessionID := app.sessionID(c); sessionID != "" {
+		if err := app.destroySession(c, sessionID); err != nil {
+			app.serverError(c, err)
+			return
+		}
 	}
-	c.SetCookie("session_id", "", -1, "/", "", false, true)
-	c.SetCookie("flash_message", "You logged out with a great success", 5, "/", "", false, true)
+	app.setCookie(c, sessionCookieName, "", -1, "/")
+	app.setCookie(c, "flash_message", "You logged out with a great success", 5, "/")
 
 	c.Redirect(http.StatusFound, "/home")
 }
@@ -338,7 +551,7 @@ func (app *application) accountView(c *gin.Context) {
 
 	//Get user ID and then other data related to the user.
 	userID := app.getID(c)
-	user, err := app.users.GetUser(userID)
+	user, err := app.users.GetUser(c, userID)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
 			c.Redirect(http.StatusFound, "/user/login")
@@ -348,9 +561,23 @@ func (app *application) accountView(c *gin.Context) {
 		return
 	}
 
+	//Get the sessions the user is signed in with.
+	sessions, err := app.userSessions(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	favorites, err := app.dialogues.Favorites(c, userID, user.Hidden())
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
 	//Renders the page with all related data.
 	data := app.newTemplateData(c)
 	data.UserData = user
+	data.Sessions = sessions
+	data.Favorites = favorites
 	app.render(c, http.StatusOK, "account.html", data)
 }
 
@@ -367,7 +594,9 @@ func (app *application) passwordUpdate(c *gin.Context) {
 	//Parse the form provided by the user.
 
 	var passwordForm accountPasswordUpdateForm
-	app.parse(c, &passwordForm)
+	if err := app.parse(c, &passwordForm); err != nil {
+		return
+	}
 
 	//Basic validations check.
 	passwordForm.CheckField(validator.NotBlank(passwordForm.CurrentPassword), "currentPassword", "This field cannot be blank")
@@ -385,23 +614,208 @@ func (app *application) passwordUpdate(c *gin.Context) {
 	//Get ID of a user.
 	userID := app.getID(c)
 
+	//Throttle attempts to guess the current password.
+	userKey := "password:user:" + strconv.Itoa(userID)
+	throttled, err := app.throttled(c, &passwordForm.Validator, "password:ip:"+c.ClientIP(), userKey)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if throttled {
+		data := app.newTemplateData(c)
+		data.PasswordForm = passwordForm
+		app.render(c, http.StatusTooManyRequests, "password.html", data)
+		return
+	}
+
 	//Update password with new information.
-	err := app.users.PasswordUpdate(userID, passwordForm.CurrentPassword, passwordForm.NewPassword)
+	err = app.users.PasswordUpdate(c, userID, passwordForm.CurrentPassword, passwordForm.NewPassword)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
+			if err := app.recordFailure(c, userKey, userID, strconv.Itoa(userID)); err != nil {
+				app.serverError(c, err)
+				return
+			}
 			passwordForm.AddFieldError("currentPassword", "Current password is incorrect")
 			data := app.newTemplateData(c)
 			data.PasswordForm = passwordForm
-			app.render(c, http.StatusUnprocessableEntity, "password.tmpl", data)
+			app.render(c, http.StatusUnprocessableEntity, "password.html", data)
 		} else {
 			app.serverError(c, err)
 		}
 		return
 	}
+	if err := app.throttle.Succeed(c, userKey); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	//Sign out every other device and rotate the current session.
+	if err := app.destroyUserSessions(c, userID, app.sessionID(c)); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.newSession(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
 	app.setFlash(c, "Password successfully updated.")
 	c.Redirect(http.StatusFound, "/account/view")
 }
 
+// verifyEmail confirms the email address of the user with the token sent by email.
+func (app *application) verifyEmail(c *gin.Context) {
+	userID, err := app.tokens.Consume(c.Query("token"), models.ScopeVerification)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			app.setFlash(c, "The confirmation link is invalid or has expired. Please, request a new one.")
+			c.Redirect(http.StatusFound, "/user/verify/resend")
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+	if err := app.users.MarkVerified(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "Your email address has been confirmed.")
+	c.Redirect(http.StatusFound, "/user/login")
+}
+
+// resendVerificationView renders the form requesting a new confirmation link.
+func (app *application) resendVerificationView(c *gin.Context) {
+	data := app.newTemplateData(c)
+	app.render(c, http.StatusOK, "resend.html", data)
+}
+
+// resendVerification sends a new confirmation link if the account exists and is not verified yet.
+func (app *application) resendVerification(c *gin.Context) {
+	var form emailForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	app.emailAction(c, &form, "resend.html", "verify", func(user *models.User) error {
+		if user.EmailVerified {
+			return nil
+		}
+		return app.sendVerificationEmail(c, user)
+	})
+}
+
+// forgotPasswordView renders the form requesting a password reset link.
+func (app *application) forgotPasswordView(c *gin.Context) {
+	data := app.newTemplateData(c)
+	app.render(c, http.StatusOK, "forgot.html", data)
+}
+
+// forgotPassword sends a password reset link if the account exists.
+func (app *application) forgotPassword(c *gin.Context) {
+	var form emailForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	app.emailAction(c, &form, "forgot.html", "forgot", func(user *models.User) error {
+		return app.sendPasswordResetEmail(c, user)
+	})
+}
+
+// emailAction validates the form, throttles the requests and runs send for the user with the email. The response
+// is the same whether the account exists or not, so the form can't be used to find out registered addresses.
+func (app *application) emailAction(c *gin.Context, form *emailForm, page, action string, send func(*models.User) error) {
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	if !form.Valid() {
+		data := app.newTemplateData(c)
+		data.EmailForm = *form
+		app.render(c, http.StatusUnprocessableEntity, page, data)
+		return
+	}
+
+	throttled, err := app.throttled(c, &form.Validator, action+":ip:"+c.ClientIP(), action+":email:"+strings.ToLower(form.Email))
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if throttled {
+		data := app.newTemplateData(c)
+		data.EmailForm = *form
+		app.render(c, http.StatusTooManyRequests, page, data)
+		return
+	}
+
+	user, err := app.users.GetByEmail(c, form.Email)
+	if err == nil {
+		err = send(user)
+	}
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "If an account with this address exists, we have sent an email to it.")
+	c.Redirect(http.StatusFound, "/user/login")
+}
+
+// resetPasswordView renders the form setting a new password with the token from the reset link.
+func (app *application) resetPasswordView(c *gin.Context) {
+	data := app.newTemplateData(c)
+	data.PasswordResetForm = passwordResetForm{Token: c.Query("token")}
+	app.render(c, http.StatusOK, "reset.html", data)
+}
+
+// resetPassword sets a new password for the user the token was issued to and signs out all of the user's sessions.
+func (app *application) resetPassword(c *gin.Context) {
+	var form passwordResetForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+
+	//Basic validations check.
+	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.NewPassword, 8), "newPassword", "This field must be at least 8 characters long")
+	form.CheckField(validator.NotBlank(form.NewPasswordConfirmation), "newPasswordConfirmation", "This field cannot be blank")
+	form.CheckField(form.NewPassword == form.NewPasswordConfirmation, "newPasswordConfirmation", "Passwords do not match")
+	if !form.Valid() {
+		data := app.newTemplateData(c)
+		data.PasswordResetForm = form
+		app.render(c, http.StatusUnprocessableEntity, "reset.html", data)
+		return
+	}
+
+	userID, err := app.tokens.Consume(form.Token, models.ScopePasswordReset)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			app.setFlash(c, "The reset link is invalid or has expired. Please, request a new one.")
+			c.Redirect(http.StatusFound, "/user/password/forgot")
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+
+	//Only the owner of the address could follow the link, so the address is verified as well.
+	if err := app.users.PasswordReset(c, userID, form.NewPassword); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.users.MarkVerified(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.tokens.DeleteAllForUser(models.ScopePasswordReset, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.destroyUserSessions(c, userID, ""); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	app.setFlash(c, "Your password has been reset. Please, log in with the new one.")
+	c.Redirect(http.StatusFound, "/user/login")
+}
+
 // about contains basic idea of the site.
 func (app *application) about(c *gin.Context) {
 	data := app.newTemplateData(c)
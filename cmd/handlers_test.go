@@ -0,0 +1,970 @@
+package main
+
+import (
+	"context"
+	"dialogue/internal/mailer"
+	"dialogue/internal/metrics"
+	"dialogue/internal/mockoidc"
+	"dialogue/internal/models"
+	"dialogue/internal/ratelimit"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newHandlerTestApp returns an app keeping stories and users in memory, with Redis faked by miniredis.
+func newHandlerTestApp(t *testing.T) *application {
+	t.Helper()
+	app := newErrorTestApp(t)
+	app.dialogues = &models.MemoryDialogueModel{}
+	app.users = &models.MemoryUserModel{BcryptCost: bcrypt.MinCost}
+	app.redisClient = redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	app.throttle = &ratelimit.Throttle{
+		Store:           &ratelimit.RedisStore{Client: app.redisClient, Prefix: "ratelimit:"},
+		Rate:            1,
+		Burst:           100,
+		MaxFailures:     5,
+		FailureWindow:   time.Minute,
+		LockoutDuration: time.Minute,
+	}
+	return app
+}
+
+// testClient is a browser for the app: it keeps cookies, doesn't follow redirects and sends CSRF tokens.
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestClient(t *testing.T, app *application) *testClient {
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(server.Close)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &testClient{t: t, server: server, client: client}
+}
+
+func (tc *testClient) do(req *http.Request) (int, string, string) {
+	tc.t.Helper()
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body), resp.Header.Get("Location")
+}
+
+// get returns the status, body and redirect location of the response.
+func (tc *testClient) get(path string) (int, string, string) {
+	tc.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, tc.server.URL+path, nil)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return tc.do(req)
+}
+
+var csrfFieldRX = regexp.MustCompile(`name='csrf_token' value='([^']+)'`)
+
+// post submits the form with the CSRF token taken from the page at tokenPath, like a browser submitting a form
+// of that page.
+func (tc *testClient) post(tokenPath, path string, form url.Values) (int, string, string) {
+	tc.t.Helper()
+	_, body, _ := tc.get(tokenPath)
+	match := csrfFieldRX.FindStringSubmatch(body)
+	if match == nil {
+		tc.t.Fatalf("no CSRF token on %s", tokenPath)
+	}
+	form.Set(csrfFieldName, match[1])
+	req, err := http.NewRequest(http.MethodPost, tc.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return tc.do(req)
+}
+
+// login signs a new user up directly in the repository and logs in through the login form.
+func (tc *testClient) login(app *application, nickname string) int {
+	tc.t.Helper()
+	email := nickname + "@example.com"
+	userID, err := app.users.Insert(context.Background(), nickname, email, "pa55word-long")
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	status, _, location := tc.post("/user/login", "/user/login", url.Values{"email": {email}, "password": {"pa55word-long"}})
+	if status != http.StatusFound || location != "/home" {
+		tc.t.Fatalf("login got status %d and location %q", status, location)
+	}
+	return userID
+}
+
+// options returns the option texts of the story or block by the IDs of the blocks they lead to.
+func options(data models.DialoguesData) map[int]string {
+	result := make(map[int]string)
+	for _, option := range data.OptionsToBlocks {
+		for id, text := range option {
+			result[id] = text
+		}
+	}
+	return result
+}
+
+// blockIDs returns the IDs of all blocks of the story except the first one.
+func blockIDs(related models.RelatedToStoryBlocks) []int {
+	var ids []int
+	for _, block := range related.OtherBlocks {
+		ids = append(ids, block.ID)
+	}
+	return ids
+}
+
+// TestStoryLifecycle writes a story with branches, edits it with option commands and deletes it piece by piece.
+func TestStoryLifecycle(t *testing.T) {
+	app := newHandlerTestApp(t)
+	tc := newTestClient(t, app)
+	ctx := context.Background()
+	authorID := tc.login(app, "author")
+
+	//Creating a story creates an empty block for every option of the first block.
+	status, _, location := tc.post("/newfirstblock", "/newfirstblock", url.Values{
+		"title":   {"The crossroads"},
+		"content": {"Where do you go?"},
+		"options": {"Left\r\nRight"},
+	})
+	if status != http.StatusFound || location != "/firstblock?id=1" {
+		t.Fatalf("creating got status %d and location %q", status, location)
+	}
+	story := app.dialogues.CreatedFBView(ctx, 1)
+	if story.FirstBlock.UserID != authorID || story.FirstBlock.StoryTitle != "The crossroads" {
+		t.Errorf("story saved as %+v", story.FirstBlock)
+	}
+	if got := options(story); len(got) != 2 || got[1] != "Left" || got[2] != "Right" {
+		t.Fatalf("first block options are %v", got)
+	}
+	status, body, _ := tc.get("/firstblock?id=1")
+	if status != http.StatusOK || !strings.Contains(body, `<a href="/block?id=2&from=0">Right</a>`) {
+		t.Errorf("story page got status %d: %s", status, body)
+	}
+
+	//Left leads deeper, Right to a block which is also reached from the deeper one.
+	tc.post("/editblock?id=1", "/editblock?id=1", url.Values{"content": {"A dark forest."}, "options": {"add Deeper"}})
+	tc.post("/editblock?id=2", "/editblock?id=2", url.Values{"content": {"A river."}, "options": {"add Shared"}})
+	status, _, location = tc.post("/editblock?id=3", "/editblock?id=3", url.Values{
+		"content": {"A cave."},
+		"options": {"addTo 4 Swim to the shared place\r\nchange 4 Dive to the shared place"},
+	})
+	if status != http.StatusFound || location != "/block?id=3" {
+		t.Fatalf("editing got status %d and location %q", status, location)
+	}
+	if got := options(app.dialogues.EditBView(ctx, 3)); len(got) != 1 || got[4] != "Dive to the shared place" {
+		t.Errorf("block 3 options are %v", got)
+	}
+	if got := blockIDs(app.dialogues.RetrieveBlocks(ctx, 1)); len(got) != 4 {
+		t.Fatalf("story has blocks %v", got)
+	}
+
+	//Deleting Left removes the blocks only it leads to, the shared block survives.
+	status, _, _ = tc.post("/editfirstblock?id=1", "/editfirstblock?id=1", url.Values{
+		"title":   {"The crossroads"},
+		"content": {"Where do you go now?"},
+		"options": {"delete 1"},
+	})
+	if status != http.StatusFound {
+		t.Fatalf("editing the first block got status %d", status)
+	}
+	story = app.dialogues.CreatedFBView(ctx, 1)
+	if got := options(story); len(got) != 1 || got[2] != "Right" {
+		t.Errorf("first block options are %v", got)
+	}
+	if got := blockIDs(story.RelatedToStoryBlocks); len(got) != 2 || got[0] != 2 || got[1] != 4 {
+		t.Errorf("story has blocks %v; want [2 4]", got)
+	}
+	if status, _, _ := tc.get("/block?id=3"); status != http.StatusNotFound {
+		t.Errorf("deleted block got status %d", status)
+	}
+
+	//Deleting Right takes the shared block with it, it has no other parent left.
+	tc.post("/block?id=2", "/block?id=2", url.Values{})
+	if got := blockIDs(app.dialogues.RetrieveBlocks(ctx, 1)); len(got) != 0 {
+		t.Errorf("story has blocks %v; want none", got)
+	}
+
+	status, _, location = tc.post("/firstblock?id=1", "/firstblock?id=1", url.Values{})
+	if status != http.StatusFound || location != "/home" {
+		t.Errorf("deleting got status %d and location %q", status, location)
+	}
+	if status, _, _ := tc.get("/firstblock?id=1"); status != http.StatusNotFound {
+		t.Errorf("deleted story got status %d", status)
+	}
+}
+
+// TestReadingStories checks which stories readers see and that their plays are counted.
+func TestReadingStories(t *testing.T) {
+	app := newHandlerTestApp(t)
+	ctx := context.Background()
+	author := newTestClient(t, app)
+	authorID := author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Public tale"}, "content": {"Once."}, "options": {"Go"}})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Secret diary"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}})
+
+	_, body, _ := author.get("/home")
+	if !strings.Contains(body, "Public tale") || !strings.Contains(body, "Secret diary") {
+		t.Error("author doesn't see both stories")
+	}
+
+	reader := newTestClient(t, app)
+	reader.login(app, "reader")
+	_, body, _ = reader.get("/home")
+	if !strings.Contains(body, "Public tale") || strings.Contains(body, "Secret diary") {
+		t.Error("reader sees the private story or misses the public one")
+	}
+
+	author.get("/firstblock?id=1")
+	reader.get("/firstblock?id=1")
+	reader.get("/firstblock?id=1")
+	if plays, _ := app.dialogues.MostPlayed(ctx, authorID); plays != 2 {
+		t.Errorf("got %d plays; want 2, the author's own reading doesn't count", plays)
+	}
+}
+
+// TestSearchPage checks that search results respect privacy and highlight the words searched for.
+func TestSearchPage(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Dragon lair"}, "content": {"A dragon sleeps."}, "options": {"Wake it"}})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Dragon diary"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}})
+	author.post("/editblock?id=1", "/editblock?id=1", url.Values{"content": {"The dragon <wakes>."}})
+
+	reader := newTestClient(t, app)
+	status, body, _ := reader.get("/search?q=dragon")
+	if status != http.StatusOK {
+		t.Fatalf("search got status %d", status)
+	}
+	if !strings.Contains(body, `<a href='/firstblock?id=1'>Dragon lair</a>`) || !strings.Contains(body, `<a href='/block?id=1'>`) {
+		t.Errorf("results don't link to the story and the block: %s", body)
+	}
+	if !strings.Contains(body, "The <mark>dragon</mark> &lt;wakes&gt;.") {
+		t.Errorf("snippet isn't highlighted or escaped: %s", body)
+	}
+	if strings.Contains(body, "Dragon diary") {
+		t.Error("reader finds the private story")
+	}
+
+	if _, body, _ := author.get("/search?q=dragon"); !strings.Contains(body, "Dragon diary") {
+		t.Error("author doesn't find the private story")
+	}
+	if _, body, _ := reader.get("/search?q=unicorn"); !strings.Contains(body, "Nothing matches") {
+		t.Error("search without results doesn't say so")
+	}
+}
+
+// TestCataloguePage pages through the catalogue as HTML and JSON and checks the tabs.
+func TestCataloguePage(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	for _, title := range []string{"First", "Second", "Third"} {
+		author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {title}, "content": {"Once."}, "options": {"Go"}, "language": {"en"}})
+	}
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Secret"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}})
+
+	reader := newTestClient(t, app)
+	status, body, _ := reader.get("/stories?limit=2")
+	if status != http.StatusOK || !strings.Contains(body, "Third") || !strings.Contains(body, "Second") || strings.Contains(body, "Secret") {
+		t.Fatalf("first page got status %d: %s", status, body)
+	}
+	next := regexp.MustCompile(`<a href='(/stories\?[^']+)'>Older stories</a>`).FindStringSubmatch(body)
+	if next == nil {
+		t.Fatal("first page doesn't link to the next one")
+	}
+	req, _ := http.NewRequest(http.MethodGet, reader.server.URL+html.UnescapeString(next[1]), nil)
+	req.Header.Set("Accept", "application/json")
+	status, body, _ = reader.do(req)
+	var page struct {
+		Stories []catalogueStory
+		Next    string
+	}
+	if err := json.Unmarshal([]byte(body), &page); err != nil || status != http.StatusOK {
+		t.Fatalf("next page got status %d and %v: %s", status, err, body)
+	}
+	if len(page.Stories) != 1 || page.Stories[0].Title != "First" || page.Stories[0].Language != "en" || page.Next != "" {
+		t.Errorf("next page is %+v", page)
+	}
+
+	if status, _, _ := reader.get("/stories?after=garbage"); status != http.StatusBadRequest {
+		t.Errorf("broken cursor got status %d", status)
+	}
+	if status, _, _ := reader.get("/stories?sort=best"); status != http.StatusBadRequest {
+		t.Errorf("unknown order got status %d", status)
+	}
+	if status, _, location := reader.get("/stories?tab=mine"); status != http.StatusFound || location != "/user/login" {
+		t.Errorf("anonymous reader's stories got status %d and location %q", status, location)
+	}
+	if _, body, _ := author.get("/stories?tab=mine"); !strings.Contains(body, "Secret") {
+		t.Error("author's tab misses the private story")
+	}
+}
+
+// TestTagsAndWarnings tags stories, lists them on tag pages and hides the ones with warnings the reader hides.
+func TestTagsAndWarnings(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{
+		"title": {"Dragons"}, "content": {"Once."}, "options": {"Go"}, "genre": {"fantasy"}, "tags": {"Big Dragons, magic, magic"},
+	})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{
+		"title": {"Duel"}, "content": {"Once."}, "options": {"Go"}, "tags": {"big-dragons"}, "warnings": {"violence"},
+	})
+	status, body, _ := author.post("/newfirstblock", "/newfirstblock", url.Values{
+		"title": {"Broken"}, "content": {"Once."}, "options": {"Go"}, "tags": {"no/slashes"},
+	})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, "Tags have up to") {
+		t.Errorf("invalid tag got status %d", status)
+	}
+
+	_, body, _ = author.get("/firstblock?id=1")
+	if !strings.Contains(body, `<a class="tag" href="/tags/big-dragons">#big-dragons</a>`) || !strings.Contains(body, "fantasy") {
+		t.Errorf("story page doesn't show the details: %s", body)
+	}
+	_, body, _ = author.get("/editfirstblock?id=1")
+	if !strings.Contains(body, `value="big-dragons, magic"`) {
+		t.Errorf("edit form doesn't keep the tags: %s", body)
+	}
+
+	reader := newTestClient(t, app)
+	reader.login(app, "reader")
+	_, body, _ = reader.get("/tags/Big-Dragons")
+	if !strings.Contains(body, "Stories tagged #big-dragons") || !strings.Contains(body, "Dragons") || !strings.Contains(body, "Duel") {
+		t.Errorf("tag page misses stories: %s", body)
+	}
+	_, body, _ = reader.get("/tags/suggest?q=ma")
+	if body != `{"tags":[{"name":"magic","stories":1}]}` {
+		t.Errorf("suggestions are %s", body)
+	}
+
+	status, _, _ = reader.post("/account/view", "/account/warnings", url.Values{"warnings": {"violence"}})
+	if status != http.StatusFound {
+		t.Fatalf("saving hidden warnings got status %d", status)
+	}
+	if _, body, _ := reader.get("/account/view"); !strings.Contains(body, `value='violence' checked`) {
+		t.Error("account page doesn't show the hidden warning")
+	}
+	_, body, _ = reader.get("/tags/big-dragons")
+	if !strings.Contains(body, "Dragons") || strings.Contains(body, "Duel") {
+		t.Errorf("reader hiding violence sees %s", body)
+	}
+}
+
+// TestProfiles signs an author up, shows the author's profile and stories and keeps nicknames unique.
+func TestProfiles(t *testing.T) {
+	app := newHandlerTestApp(t)
+	app.config.Features.Signup = true
+	author := newTestClient(t, app)
+	authorID := author.login(app, "Jane-Doe")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Public tale"}, "content": {"Once."}, "options": {"Go"}})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Secret diary"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}})
+	status, _, _ := author.post("/account/view", "/account/profile", url.Values{"bio": {"Writes <tales>."}, "avatar": {"https://example.com/jane.png"}})
+	if status != http.StatusFound {
+		t.Fatalf("updating the profile got status %d", status)
+	}
+	if status, _, _ := author.post("/account/view", "/account/profile", url.Values{"avatar": {"javascript:alert(1)"}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("script avatar got status %d", status)
+	}
+
+	reader := newTestClient(t, app)
+	reader.get("/firstblock?id=1")
+	status, body, _ := reader.get("/u/Jane-Doe")
+	if status != http.StatusOK {
+		t.Fatalf("profile got status %d", status)
+	}
+	for _, want := range []string{"Writes &lt;tales&gt;.", "src='https://example.com/jane.png'", "1 public stories · played 1 times", "Public tale"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("profile misses %q: %s", want, body)
+		}
+	}
+	if strings.Contains(body, "Secret diary") {
+		t.Error("profile lists the private story")
+	}
+	if status, _, location := reader.get("/u/jane-doe"); status != http.StatusMovedPermanently || location != "/u/Jane-Doe" {
+		t.Errorf("nickname in another case got status %d and location %q", status, location)
+	}
+	if status, _, _ := reader.get("/u/nobody"); status != http.StatusNotFound {
+		t.Errorf("unknown author got status %d", status)
+	}
+	if _, body, _ := reader.get("/firstblock?id=1"); !strings.Contains(body, `by <a href="/u/Jane-Doe">Jane-Doe</a>`) {
+		t.Errorf("story page doesn't name the author: %s", body)
+	}
+
+	for nickname, message := range map[string]string{"JANE-DOE": "Nickname is already taken", "Jane Doe": "Use 3 to 30 letters"} {
+		status, body, _ := reader.post("/user/signup", "/user/signup", url.Values{
+			"nickname": {nickname}, "email": {"copy@example.com"}, "password": {"pa55word-long"},
+		})
+		if status != http.StatusUnprocessableEntity || !strings.Contains(body, message) {
+			t.Errorf("signing up as %q got status %d", nickname, status)
+		}
+	}
+	if user, _ := app.users.GetByNickname(context.Background(), "jane-doe"); user.ID != authorID {
+		t.Errorf("nickname belongs to user %d", user.ID)
+	}
+}
+
+func TestTOTPThrottled(t *testing.T) {
+	app := newHandlerTestApp(t)
+	ctx := context.Background()
+	userID, err := app.users.Insert(ctx, "reader", "reader@example.com", "pa55word-long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.users.EnableTOTP(ctx, userID, "JBSWY3DPEHPK3PXP", nil)
+	reader := newTestClient(t, app)
+	status, _, location := reader.post("/user/login", "/user/login", url.Values{"email": {"reader@example.com"}, "password": {"pa55word-long"}})
+	if status != http.StatusFound || location != "/user/login/totp" {
+		t.Fatalf("login got status %d and location %q", status, location)
+	}
+
+	//One attempt at once, refilled slowly.
+	app.throttle.Burst, app.throttle.Rate = 1, 0.001
+	if status, _, _ := reader.post(location, location, url.Values{"code": {"not-a-code"}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("wrong code got status %d", status)
+	}
+	status, body, _ := reader.post(location, location, url.Values{"code": {"not-a-code"}})
+	if status != http.StatusTooManyRequests || !strings.Contains(body, "Too many attempts") {
+		t.Errorf("throttled code got status %d", status)
+	}
+
+	//Turning two-factor authentication off is throttled the same way.
+	app.throttle.Burst, app.throttle.Rate = 100, 1
+	author := newTestClient(t, app)
+	authorID := author.login(app, "author")
+	app.users.EnableTOTP(ctx, authorID, "JBSWY3DPEHPK3PXP", nil)
+	app.throttle.Burst, app.throttle.Rate = 1, 0.001
+	disable := url.Values{"password": {"pa55word-long"}, "code": {"not-a-code"}}
+	if status, _, _ := author.post("/account/view", "/account/totp/disable", disable); status != http.StatusUnprocessableEntity {
+		t.Errorf("wrong code got status %d", status)
+	}
+	disable = url.Values{"password": {"pa55word-long"}, "code": {"not-a-code"}}
+	status, body, _ = author.post("/account/view", "/account/totp/disable", disable)
+	if status != http.StatusTooManyRequests || !strings.Contains(body, "Too many attempts") {
+		t.Errorf("throttled disabling got status %d", status)
+	}
+}
+
+// failingMailer fails to send any message.
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("mail server is down")
+}
+
+func TestSignupMailFailure(t *testing.T) {
+	app := newHandlerTestApp(t)
+	app.mailer = failingMailer{}
+	cfg := DefaultConfig()
+	cfg.Database = "sqlite"
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "dialogue.db")
+	db, err := openDatabase(&cfg, app.logger, metrics.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	app.tokens = &models.TokenModel{DB: db, Secret: []byte("test-secret")}
+	reader := newTestClient(t, app)
+
+	status, _, location := reader.post("/user/signup", "/user/signup", url.Values{
+		"nickname": {"reader"}, "email": {"reader@example.com"}, "password": {"pa55word-long"},
+	})
+	if status != http.StatusFound || location != "/user/verify/resend" {
+		t.Fatalf("signing up got status %d and location %q", status, location)
+	}
+	if _, body, _ := reader.get(location); !strings.Contains(body, "couldn&#39;t send the confirmation email") {
+		t.Errorf("resend page doesn't tell about the failure: %s", body)
+	}
+	if _, err := app.users.GetByNickname(context.Background(), "reader"); err != nil {
+		t.Errorf("account isn't kept: %v", err)
+	}
+}
+
+func TestAccountSessions(t *testing.T) {
+	app := newHandlerTestApp(t)
+	laptop := newTestClient(t, app)
+	laptop.login(app, "reader")
+	phone := newTestClient(t, app)
+	status, _, location := phone.post("/user/login", "/user/login", url.Values{"email": {"reader@example.com"}, "password": {"pa55word-long"}})
+	if status != http.StatusFound || location != "/home" {
+		t.Fatalf("second login got status %d and location %q", status, location)
+	}
+
+	status, body, _ := laptop.get("/account/view")
+	if status != http.StatusOK {
+		t.Fatalf("account page got status %d", status)
+	}
+	form := regexp.MustCompile(`(?s)<form action='/account/sessions/revoke' method='POST'>\s*<input type='hidden' name='csrf_token' value='[^']+'>`)
+	if !form.MatchString(body) {
+		t.Errorf("account page misses the revoke form with its token: %s", body)
+	}
+}
+
+func TestRatingsAndFavorites(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Rated tale"}, "content": {"Once."}, "options": {"Go"}})
+
+	if status, _, _ := author.post("/firstblock?id=1", "/rate?id=1", url.Values{"stars": {"5"}}); status != http.StatusForbidden {
+		t.Errorf("author rating own story got status %d", status)
+	}
+	if _, body, _ := author.get("/firstblock?id=1"); strings.Contains(body, "Rate the story") {
+		t.Error("author is offered to rate own story")
+	}
+
+	reader := newTestClient(t, app)
+	if status, _, location := reader.post("/user/login", "/rate?id=1", url.Values{"stars": {"5"}}); status != http.StatusFound || location != "/user/login" {
+		t.Errorf("anonymous rating got status %d and location %q", status, location)
+	}
+	reader.login(app, "reader")
+	if status, _, _ := reader.post("/firstblock?id=1", "/rate?id=1", url.Values{"stars": {"6"}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("six stars got status %d", status)
+	}
+	if status, _, _ := reader.post("/firstblock?id=1", "/rate?id=2", url.Values{"stars": {"5"}}); status != http.StatusNotFound {
+		t.Errorf("rating a missing story got status %d", status)
+	}
+	status, _, _ := reader.post("/firstblock?id=1", "/rate?id=1", url.Values{"stars": {"4"}, "review": {"Short <but> sweet."}})
+	if status != http.StatusFound {
+		t.Fatalf("rating got status %d", status)
+	}
+	_, body, _ := reader.get("/firstblock?id=1")
+	for _, want := range []string{"★ 4.0 (1)", "Your rating", "Short &lt;but&gt; sweet.", `<a href="/u/reader">reader</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("story page misses %q: %s", want, body)
+		}
+	}
+	if _, body, _ := reader.get("/home"); !strings.Contains(body, "★ 4.0 (1)") {
+		t.Errorf("home page misses the rating: %s", body)
+	}
+
+	if status, _, _ := reader.post("/firstblock?id=1", "/favorite?id=1", url.Values{"favorite": {"true"}}); status != http.StatusFound {
+		t.Fatalf("adding a favorite got status %d", status)
+	}
+	if _, body, _ := reader.get("/account/view"); !strings.Contains(body, "Rated tale") {
+		t.Errorf("account page misses the favorite: %s", body)
+	}
+	reader.post("/firstblock?id=1", "/favorite?id=1", url.Values{"favorite": {"false"}})
+	if _, body, _ := reader.get("/account/view"); strings.Contains(body, "Rated tale") {
+		t.Error("account page lists the removed favorite")
+	}
+}
+
+func TestComments(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Draft"}, "content": {"Once."}, "options": {"Go"}})
+
+	editor := newTestClient(t, app)
+	editorID := editor.login(app, "editor")
+	if status, _, _ := editor.post("/home", "/comments?story=1&block=1", url.Values{"body": {"Hello"}}); status != http.StatusForbidden {
+		t.Errorf("uninvited comment got status %d", status)
+	}
+	if status, _, _ := editor.post("/home", "/collaborators?id=1", url.Values{"nickname": {"editor"}}); status != http.StatusForbidden {
+		t.Errorf("inviting to another's story got status %d", status)
+	}
+	if status, _, _ := author.post("/firstblock?id=1", "/collaborators?id=1", url.Values{"nickname": {"nobody"}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("inviting an unknown nickname got status %d", status)
+	}
+	if status, _, _ := author.post("/firstblock?id=1", "/collaborators?id=1", url.Values{"nickname": {"Editor"}}); status != http.StatusFound {
+		t.Fatalf("inviting got status %d", status)
+	}
+
+	status, _, location := editor.post("/block?id=1", "/comments?story=1&block=1", url.Values{"body": {"Typo <here>, @author. Ask author@example.com, @nobody or @author" + strings.Repeat("x", 34) + "."}})
+	if status != http.StatusFound || location != "/block?id=1#comment-1" {
+		t.Fatalf("commenting got status %d and location %q", status, location)
+	}
+	if status, _, _ := editor.post("/block?id=1", "/comments?story=1&block=2", url.Values{"body": {"Hello"}}); status != http.StatusNotFound {
+		t.Errorf("comment on a block of another story got status %d", status)
+	}
+	if comment, _ := app.dialogues.GetComment(context.Background(), 1); len(comment.Mentioned()) != 1 {
+		t.Errorf("got mentions %v; want the author", comment.Mentioned())
+	}
+	author.post("/block?id=1", "/comments?story=1&block=1", url.Values{"body": {"Fixed."}, "parent": {"1"}})
+
+	_, body, _ := author.get("/block?id=1")
+	for _, want := range []string{`Typo &lt;here&gt;, <a href="/u/author">@author</a>. Ask author@example.com, @nobody or @author` + strings.Repeat("x", 34) + ".", "Fixed.", `<a href="/u/editor">editor</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("block page misses %q: %s", want, body)
+		}
+	}
+	if _, body, _ := editor.get("/firstblock?id=1"); !strings.Contains(body, "2 comments, 1 open") {
+		t.Errorf("story map misses the comment count: %s", body)
+	}
+	if _, body, _ := author.get("/firstblock?id=1"); !strings.Contains(body, `<button name="user" value="`+strconv.Itoa(editorID)+`">`) {
+		t.Errorf("author doesn't see the collaborator: %s", body)
+	}
+
+	if status, _, _ := editor.post("/block?id=1", "/comments/resolve?id=1", url.Values{"resolved": {"true"}}); status != http.StatusFound {
+		t.Fatalf("resolving got status %d", status)
+	}
+	if _, body, _ := editor.get("/firstblock?id=1"); !strings.Contains(body, "2 comments</span>") {
+		t.Errorf("resolved thread is still open: %s", body)
+	}
+
+	reader := newTestClient(t, app)
+	reader.login(app, "reader")
+	if _, body, _ := reader.get("/block?id=1"); strings.Contains(body, "Typo") {
+		t.Error("reader sees the comments")
+	}
+	author.post("/firstblock?id=1", "/collaborators?id=1", url.Values{"user": {strconv.Itoa(editorID)}})
+	if _, body, _ := editor.get("/block?id=1"); strings.Contains(body, "Typo") {
+		t.Error("removed collaborator sees the comments")
+	}
+}
+
+func TestFollowsAndNotifications(t *testing.T) {
+	app := newHandlerTestApp(t)
+	outbox := t.TempDir()
+	app.mailer = &mailer.OutboxMailer{Dir: outbox, From: "test@example.com"}
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	reader := newTestClient(t, app)
+	reader.login(app, "reader")
+
+	if status, _, _ := author.post("/u/author", "/u/author/follow", url.Values{"follow": {"true"}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("following yourself got status %d", status)
+	}
+	if status, _, location := reader.post("/u/author", "/u/author/follow", url.Values{"follow": {"true"}}); status != http.StatusFound || location != "/u/author" {
+		t.Fatalf("following got status %d and location %q", status, location)
+	}
+	if _, body, _ := reader.get("/u/author"); !strings.Contains(body, "1 followers") || !strings.Contains(body, "Unfollow") {
+		t.Errorf("profile doesn't show the follow: %s", body)
+	}
+
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Public tale"}, "content": {"Once."}, "options": {"Go"}})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Secret diary"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}})
+	reader.post("/firstblock?id=1", "/rate?id=1", url.Values{"stars": {"5"}, "review": {"Lovely."}})
+	author.post("/firstblock?id=1", "/collaborators?id=1", url.Values{"nickname": {"reader"}})
+
+	_, body, _ := reader.get("/notifications")
+	for _, want := range []string{"<span class='unread-count'>2</span>", "author published “Public tale”.", "author invited you to comment on “Public tale”."} {
+		if !strings.Contains(body, want) {
+			t.Errorf("reader's inbox misses %q: %s", want, body)
+		}
+	}
+	if strings.Contains(body, "Secret diary") {
+		t.Error("followers hear about private stories")
+	}
+	reader.post("/block?id=1", "/comments?story=1&block=1", url.Values{"body": {"Typo."}})
+	if _, body, _ := author.get("/notifications"); !strings.Contains(body, "reader reviewed “Public tale”.") ||
+		!strings.Contains(body, `<a href='/block?id=1'>reader commented on “Public tale”.</a>`) {
+		t.Errorf("author's inbox misses the review or the comment: %s", body)
+	}
+
+	if status, _, _ := reader.post("/account/view", "/account/digest", url.Values{"digest": {"true"}}); status != http.StatusFound {
+		t.Fatalf("turning the digest on got status %d", status)
+	}
+	if err := app.sendDigests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	emails, _ := os.ReadDir(outbox)
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails; want the reader's digest only", len(emails))
+	}
+	if content, _ := os.ReadFile(filepath.Join(outbox, emails[0].Name())); !strings.Contains(string(content), "author published “Public tale”.") {
+		t.Errorf("digest misses the story: %s", content)
+	}
+	app.sendDigests(context.Background())
+	if emails, _ := os.ReadDir(outbox); len(emails) != 1 {
+		t.Errorf("got %d emails; the digest was sent again", len(emails))
+	}
+	if locked, err := app.lockDigests(context.Background(), time.Hour); !locked || err != nil {
+		t.Errorf("first replica got the digest lock %v, %v", locked, err)
+	}
+	if locked, _ := app.lockDigests(context.Background(), time.Hour); locked {
+		t.Error("second replica got the digest lock too")
+	}
+
+	reader.post("/notifications", "/notifications/read", url.Values{})
+	if _, body, _ := reader.get("/notifications"); strings.Contains(body, "unread-count") {
+		t.Errorf("notifications are unread after marking them read: %s", body)
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	app := newHandlerTestApp(t)
+	app.config.BaseURL = "https://dialogue.example"
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Public <tale>"}, "content": {"Once & again."}, "options": {"Go"}, "tags": {"dragons"}})
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Secret diary"}, "content": {"Dear."}, "options": {"Go"}, "privacy": {"true"}, "tags": {"dragons"}})
+	other := newTestClient(t, app)
+	other.login(app, "other")
+	other.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Other tale"}, "content": {"Elsewhere."}, "options": {"Go"}})
+
+	reader := newTestClient(t, app)
+	feeds := []struct {
+		path        string
+		contentType string
+		want        []string
+		unwanted    []string
+	}{
+		{"/feeds/latest.atom", "application/atom+xml", []string{
+			`<feed xmlns="http://www.w3.org/2005/Atom">`, "<title>Public &lt;tale&gt;</title>", "<summary>Once &amp; again.</summary>",
+			`<id>https://dialogue.example/firstblock?id=1</id>`, "<name>author</name>", "Other tale",
+		}, []string{"Secret diary"}},
+		{"/feeds/latest.rss", "application/rss+xml", []string{
+			`<rss version="2.0">`, "<title>Public &lt;tale&gt; by author</title>", `<guid isPermaLink="true">https://dialogue.example/firstblock?id=1</guid>`,
+		}, []string{"Secret diary"}},
+		{"/u/author/feed.atom", "application/atom+xml", []string{"<title>Stories by author</title>", "Public &lt;tale&gt;"}, []string{"Secret diary", "Other tale"}},
+		{"/tags/Dragons/feed.rss", "application/rss+xml", []string{"<title>Stories tagged #dragons</title>", "Public &lt;tale&gt;"}, []string{"Secret diary", "Other tale"}},
+		{"/sitemap.xml", "application/xml", []string{
+			`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`, "<loc>https://dialogue.example/firstblock?id=1</loc>",
+			"<loc>https://dialogue.example/firstblock?id=3</loc>",
+		}, []string{"id=2"}},
+	}
+	for _, feed := range feeds {
+		req, _ := http.NewRequest(http.MethodGet, reader.server.URL+feed.path, nil)
+		resp, err := reader.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), feed.contentType) {
+			t.Errorf("%s got status %d and type %q", feed.path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		for _, want := range feed.want {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("%s misses %q: %s", feed.path, want, body)
+			}
+		}
+		for _, unwanted := range feed.unwanted {
+			if strings.Contains(string(body), unwanted) {
+				t.Errorf("%s has %q: %s", feed.path, unwanted, body)
+			}
+		}
+	}
+	if status, _, _ := reader.get("/u/nobody/feed.atom"); status != http.StatusNotFound {
+		t.Errorf("feed of an unknown author got status %d", status)
+	}
+}
+
+func TestReaderAnalytics(t *testing.T) {
+	app := newHandlerTestApp(t)
+	author := newTestClient(t, app)
+	author.login(app, "author")
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Crossroads"}, "content": {"Left or right?"}, "options": {"Left\r\nRight"}})
+
+	author.post("/newfirstblock", "/newfirstblock", url.Values{"title": {"Elsewhere"}, "content": {"Go."}, "options": {"Go"}})
+
+	//Two readers pick an option each, a third one leaves on the first block. Reloading the first block or reading
+	//another story in between goes on with the same reading. Visits which aren't picks, like following a made-up
+	//link, don't count.
+	for _, path := range []string{"/block?id=1&from=0", "/block?id=2&from=0", ""} {
+		reader := newTestClient(t, app)
+		reader.get("/firstblock?id=1")
+		reader.get("/firstblock?id=2")
+		reader.get("/firstblock?id=1")
+		if path != "" {
+			reader.get(path)
+			reader.get("/block?id=2&from=1")
+		}
+	}
+	//Neither the author's own visits nor crawlers count.
+	author.get("/block?id=1&from=0")
+	crawler := newTestClient(t, app)
+	req, err := http.NewRequest(http.MethodGet, crawler.server.URL+"/firstblock?id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+	crawler.do(req)
+
+	status, body, _ := author.get("/stories/analytics?id=1")
+	if status != http.StatusOK {
+		t.Fatalf("dashboard got status %d", status)
+	}
+	for _, want := range []string{"3 readings", "67% reached an ending", "1.7 blocks read on average", "Left → 1: 1 (50%)", "33%"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard doesn't show %q: %s", want, body)
+		}
+	}
+	if _, body, _ := author.get("/firstblock?id=1"); !strings.Contains(body, "3 readers, 33% drop off") {
+		t.Errorf("story map doesn't show the readings: %s", body)
+	}
+
+	other := newTestClient(t, app)
+	if status, _, location := other.get("/stories/analytics?id=1"); status != http.StatusFound || location != "/user/login" {
+		t.Errorf("anonymous dashboard got status %d and location %q", status, location)
+	}
+	other.login(app, "other")
+	if status, _, _ := other.get("/stories/analytics?id=1"); status != http.StatusForbidden {
+		t.Errorf("dashboard of another author got status %d", status)
+	}
+	if status, _, _ := author.get("/stories/analytics?id=9"); status != http.StatusNotFound {
+		t.Errorf("dashboard of a missing story got status %d", status)
+	}
+
+	//A browser keeps one reading cookie, with the readings of the latest stories only, which expires.
+	var ids []int
+	for range maxReadings + 2 {
+		ids = append(ids, app.dialogues.CreateFB(context.Background(), 1, "Short", "Once.", []string{"Go"}, false))
+	}
+	browser := newTestClient(t, app)
+	for _, id := range ids {
+		resp, err := browser.client.Get(browser.server.URL + "/firstblock?id=" + strconv.Itoa(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		var set []*http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if strings.HasPrefix(cookie.Name, readingCookieName) {
+				set = append(set, cookie)
+			}
+		}
+		if len(set) != 1 || set[0].Name != readingCookieName || set[0].MaxAge <= 0 {
+			t.Fatalf("story %d set reading cookies %v; want one with a Max-Age", id, set)
+		}
+	}
+	serverURL, _ := url.Parse(browser.server.URL)
+	var kept []*http.Cookie
+	for _, cookie := range browser.client.Jar.Cookies(serverURL) {
+		if strings.HasPrefix(cookie.Name, readingCookieName) {
+			kept = append(kept, cookie)
+		}
+	}
+	if len(kept) != 1 {
+		t.Fatalf("browser keeps reading cookies %v; want one", kept)
+	}
+	value, _ := url.QueryUnescape(kept[0].Value)
+	if pairs := strings.Split(value, "."); len(pairs) != maxReadings || !strings.HasPrefix(pairs[0], strconv.Itoa(ids[2])+":") {
+		t.Errorf("reading cookie holds %v; want the latest %d stories", pairs, maxReadings)
+	}
+}
+
+// oidcLogin signs in with the mock issuer as the email and returns the response of the callback.
+func (tc *testClient) oidcLogin(email string) (int, string, string) {
+	tc.t.Helper()
+	_, _, authorize := tc.get("/user/login/oidc/mock")
+	authorizeURL, err := url.Parse(authorize)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	form := authorizeURL.Query()
+	form.Set("email", email)
+	form.Set("email_verified", "true")
+	authorizeURL.RawQuery = ""
+	resp, err := tc.client.PostForm(authorizeURL.String(), form)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	resp.Body.Close()
+	req, err := http.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return tc.do(req)
+}
+
+func TestOIDCCallback(t *testing.T) {
+	app := newHandlerTestApp(t)
+	tc := newTestClient(t, app)
+	issuer := httptest.NewUnstartedServer(nil)
+	issuer.Start()
+	t.Cleanup(issuer.Close)
+	mock, err := mockoidc.New(issuer.URL, "dialogue", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Config.Handler = mock
+	app.oidcProviders = newOIDCProviders(context.Background(), tc.server.URL, []OIDCProviderConfig{
+		{Name: "mock", DisplayName: "Mock", IssuerURL: issuer.URL, ClientID: "dialogue", ClientSecret: "secret"},
+	}, app.logger)
+	if app.oidcProviders["mock"] == nil {
+		t.Fatal("mock provider wasn't discovered")
+	}
+	ctx := context.Background()
+
+	//An unknown email signs a new user up.
+	if status, _, location := tc.oidcLogin("newcomer@example.com"); status != http.StatusFound || location != "/home" {
+		t.Fatalf("new user login got status %d and location %q", status, location)
+	}
+	if _, err := app.users.GetByIdentity(ctx, "mock", "mock|newcomer@example.com"); err != nil {
+		t.Errorf("new user isn't linked: %v", err)
+	}
+
+	//With signups closed an existing confirmed account is still linked, nobody new gets in.
+	app.config.Features.Signup = false
+	existingID, err := app.users.Insert(ctx, "existing", "existing@example.com", "pa55word-long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.users.MarkVerified(ctx, existingID); err != nil {
+		t.Fatal(err)
+	}
+	//The provider redirects back to the server it was configured with, so every client uses that one.
+	linker := newTestClient(t, app)
+	linker.server = tc.server
+	if status, _, location := linker.oidcLogin("existing@example.com"); status != http.StatusFound || location != "/home" {
+		t.Fatalf("linking login got status %d and location %q", status, location)
+	}
+	if user, err := app.users.GetByIdentity(ctx, "mock", "mock|existing@example.com"); err != nil || user.ID != existingID {
+		t.Errorf("got %+v and %v; want the identity linked to the existing user", user, err)
+	}
+
+	stranger := newTestClient(t, app)
+	stranger.server = tc.server
+	if status, _, location := stranger.oidcLogin("stranger@example.com"); status != http.StatusFound || location != "/user/login" {
+		t.Fatalf("closed signup login got status %d and location %q", status, location)
+	}
+	if _, body, _ := stranger.get("/user/login"); !strings.Contains(body, "signing up is closed") {
+		t.Errorf("login page doesn't explain the failure: %s", body)
+	}
+	if _, err := app.users.GetByEmail(ctx, "stranger@example.com"); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("got %v; want no account for the stranger", err)
+	}
+
+	//A failed password login still offers the providers.
+	for name, form := range map[string]url.Values{
+		"invalid form":   {"email": {"stranger"}, "password": {""}},
+		"wrong password": {"email": {"existing@example.com"}, "password": {"wrong-password"}},
+	} {
+		if _, body, _ := stranger.post("/user/login", "/user/login", form); !strings.Contains(body, "Log in with Mock") {
+			t.Errorf("%s: login page misses the providers: %s", name, body)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"dialogue/internal/models"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout limits how long a single readiness check may take, so a hanging dependency fails the probe
+// instead of stalling it.
+const readinessTimeout = 2 * time.Second
+
+// healthz reports that the process is alive. It checks nothing else, a restart wouldn't fix a broken dependency.
+func (app *application) healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// readyz reports whether the app can serve traffic: it isn't shutting down and the database, the session store
+// and the template cache work.
+func (app *application) readyz(c *gin.Context) {
+	if !app.ready.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c, readinessTimeout)
+	defer cancel()
+	checks := map[string]func(context.Context) error{
+		"database":  app.checkDatabase,
+		"sessions":  app.checkSessionStore,
+		"templates": app.checkTemplates,
+	}
+	status := http.StatusOK
+	results := make(map[string]string, len(checks))
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			app.logger.ErrorContext(c, "Readiness check failed", "check", name, "error", err)
+			//Error texts name hosts and drivers, they are only logged.
+			results[name] = "fail"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	if status == http.StatusOK {
+		c.JSON(status, gin.H{"status": "ok", "checks": results})
+		return
+	}
+	c.JSON(status, gin.H{"status": "unavailable", "checks": results})
+}
+
+func (app *application) checkDatabase(ctx context.Context) error {
+	sqlDB, err := app.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+func (app *application) checkSessionStore(ctx context.Context) error {
+	return app.redisClient.Ping(ctx).Err()
+}
+
+// checkTemplates renders every page handlers render, with the least data they need, so a page that is missing or
+// fails to execute fails the check.
+func (app *application) checkTemplates(ctx context.Context) error {
+	sample := data{Profile: profileData{User: &models.User{}}}
+	var failed []string
+	for _, page := range pages {
+		ts, ok := app.templates.get(page)
+		if !ok || ts.ExecuteTemplate(io.Discard, "base", sample) != nil {
+			failed = append(failed, page)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("pages failing to render: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestProbes(t *testing.T) {
+	app := newCSRFTestApp()
+	router := app.routes()
+
+	tests := []struct {
+		name  string
+		path  string
+		ready bool
+		want  int
+	}{
+		{"alive", "/healthz", false, http.StatusOK},
+		{"not ready before serving", "/readyz", false, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.ready.Store(tt.ready)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rr.Code != tt.want {
+				t.Errorf("got status %d; want %d", rr.Code, tt.want)
+			}
+			if len(rr.Result().Cookies()) != 0 {
+				t.Error("probe set cookies")
+			}
+		})
+	}
+}
+
+func TestDebugRequiresAuthentication(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		user     string
+		sent     string
+		want     int
+	}{
+		{"disabled", "", debugUser, "", http.StatusNotFound},
+		{"no credentials", "debug-password-123", "", "", http.StatusUnauthorized},
+		{"wrong password", "debug-password-123", debugUser, "debug-password-12", http.StatusUnauthorized},
+		{"wrong user", "debug-password-123", "admin", "debug-password-123", http.StatusUnauthorized},
+		{"authenticated", "debug-password-123", debugUser, "debug-password-123", http.StatusOK},
+	}
+	for _, path := range []string{"/debug/pprof/", "/metrics"} {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				app := newCSRFTestApp()
+				app.config.DebugPassword = tt.password
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.user != "" {
+					req.SetBasicAuth(tt.user, tt.sent)
+				}
+				rr := httptest.NewRecorder()
+				app.routes().ServeHTTP(rr, req)
+				if rr.Code != tt.want {
+					t.Errorf("got status %d; want %d", rr.Code, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// TestDebugProfileOutlastsWriteTimeout collects a CPU profile for longer than the server may write a response.
+func TestDebugProfileOutlastsWriteTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("profiling takes seconds")
+	}
+	app := newCSRFTestApp()
+	app.config.DebugPassword = "debug-password-123"
+	app.config.Server.WriteTimeout = Duration(500 * time.Millisecond)
+	srv, err := app.newServer(app.routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(srv.Handler)
+	server.Config = srv
+	server.Start()
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/debug/pprof/profile?seconds=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(debugUser, "debug-password-123")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	profile, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK || len(profile) == 0 {
+		t.Errorf("got status %d, %d bytes and %v; want the profile", resp.StatusCode, len(profile), err)
+	}
+}
+
+// TestReadyzHidesErrors fails the database and Redis checks: the probe says which checks failed, not why.
+func TestReadyzHidesErrors(t *testing.T) {
+	app := newHandlerTestApp(t)
+	app.ready.Store(true)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "closed.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	app.db = db
+	app.redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Status string
+		Checks map[string]string
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"database": "fail", "sessions": "fail", "templates": "ok"}
+	if rr.Code != http.StatusServiceUnavailable || !maps.Equal(body.Checks, want) {
+		t.Errorf("got status %d and %s; want 503 and checks %v", rr.Code, rr.Body, want)
+	}
+}
@@ -1,13 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
-	"log"
-	"net/http"
-	"path/filepath"
-	"runtime/debug"
-	"strconv"
+	"io/fs"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,23 +12,16 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-// serverError handles some unexpected errors.
-func (app *application) serverError(c *gin.Context, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.errorLog.Output(2, trace)
-	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-		"error":   http.StatusText(http.StatusInternalServerError),
-		"message": "An unexpected error occurred.",
-	})
-}
-
 // newTemplateData gathers context data and passes it to every request by default.
 func (app *application) newTemplateData(c *gin.Context) *data {
 	return &data{
 		CurrentYear:     time.Now().Year(),
 		Flash:           app.getFlash(c),
 		IsAuthenticated: app.isAuthenticated(c),
+		SignupEnabled:   app.config.Features.Signup,
+		CSRFToken:       c.GetString(csrfTokenContextKey),
 		UserID:          app.getID(c),
+		Unread:          app.unreadCount(c),
 	}
 }
 
@@ -48,9 +37,9 @@ func (app *application) isAuthenticated(c *gin.Context) bool {
 
 // setFlash sets a flash message by putting it into the cookie.
 func (app *application) setFlash(c *gin.Context, flashText string) {
-	sessionID, err := c.Cookie("session_id")
-	if err != nil {
-		c.SetCookie("flash_message", flashText, 5, "/", "", false, true)
+	sessionID := app.sessionID(c)
+	if sessionID == "" {
+		app.setCookie(c, "flash_message", flashText, 5, "/")
 		return
 	}
 	app.redisClient.Set(c, "flash:"+sessionID, flashText, 5*time.Minute)
@@ -64,14 +53,12 @@ func (app *application) getFlash(c *gin.Context) string {
 	//Checking if flash is inside temporary cookie, if so extract it.
 	flashTextTmp, err := c.Cookie("flash_message")
 	if err == nil {
-		c.SetCookie("flash_message", "", -1, "/", "", false, true)
+		app.setCookie(c, "flash_message", "", -1, "/")
 		return flashTextTmp
 	}
-	sessionID, err := c.Cookie("session_id")
-	if err != nil {
-		flashTextTmp, _ = c.Cookie("flash_message")
-		c.SetCookie("flash_message", "", -1, "/", "", false, true)
-		return flashTextTmp
+	sessionID := app.sessionID(c)
+	if sessionID == "" {
+		return ""
 	}
 
 	//Trying to gather flash from session.
@@ -79,7 +66,7 @@ func (app *application) getFlash(c *gin.Context) string {
 	if err == redis.Nil {
 		flashSession = ""
 	} else if err != nil {
-		log.Println("Redis error:", err)
+		app.logger.ErrorContext(c, "Failed to get the flash message", "error", err)
 		flashSession = ""
 	} else {
 		app.redisClient.Del(c, "flash:"+sessionID)
@@ -89,25 +76,25 @@ func (app *application) getFlash(c *gin.Context) string {
 
 // render renders a page from created HTML pages cash.
 func (app *application) render(c *gin.Context, status int, page string, data interface{}) {
-	ts, ok := app.templateCache[page]
+	ts, ok := app.templates.get(page)
 	if !ok {
-		err := fmt.Errorf("the template %s does not exist", page)
-		app.errorLog.Println(err)
+		app.serverError(c, fmt.Errorf("the template %s does not exist", page))
 		return
 	}
-	c.Status(status)
-	err := ts.ExecuteTemplate(c.Writer, "base", data)
-	if err != nil {
-		app.errorLog.Println(err)
+	//The page is rendered into a buffer first, so a failing template is answered with an error, not half a page.
+	var buf bytes.Buffer
+	if err := ts.ExecuteTemplate(&buf, "base", data); err != nil {
+		app.serverError(c, fmt.Errorf("rendering %s: %w", page, err))
 		return
 	}
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
 }
 
 // globbing is a wrap around glob() function to check for different patterns.
-func globbing(patterns []string) ([]string, error) {
+func globbing(fsys fs.FS, patterns []string) ([]string, error) {
 	var result []string
 	for _, v := range patterns {
-		pattern, err := filepath.Glob(v)
+		pattern, err := fs.Glob(fsys, v)
 		if err != nil {
 			return nil, err
 		}
@@ -121,49 +108,43 @@ func generateSessionID() string {
 	return uuid.New().String()
 }
 
-// serialize is a helper to marshal data and return it as a string.
-func serialize(data map[string]any) string {
-	jsonData, _ := json.Marshal(data)
-	return string(jsonData)
-}
-
-// deserialize is a function that unmarshals json data into string.
-func deserialize(jsonStr string, target *map[string]any) {
-	json.Unmarshal([]byte(jsonStr), target)
+// setCookie sets an HTTP only cookie with domain and secure attributes from the configuration.
+func (app *application) setCookie(c *gin.Context, name, value string, maxAge int, path string) {
+	c.SetCookie(name, value, maxAge, path, app.config.Cookie.Domain, app.config.Cookie.Secure, true)
 }
 
-// getID gets user ID from current session.
+// getID gets user ID from current session, which is resolved by authenticateMiddleware.
 func (app *application) getID(c *gin.Context) int {
-	sessionID, err := c.Cookie("session_id")
-	if err != nil {
-		return 0 //If session does not exists returns nil.
-	}
-
-	// Get ID of a user directly from Redis.
-	userIDStr, err := app.redisClient.Get(c, sessionID+":userID").Result()
-	if err == redis.Nil {
-		return 0
-	} else if err != nil {
-		return 0
-	}
-
-	// Convert string, wich is ID, to int.
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		return 0
-	}
-	return userID
+	return c.GetInt(userIDContextKey) //If session does not exists returns 0.
 }
 
-// parse is a helper function to parse forms from the user.
-func (app *application) parse(c *gin.Context, form any) {
+// parse is a helper function to parse forms from the user. Malformed forms are answered with an error page and
+// the error is returned, so the handler has to stop.
+func (app *application) parse(c *gin.Context, form any) error {
 	if err := c.Request.ParseForm(); err != nil {
-		app.errorLog.Print(err.Error())
-		app.serverError(c, err)
+		err = errBadRequest("The form is malformed.", err)
+		app.fail(c, err)
+		return err
 	}
 	dec := schema.NewDecoder()
+	dec.IgnoreUnknownKeys(true) //Forms carry fields like the CSRF token which don't belong to the form structs.
 	if err := dec.Decode(form, c.Request.PostForm); err != nil {
-		app.errorLog.Print(err.Error())
-		app.serverError(c, err)
+		err = errUnprocessable("The form contains invalid values.", err)
+		app.fail(c, err)
+		return err
+	}
+	return nil
+}
+
+// parseQuery decodes the query string into form like parse does with forms. Malformed queries are answered with an
+// error page and the error is returned, so the handler has to stop.
+func (app *application) parseQuery(c *gin.Context, form any) error {
+	dec := schema.NewDecoder()
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.Decode(form, c.Request.URL.Query()); err != nil {
+		err = errBadRequest("The query contains invalid values.", err)
+		app.fail(c, err)
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"dialogue/internal/mailer"
+	"dialogue/internal/models"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	verificationTokenTTL  = 72 * time.Hour
+	passwordResetTokenTTL = 30 * time.Minute
+)
+
+// sendVerificationEmail issues a verification token for the user and mails the link confirming the address.
+func (app *application) sendVerificationEmail(c *gin.Context, user *models.User) error {
+	token, err := app.tokens.New(user.ID, models.ScopeVerification, verificationTokenTTL)
+	if err != nil {
+		return err
+	}
+	return app.mailer.Send(c, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: "Hi " + user.NickName + ",\n\n" +
+			"please confirm your email address by opening the link below:\n\n" +
+			app.config.BaseURL + "/user/verify?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link is valid for 3 days.\n",
+	})
+}
+
+// sendPasswordResetEmail issues a password reset token for the user and mails the link to the reset form.
+func (app *application) sendPasswordResetEmail(c *gin.Context, user *models.User) error {
+	token, err := app.tokens.New(user.ID, models.ScopePasswordReset, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return app.mailer.Send(c, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Hi " + user.NickName + ",\n\n" +
+			"somebody asked to reset the password of your account. If it was you, open the link below:\n\n" +
+			app.config.BaseURL + "/user/password/reset?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link is valid for 30 minutes. If you didn't ask for it, just ignore this email.\n",
+	})
+}
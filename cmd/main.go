@@ -2,58 +2,238 @@ package main
 
 import (
 	"context"
+	"dialogue/internal/logging"
+	"dialogue/internal/mailer"
+	"dialogue/internal/metrics"
 	"dialogue/internal/models"
-	"html/template"
-	"log"
+	"dialogue/internal/ratelimit"
+	"dialogue/internal/tracing"
+	"dialogue/ui"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// throttleCleanupInterval is how often the memory throttle store drops expired state.
+const throttleCleanupInterval = 10 * time.Minute
+
 type application struct {
-	errorLog      *log.Logger
-	infoLog       *log.Logger
-	dialogues     *models.DialogueModel
-	users         *models.UserModel
-	templateCache map[string]*template.Template
-	redisClient   *redis.Client
+	config      *Config
+	db          *gorm.DB
+	logger      *slog.Logger
+	dialogues   models.StoryRepository
+	users       models.UserRepository
+	audit       *models.AuditModel
+	tokens      *models.TokenModel
+	mailer      mailer.Mailer
+	metrics     *metrics.Metrics
+	templates   *templateCache
+	assets      *staticAssets
+	redisClient *redis.Client
+	csrfSecret  []byte
+	throttle    *ratelimit.Throttle
+
+	// totpPolicy decides whether a user has to enable two-factor authentication.
+	totpPolicy func(ctx context.Context, userID int) (bool, error)
+
+	oidcProviders map[string]*oidcProvider
+
+	startedAt time.Time
+
+	// ready is set while the server accepts traffic and cleared as soon as shutdown begins.
+	ready atomic.Bool
 }
 
 func main() {
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime)
+	cfg, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logger, err := logging.New(os.Stdout, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	//Packages logging with the default logger end up in the same pipeline.
+	slog.SetDefault(logger)
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Configuration loaded", "config", cfg.String())
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	secret, persistent := cfg.secret()
+	if !persistent {
+		logger.Warn("No secret is configured, links in emails won't survive a restart")
+	}
 
-	dsn := DefaultPostgresConfig().ConnectionInfo()
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: "dialogue",
+		Version:     buildVersion(),
+		Output:      os.Stdout,
+	})
 	if err != nil {
-		panic(err)
+		fatal("Failed to set up tracing", err)
 	}
 
-	templateCache, err := newTemplateCache()
+	appMetrics := metrics.New()
+
+	db, err := openDatabase(cfg, logger, appMetrics)
 	if err != nil {
-		errorLog.Fatal(err)
+		fatal("Failed to open the database", err)
 	}
 
-	db.Migrator().DropTable("first_blocks", "blocks")
-	db.AutoMigrate(&models.FirstBlock{}, &models.Block{}, &models.User{})
+	//Templates and static files are compiled into the binary, dev mode reads them from disk instead.
+	uiFS := fs.FS(ui.Files)
+	if cfg.Dev {
+		uiFS = os.DirFS(uiDir)
+	}
+	staticFS, err := fs.Sub(uiFS, "static")
+	if err != nil {
+		fatal("Failed to open static files", err)
+	}
+	assets, err := newStaticAssets(staticFS, !cfg.Dev)
+	if err != nil {
+		fatal("Failed to hash static files", err)
+	}
+	templates, err := newTemplateCache(uiFS, assets)
+	if err != nil {
+		fatal("Failed to parse templates", err)
+	}
 
-	redisClient := redis.NewClient(DefaultRedisConfig())
+	redisClient := redis.NewClient(cfg.Redis.Options())
+	redisClient.AddHook(metrics.RedisHook{Metrics: appMetrics})
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		fatal("Failed to register Redis tracing", err)
+	}
 
 	_, err = redisClient.Ping(context.Background()).Result()
 	if err != nil {
-		log.Fatal("Failed to connect to Redis: ", err)
+		fatal("Failed to connect to Redis", err)
+	}
+
+	//The memory store drops expired attempts and lockouts itself, Redis expires the keys.
+	var throttleStore ratelimit.Store = &ratelimit.RedisStore{Client: redisClient, Prefix: "ratelimit:"}
+	memoryThrottle := ratelimit.NewMemoryStore()
+	if cfg.Throttle == "memory" {
+		throttleStore = memoryThrottle
 	}
 
 	app := &application{
-		errorLog:      errorLog,
-		infoLog:       infoLog,
-		dialogues:     &models.DialogueModel{DB: db},
-		users:         &models.UserModel{DB: db},
-		templateCache: templateCache,
-		redisClient:   redisClient,
+		config:      cfg,
+		db:          db,
+		startedAt:   time.Now(),
+		logger:      logger,
+		dialogues:   &models.DialogueModel{DB: db},
+		users:       &models.UserModel{DB: db, RequireVerified: cfg.Features.RequireVerifiedEmail, BcryptCost: cfg.BcryptCost},
+		audit:       &models.AuditModel{DB: db},
+		tokens:      &models.TokenModel{DB: db, Secret: deriveKey(secret, "tokens")},
+		mailer:      cfg.Mailer.Mailer(),
+		metrics:     appMetrics,
+		templates:   templates,
+		assets:      assets,
+		redisClient: redisClient,
+		csrfSecret:  deriveKey(secret, "csrf"),
+		throttle: &ratelimit.Throttle{
+			Store:           throttleStore,
+			Rate:            0.2,
+			Burst:           10,
+			MaxFailures:     5,
+			FailureWindow:   15 * time.Minute,
+			LockoutDuration: 15 * time.Minute,
+		},
 	}
 
-	app.routes().Run(srvArrd)
+	if cfg.Features.TOTPForPopularAuthors {
+		app.totpPolicy = app.popularAuthorPolicy
+	}
+	app.oidcProviders = newOIDCProviders(context.Background(), cfg.BaseURL, cfg.OIDCProviders, logger)
+
+	srv, err := app.newServer(app.routes())
+	if err != nil {
+		fatal("Failed to configure the server", err)
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("Failed to listen", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Dev {
+		go func() {
+			if err := app.watchTemplates(ctx, filepath.Join(uiDir, "html")); err != nil {
+				logger.Error("Failed to watch templates", "error", err)
+			}
+		}()
+	}
+	if cfg.Throttle == "memory" {
+		go memoryThrottle.RunCleanup(ctx, throttleCleanupInterval)
+	}
+	if interval := time.Duration(cfg.Mailer.DigestInterval); interval > 0 {
+		go app.runDigests(ctx, interval)
+	}
+	if err := app.serve(ctx, srv, ln); err != nil {
+		logger.Error("Server failed", "error", err)
+	}
+
+	//Requests are drained at this point, so the pools can be closed.
+	if sqlDB, err := db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			logger.Error("Failed to close the database", "error", err)
+		}
+	}
+	if err := redisClient.Close(); err != nil {
+		logger.Error("Failed to close Redis", "error", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("Failed to flush spans", "error", err)
+	}
+	logger.Info("Stopped")
+}
+
+// openDatabase connects to the configured database and brings its tables up to date, keeping the data they hold.
+func openDatabase(cfg *Config, logger *slog.Logger, appMetrics *metrics.Metrics) (*gorm.DB, error) {
+	dialector, dbSystem := cfg.dialector()
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger: &logging.GormLogger{Logger: logger, SlowThreshold: time.Duration(cfg.Log.SlowQuery)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	if err := db.Use(metrics.GormPlugin{Metrics: appMetrics}); err != nil {
+		return nil, fmt.Errorf("register metrics: %w", err)
+	}
+	if err := db.Use(tracing.GormPlugin{System: dbSystem}); err != nil {
+		return nil, fmt.Errorf("register tracing: %w", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return db, nil
 }
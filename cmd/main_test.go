@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"dialogue/internal/metrics"
+	"dialogue/internal/models"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenDatabaseKeepsStories opens the SQLite file twice, as two starts of the app do: stories written by the
+// first run must be there for the second one.
+func TestOpenDatabaseKeepsStories(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database = "sqlite"
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "dialogue.db")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	open := func() *models.DialogueModel {
+		db, err := openDatabase(&cfg, logger, metrics.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+		return &models.DialogueModel{DB: db}
+	}
+
+	first := open()
+	id := first.CreateFB(ctx, 1, "Kept tale", "Once.", []string{"Go on"}, false)
+	if sqlDB, err := first.DB.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	blocks := open().RetrieveBlocks(ctx, id)
+	if blocks.FirstBlock.StoryTitle != "Kept tale" || len(blocks.OtherBlocks) != 1 {
+		t.Errorf("after a restart got %+v; want the story with its block", blocks)
+	}
+}
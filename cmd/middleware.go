@@ -1,36 +1,103 @@
 package main
 
 import (
+	"crypto/rand"
+	"dialogue/internal/logging"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches request IDs accepted from proxies in front of the app. Anything else is replaced, so
+// clients can't inject arbitrary text into logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags the request with an ID, taken from the X-Request-ID header of a proxy or generated,
+// sends it back in the same header and puts it into the log context together with the matched route.
+func (app *application) requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				panic(err)
+			}
+			id = hex.EncodeToString(b)
+		}
+		c.Header(requestIDHeader, id)
+		attrs := []any{"request_id", id, "route", c.FullPath()}
+		//Logs of traced requests can be found from the trace and the other way round.
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			attrs = append(attrs, "trace_id", span.TraceID().String())
+		}
+		c.Request = c.Request.WithContext(logging.With(c.Request.Context(), attrs...))
+		c.Next()
+	}
+}
+
+// logRequest logs every request once it is handled. Probes and metrics scrapes are logged at debug level only.
+func (app *application) logRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		switch c.FullPath() {
+		case "/healthz", "/readyz", "/metrics":
+			level = slog.LevelDebug
+		}
+		app.logger.Log(c, level, "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"size", c.Writer.Size(),
+			"duration", time.Since(start),
+			"ip", c.ClientIP(),
+		)
+	}
+}
+
+// recoverPanic logs panics of handlers with their stack and answers with the 500 Internal Server Error page.
+func (app *application) recoverPanic(c *gin.Context, recovered any) {
+	app.logger.ErrorContext(c, "Panic", "panic", recovered, "stack", string(debug.Stack()))
+	app.errorPage(c, http.StatusInternalServerError, internalErrorMessage)
+}
+
 // authenticateMiddleware checks if the session presists for the user and sets key for authentication.
 func (app *application) authenticateMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		c.SetSameSite(http.SameSiteLaxMode)
 
-		//Get the session ID from cookie.
-		sessionID, err := c.Cookie("session_id")
-		if err != nil {
+		//Requests authorized with bearer tokens don't get cookie sessions, this keeps them exempt from CSRF checks.
+		if hasBearerToken(c) {
 			c.Set(isAuthenticatedContextKey, false)
 			c.Next()
 			return
 		}
 
-		//Get user ID related to the session from Redis.
-		var sessionData map[string]any
-		jsonData, _ := app.redisClient.Get(c, sessionID).Result()
-		deserialize(jsonData, &sessionData)
-		idFloat, _ := sessionData["userID"].(float64)
-		id := int(idFloat)
-
-		if id == 0 {
+		//Load the session from cookie, expired sessions are dropped and active ones are prolonged.
+		s, err := app.loadSession(c)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		if s == nil {
 			c.Set(isAuthenticatedContextKey, false)
 			c.Next()
 			return
 		}
+		c.Set(sessionIDContextKey, s.ID)
 
 		//Check if the user with gathered ID persists in database.
-		exists, err := app.users.Exists(id)
+		exists, err := app.users.Exists(c, s.UserID)
 		if err != nil {
 			app.serverError(c, err)
 			return
@@ -39,6 +106,8 @@ func (app *application) authenticateMiddleware() gin.HandlerFunc {
 		//Set the value for the authenticated key.
 		if exists {
 			c.Set(isAuthenticatedContextKey, true)
+			c.Set(userIDContextKey, s.UserID)
+			c.Request = c.Request.WithContext(logging.With(c.Request.Context(), "user_id", s.UserID))
 		} else {
 			c.Set(isAuthenticatedContextKey, false)
 		}
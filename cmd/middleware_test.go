@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	app := newCSRFTestApp()
+	router := app.routes()
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"generated", "", false},
+		{"from proxy", "edge-42.abc", true},
+		{"invalid replaced", "bad id\nforged log line", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			got := rr.Header().Get(requestIDHeader)
+			if !validRequestID.MatchString(got) {
+				t.Fatalf("invalid request ID %q", got)
+			}
+			if (got == tt.incoming) != tt.keep {
+				t.Errorf("got request ID %q for incoming %q", got, tt.incoming)
+			}
+		})
+	}
+}
+
+// TestParseStopsOnMalformedForm checks that a form with invalid values is answered with 422 and the handler
+// doesn't go on.
+func TestParseStopsOnMalformedForm(t *testing.T) {
+	app := newCSRFTestApp()
+	router := gin.New()
+	continued := false
+	router.POST("/form", func(c *gin.Context) {
+		var form struct {
+			Count int `schema:"count"`
+		}
+		if err := app.parse(c, &form); err != nil {
+			return
+		}
+		continued = true
+	})
+
+	body := url.Values{"count": {"many"}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity || continued {
+		t.Errorf("got status %d, handler continued: %v", rr.Code, continued)
+	}
+}
@@ -0,0 +1,24 @@
+// Command mockoidc runs the bundled OpenID Connect issuer for local development.
+package main
+
+import (
+	"dialogue/internal/mockoidc"
+	"flag"
+	"log"
+	"net/http"
+)
+
+func main() {
+	addr := flag.String("addr", ":9999", "HTTP network address")
+	issuer := flag.String("issuer", "http://localhost:9999", "public URL of the issuer")
+	clientID := flag.String("client-id", "dialogue", "accepted client ID")
+	clientSecret := flag.String("client-secret", "dialogue-secret", "accepted client secret")
+	flag.Parse()
+
+	server, err := mockoidc.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("mock OIDC issuer %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"dialogue/internal/mailer"
+	"dialogue/internal/models"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inboxSize is how many of the latest notifications the inbox shows.
+const inboxSize = 50
+
+// followForm tells whether to follow the author or to stop.
+type followForm struct {
+	Follow bool `schema:"follow"`
+}
+
+// digestForm turns the email digest on or off.
+type digestForm struct {
+	Digest bool `schema:"digest"`
+}
+
+// notificationView is a notification as the inbox and the digest show it.
+type notificationView struct {
+	models.Notification
+	Text string
+	URL  string
+}
+
+// describe words the notification and links it to the story or block it is about.
+func describe(n models.Notification) notificationView {
+	view := notificationView{Notification: n, URL: blockPath(n.StoryID, n.BlockID)}
+	title := "“" + n.StoryTitle + "”"
+	switch n.Kind {
+	case models.NotifyStory:
+		view.Text = n.ActorName + " published " + title + "."
+	case models.NotifyComment:
+		view.Text = n.ActorName + " commented on " + title + "."
+	case models.NotifyMention:
+		view.Text = n.ActorName + " mentioned you in a comment on " + title + "."
+	case models.NotifyReview:
+		view.Text = n.ActorName + " reviewed " + title + "."
+	case models.NotifyInvite:
+		view.Text = n.ActorName + " invited you to comment on " + title + "."
+	default:
+		view.Text = n.ActorName + " did something on " + title + "."
+	}
+	return view
+}
+
+// notify tells the recipients that the user of the request did something on the story. The user isn't notified of
+// own actions. Failures are logged only, the action itself has succeeded.
+func (app *application) notify(c *gin.Context, kind string, story models.FirstBlock, blockID int, recipients ...int) {
+	actorID := app.getID(c)
+	actor, err := app.users.GetUser(c, actorID)
+	if err != nil {
+		app.logger.Error("Failed to notify", "kind", kind, "error", err)
+		return
+	}
+	var notifications []models.Notification
+	for _, recipient := range recipients {
+		if recipient == actorID || recipient == 0 {
+			continue
+		}
+		notifications = append(notifications, models.Notification{
+			UserID:     recipient,
+			Kind:       kind,
+			ActorID:    actorID,
+			ActorName:  actor.NickName,
+			StoryID:    story.ID,
+			StoryTitle: story.StoryTitle,
+			BlockID:    blockID,
+		})
+	}
+	if err := app.users.Notify(c, notifications...); err != nil {
+		app.logger.Error("Failed to notify", "kind", kind, "error", err)
+	}
+}
+
+// unreadCount returns the number of unread notifications of the user shown in the navigation, 0 if it can't be
+// counted.
+func (app *application) unreadCount(c *gin.Context) int {
+	userID := app.getID(c)
+	if userID == 0 {
+		return 0
+	}
+	count, err := app.users.UnreadCount(c, userID)
+	if err != nil {
+		app.logger.Error("Failed to count unread notifications", "error", err)
+	}
+	return count
+}
+
+// inbox lists the latest notifications of the user.
+func (app *application) inbox(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	notifications, err := app.users.Notifications(c, userID, inboxSize)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	data := app.newTemplateData(c)
+	for _, n := range notifications {
+		data.Notifications = append(data.Notifications, describe(n))
+	}
+	app.render(c, http.StatusOK, "notifications.html", data)
+}
+
+// markRead marks all notifications of the user as read.
+func (app *application) markRead(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	if err := app.users.MarkRead(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/notifications")
+}
+
+// follow makes the user follow the author with the nickname, or stop following.
+func (app *application) follow(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	author, err := app.users.GetByNickname(c, c.Param("nickname"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(c)
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+	if author.ID == userID {
+		app.fail(c, errUnprocessable("You can't follow yourself.", nil))
+		return
+	}
+	var form followForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if form.Follow {
+		err = app.users.Follow(c, userID, author.ID)
+	} else {
+		err = app.users.Unfollow(c, userID, author.ID)
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/u/"+author.NickName)
+}
+
+// digest turns the email digest of unread notifications on or off for the user.
+func (app *application) digest(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	var form digestForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if err := app.users.SetDigest(c, userID, form.Digest); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "Your email preferences have been updated.")
+	c.Redirect(http.StatusFound, "/account/view")
+}
+
+// sendDigests mails every user receiving digests the unread notifications not sent yet. A failed email is logged
+// and its notifications are tried again next time.
+func (app *application) sendDigests(ctx context.Context) error {
+	digests, err := app.users.PendingDigests(ctx)
+	if err != nil {
+		return err
+	}
+	for userID, notifications := range digests {
+		user, err := app.users.GetUser(ctx, userID)
+		if err != nil {
+			app.logger.Error("Failed to send a digest", "user", userID, "error", err)
+			continue
+		}
+		var body strings.Builder
+		body.WriteString("Hi " + user.NickName + ",\n\nhere is what happened since the last email:\n\n")
+		ids := make([]int, len(notifications))
+		for i, n := range notifications {
+			view := describe(n)
+			body.WriteString("- " + view.Text + "\n  " + app.config.BaseURL + view.URL + "\n")
+			ids[i] = n.ID
+		}
+		body.WriteString("\nYou can turn these emails off on your account page:\n" + app.config.BaseURL + "/account/view\n")
+		err = app.mailer.Send(ctx, mailer.Message{To: user.Email, Subject: "News from Dialogue", Body: body.String()})
+		if err != nil {
+			app.logger.Error("Failed to send a digest", "user", userID, "error", err)
+			continue
+		}
+		if err := app.users.MarkEmailed(ctx, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digestLockKey is the Redis key a replica sets before sending digests, so replicas don't send them twice.
+const digestLockKey = "digests:lock"
+
+// lockDigests reports whether this replica may send the digests of the interval. The first replica to ask within
+// the interval gets the lock, which expires a little before the next one so ticker drift doesn't skip a round.
+func (app *application) lockDigests(ctx context.Context, interval time.Duration) (bool, error) {
+	return app.redisClient.SetNX(ctx, digestLockKey, time.Now().Format(time.RFC3339), interval*9/10).Result()
+}
+
+// runDigests sends digests every interval until the context is done. Only one replica sends them each interval.
+func (app *application) runDigests(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			locked, err := app.lockDigests(ctx, interval)
+			if err != nil {
+				app.logger.Error("Failed to lock digests", "error", err)
+				continue
+			}
+			if !locked {
+				continue
+			}
+			if err := app.sendDigests(ctx); err != nil {
+				app.logger.Error("Failed to send digests", "error", err)
+			}
+		}
+	}
+}
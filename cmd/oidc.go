@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"dialogue/internal/models"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// errUnconfirmedAccount is returned when the email belongs to an account whose owner never confirmed it. Linking
+// it could hand over an account somebody else registered with the address in advance.
+var errUnconfirmedAccount = errors.New("account with the email is not confirmed")
+
+// errSignupClosed is returned when no account has the email and new accounts can't be created.
+var errSignupClosed = errors.New("signup is disabled")
+
+const (
+	oidcStateCookieName = "oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+)
+
+// oidcProvider is a configured and discovered OpenID Connect provider.
+type oidcProvider struct {
+	Name        string
+	DisplayName string
+	oauth2      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+}
+
+// oidcLogin is what is remembered between redirecting the user to the provider and the callback.
+type oidcLogin struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// oidcClaims are the ID token claims used to find or create the user.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// newOIDCProviders discovers configured providers. Providers which can't be reached are skipped, so a broken
+// provider doesn't prevent logging in with a password.
+func newOIDCProviders(ctx context.Context, baseURL string, configs []OIDCProviderConfig, logger *slog.Logger) map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider)
+	for _, cfg := range configs {
+		provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+		if err != nil {
+			logger.Error("OIDC provider is disabled", "provider", cfg.Name, "error", err)
+			continue
+		}
+		scopes := cfg.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		providers[cfg.Name] = &oidcProvider{
+			Name:        cfg.Name,
+			DisplayName: cfg.DisplayName,
+			oauth2: oauth2.Config{
+				ClientID:     cfg.ClientID,
+				ClientSecret: cfg.ClientSecret,
+				Endpoint:     provider.Endpoint(),
+				RedirectURL:  baseURL + "/user/login/oidc/" + cfg.Name + "/callback",
+				Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+			},
+			verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		}
+	}
+	return providers
+}
+
+// loginProviders lists providers for the login page.
+func (app *application) loginProviders() []*oidcProvider {
+	var providers []*oidcProvider
+	for _, p := range app.oidcProviders {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].DisplayName < providers[j].DisplayName
+	})
+	return providers
+}
+
+// oidcStart redirects the user to the provider. State, nonce and the PKCE verifier are kept in Redis, the state
+// is also bound to the browser with a cookie.
+func (app *application) oidcStart(c *gin.Context) {
+	provider, ok := app.oidcProviders[c.Param("provider")]
+	if !ok {
+		app.notFound(c)
+		return
+	}
+
+	state := randomToken()
+	login := oidcLogin{
+		Provider: provider.Name,
+		Nonce:    randomToken(),
+		Verifier: oauth2.GenerateVerifier(),
+	}
+	jsonData, err := json.Marshal(login)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.redisClient.Set(c, "oidc:"+state, jsonData, oidcStateTTL).Err(); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setCookie(c, oidcStateCookieName, state, int(oidcStateTTL.Seconds()), "/user/login/oidc")
+	c.Redirect(http.StatusFound, provider.oauth2.AuthCodeURL(state, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)))
+}
+
+// oidcCallback exchanges the code for tokens, verifies the ID token and logs the linked user in.
+func (app *application) oidcCallback(c *gin.Context) {
+	provider, ok := app.oidcProviders[c.Param("provider")]
+	if !ok {
+		app.notFound(c)
+		return
+	}
+
+	//The state has to match the cookie set when the login started, and it can be used only once.
+	state := c.Query("state")
+	cookie, err := c.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cookie != state {
+		app.oidcFailed(c, "The login request is invalid or has expired.")
+		return
+	}
+	app.setCookie(c, oidcStateCookieName, "", -1, "/user/login/oidc")
+	jsonData, err := app.redisClient.GetDel(c, "oidc:"+state).Bytes()
+	if errors.Is(err, redis.Nil) {
+		app.oidcFailed(c, "The login request is invalid or has expired.")
+		return
+	} else if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	var login oidcLogin
+	if err := json.Unmarshal(jsonData, &login); err != nil || login.Provider != provider.Name {
+		app.oidcFailed(c, "The login request is invalid or has expired.")
+		return
+	}
+	if c.Query("error") != "" {
+		app.oidcFailed(c, "The login was cancelled.")
+		return
+	}
+
+	token, err := provider.oauth2.Exchange(c.Request.Context(), c.Query("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		app.logger.WarnContext(c, "OIDC code exchange failed", "provider", provider.Name, "error", err)
+		app.oidcFailed(c, "The login with "+provider.DisplayName+" failed.")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.verifier.Verify(c.Request.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		app.logger.WarnContext(c, "OIDC ID token is invalid", "provider", provider.Name, "error", err)
+		app.oidcFailed(c, "The login with "+provider.DisplayName+" failed.")
+		return
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	userID, err := app.oidcUser(c, provider.Name, idToken.Subject, claims)
+	if err != nil {
+		if errors.Is(err, models.ErrUnverifiedEmail) {
+			app.oidcFailed(c, provider.DisplayName+" has not verified your email address.")
+		} else if errors.Is(err, errUnconfirmedAccount) {
+			app.oidcFailed(c, "Please, confirm the email address of your account before logging in with "+provider.DisplayName+".")
+		} else if errors.Is(err, errSignupClosed) {
+			app.oidcFailed(c, "There is no account with your "+provider.DisplayName+" email address and signing up is closed.")
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+
+	//Single sign-on replaces the password, the second factor is still required.
+	user, err := app.users.GetUser(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if user.TOTPEnabled {
+		if err := app.startTOTPLogin(c, userID); err != nil {
+			app.serverError(c, err)
+			return
+		}
+		c.Redirect(http.StatusFound, "/user/login/totp")
+		return
+	}
+	if err := app.newSession(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "You logged in with "+provider.DisplayName+".")
+	c.Redirect(http.StatusFound, "/home")
+}
+
+// oidcUser finds the user linked to the subject. Unknown subjects are linked to the existing user with the same
+// email, or to a new user if signing up is enabled, but only if the provider verified the email.
+func (app *application) oidcUser(ctx context.Context, provider, subject string, claims oidcClaims) (int, error) {
+	user, err := app.users.GetByIdentity(ctx, provider, subject)
+	if err == nil {
+		return user.ID, nil
+	} else if !errors.Is(err, models.ErrNoRecord) {
+		return 0, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return 0, models.ErrUnverifiedEmail
+	}
+	var userID int
+	user, err = app.users.GetByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		if !user.EmailVerified {
+			return 0, errUnconfirmedAccount
+		}
+		userID = user.ID
+	case errors.Is(err, models.ErrNoRecord):
+		if !app.config.Features.Signup {
+			return 0, errSignupClosed
+		}
+		name := claims.Name
+		if name == "" {
+			name, _, _ = strings.Cut(claims.Email, "@")
+		}
+		userID, err = app.users.InsertExternal(ctx, name, claims.Email)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+	return userID, app.users.LinkIdentity(ctx, userID, provider, subject, claims.Email)
+}
+
+// oidcFailed sends the user back to the login page with the message.
+func (app *application) oidcFailed(c *gin.Context, message string) {
+	app.setFlash(c, message)
+	c.Redirect(http.StatusFound, "/user/login")
+}
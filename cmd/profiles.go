@@ -0,0 +1,140 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"errors"
+	"net/http"
+	"net/url"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of the profile form.
+const (
+	maxBioLength       = 1000
+	maxAvatarURLLength = 500
+)
+
+// profileForm holds the bio and avatar the user shows on the public profile.
+type profileForm struct {
+	Bio       string `schema:"bio"`
+	AvatarURL string `schema:"avatar"`
+}
+
+// profileData is the public profile of an author with a page of the author's public stories.
+type profileData struct {
+	User    *models.User
+	Stats   models.AuthorStats
+	Stories models.CataloguePage
+	NextURL string
+
+	Followers int
+	Following bool //Whether the reader follows the author.
+}
+
+// validAvatarURL reports whether the avatar is a HTTPS address, or blank for no avatar.
+func validAvatarURL(s string) bool {
+	if s == "" {
+		return true
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != "" && validator.MaxChars(s, maxAvatarURLLength)
+}
+
+// initial returns the first letter of the name, shown in place of a missing avatar.
+func initial(name string) string {
+	for _, r := range name {
+		return string(unicode.ToUpper(r))
+	}
+	return "?"
+}
+
+// profile renders the public profile of the author with the nickname.
+func (app *application) profile(c *gin.Context) {
+	user, err := app.users.GetByNickname(c, c.Param("nickname"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(c)
+		} else {
+			app.serverError(c, err)
+		}
+		return
+	}
+	//Nicknames match in any case, the profile has one address.
+	if user.NickName != c.Param("nickname") {
+		c.Redirect(http.StatusMovedPermanently, "/u/"+user.NickName)
+		return
+	}
+
+	stats, err := app.dialogues.AuthorStats(c, user.ID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	hidden, err := app.hiddenFor(c, app.getID(c))
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	page, err := app.dialogues.Catalogue(c, models.CatalogueQuery{
+		UserID:       app.getID(c),
+		AuthorID:     user.ID,
+		Cursor:       c.Query("after"),
+		HideWarnings: hidden,
+	})
+	if errors.Is(err, models.ErrInvalidCursor) {
+		app.fail(c, errBadRequest("The link to the page is broken, start from the first page.", err))
+		return
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	followers, err := app.users.FollowerCount(c, user.ID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	following, err := app.users.IsFollowing(c, app.getID(c), user.ID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	data := app.newTemplateData(c)
+	data.Profile = profileData{User: user, Stats: stats, Stories: page, Followers: followers, Following: following}
+	if page.Next != "" {
+		data.Profile.NextURL = "/u/" + user.NickName + "?after=" + url.QueryEscape(page.Next)
+	}
+	app.render(c, http.StatusOK, "profile.html", data)
+}
+
+// updateProfile saves the bio and avatar of the user's public profile.
+func (app *application) updateProfile(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	var form profileForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if !validator.MaxChars(form.Bio, maxBioLength) {
+		app.fail(c, errUnprocessable("The bio is too long.", nil))
+		return
+	}
+	if !validAvatarURL(form.AvatarURL) {
+		app.fail(c, errUnprocessable("The avatar must be an HTTPS address of an image.", nil))
+		return
+	}
+	if err := app.users.UpdateProfile(c, userID, form.Bio, form.AvatarURL); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "Your profile has been updated.")
+	c.Redirect(http.StatusFound, "/account/view")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of the rating form and of the reviews shown with a story.
+const (
+	maxReviewLength = 2000
+	reviewsShown    = 20
+)
+
+// ratingForm holds the stars and the optional review a reader gives a story.
+type ratingForm struct {
+	Stars  int    `schema:"stars"`
+	Review string `schema:"review"`
+}
+
+// favoriteForm tells whether to add the story to the favorites or to remove it.
+type favoriteForm struct {
+	Favorite bool `schema:"favorite"`
+}
+
+// review is a rating shown on the story page with its reader, who is nil if the account is gone.
+type review struct {
+	models.Rating
+	Reader *models.User
+}
+
+// ratingsData is what the story page shows about ratings: the reader's own rating and favorite, and the reviews.
+type ratingsData struct {
+	Mine     *models.Rating
+	Favorite bool
+	Reviews  []review
+}
+
+// stars formats the average rating of a story, e.g. "★ 4.5 (12)", or "Not rated yet".
+func stars(rating float64, ratings int) string {
+	if ratings == 0 {
+		return "Not rated yet"
+	}
+	return fmt.Sprintf("★ %.1f (%d)", rating, ratings)
+}
+
+// storyRatings loads the ratings data of the story for the page the user views.
+func (app *application) storyRatings(c *gin.Context, storyID, userID int) (data ratingsData, err error) {
+	if userID != 0 {
+		data.Mine, err = app.dialogues.UserRating(c, storyID, userID)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return data, err
+		}
+		if data.Favorite, err = app.dialogues.IsFavorite(c, storyID, userID); err != nil {
+			return data, err
+		}
+	}
+	ratings, err := app.dialogues.Reviews(c, storyID, reviewsShown)
+	if err != nil {
+		return data, err
+	}
+	for _, rating := range ratings {
+		reader, err := app.users.GetUser(c, rating.UserID)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return data, err
+		}
+		data.Reviews = append(data.Reviews, review{Rating: rating, Reader: reader})
+	}
+	return data, nil
+}
+
+// rate saves the stars and review the user gives the story, rating again replaces the previous rating.
+func (app *application) rate(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	storyID, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	var form ratingForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	if !validator.PermittedInt(form.Stars, 1, 2, 3, 4, 5) {
+		app.fail(c, errUnprocessable("Give the story from 1 to 5 stars.", nil))
+		return
+	}
+	if !validator.MaxChars(form.Review, maxReviewLength) {
+		app.fail(c, errUnprocessable(fmt.Sprintf("The review can't be longer than %d characters.", maxReviewLength), nil))
+		return
+	}
+
+	err = app.dialogues.Rate(c, storyID, userID, form.Stars, form.Review)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(c)
+		return
+	case errors.Is(err, models.ErrOwnStory):
+		app.fail(c, errForbidden("You can't rate your own story."))
+		return
+	case err != nil:
+		app.serverError(c, err)
+		return
+	}
+	if form.Review != "" {
+		story := app.dialogues.RetrieveBlocks(c, storyID).FirstBlock
+		app.notify(c, models.NotifyReview, story, 0, story.UserID)
+	}
+	app.setFlash(c, "Thank you for rating the story!")
+	c.Redirect(http.StatusFound, "/firstblock?id="+strconv.Itoa(storyID))
+}
+
+// favorite adds the story to the user's favorites or removes it.
+func (app *application) favorite(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	storyID, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		app.notFound(c)
+		return
+	}
+	var form favoriteForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	err = app.dialogues.SetFavorite(c, storyID, userID, form.Favorite)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.notFound(c)
+		return
+	}
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/firstblock?id="+strconv.Itoa(storyID))
+}
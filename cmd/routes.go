@@ -1,31 +1,81 @@
 package main
 
 import (
+	"io"
+
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func (app *application) routes() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	//Handlers pass the gin context on, it has to expose the values and deadline of the request context.
+	router.ContextWithFallback = true
+	router.Use(
+		otelgin.Middleware("dialogue"),
+		app.metrics.Middleware(),
+		app.requestIDMiddleware(),
+		app.logRequest(),
+		gin.CustomRecoveryWithWriter(io.Discard, app.recoverPanic),
+	)
+
+	//Probes, diagnostics and static files are registered before the middleware, they must not touch sessions.
+	router.GET("/healthz", app.healthz)
+	router.GET("/readyz", app.readyz)
+	router.GET("/metrics", app.requireDebugAuth(), gin.WrapH(app.metrics.Handler()))
+
+	//Static files are cached by browsers and proxies, their responses must not carry session cookies.
+	router.GET("/static/*filepath", app.serveStatic)
+	router.HEAD("/static/*filepath", app.serveStatic)
+
+	debugGroup := router.Group("/debug", app.requireDebugAuth())
+	debugGroup.GET("/vars", app.debugVars)
+	debugGroup.GET("/pprof/*profile", debugPprof)
+	debugGroup.POST("/pprof/*profile", debugPprof)
 
-	router.Use(app.authenticateMiddleware())
+	router.Use(app.authenticateMiddleware(), app.csrfMiddleware())
 
-	router.Static("/static", "./ui/static")
+	router.NoRoute(app.notFound)
 
 	router.GET("/", app.redirectHomePage)
 	router.GET("/home", app.homePage)
 	router.GET("/about", app.about)
+	router.GET("/search", app.search)
+	router.GET("/feeds/latest.atom", app.latestFeed)
+	router.GET("/feeds/latest.rss", app.latestFeed)
+	router.GET("/sitemap.xml", app.sitemap)
+	router.GET("/stories", app.catalogue)
+	router.GET("/tags/suggest", app.suggestTags)
+	router.GET("/tags/:tag", app.catalogue)
+	router.GET("/tags/:tag/feed.atom", app.tagFeed)
+	router.GET("/tags/:tag/feed.rss", app.tagFeed)
+	router.GET("/u/:nickname", app.profile)
+	router.GET("/u/:nickname/feed.atom", app.authorFeed)
+	router.GET("/u/:nickname/feed.rss", app.authorFeed)
+	router.POST("/u/:nickname/follow", app.follow)
+	router.GET("/notifications", app.inbox)
+	router.POST("/notifications/read", app.markRead)
 
-	router.GET("/newfirstblock", app.emptyFBView)
-	router.POST("/newfirstblock", app.createFB)
+	//Authoring routes may require two-factor authentication from authors of popular stories.
+	requireTOTP := app.requireTOTP()
+
+	router.GET("/newfirstblock", requireTOTP, app.emptyFBView)
+	router.POST("/newfirstblock", requireTOTP, app.createFB)
 	router.GET("/firstblock", app.createdFBView)
-	router.POST("/firstblock", app.deleteFB)
-	router.GET("/editfirstblock", app.editFBView)
-	router.POST("/editfirstblock", app.editFB)
+	router.POST("/firstblock", requireTOTP, app.deleteFB)
+	router.GET("/editfirstblock", requireTOTP, app.editFBView)
+	router.POST("/editfirstblock", requireTOTP, app.editFB)
+	router.POST("/rate", app.rate)
+	router.POST("/favorite", app.favorite)
+	router.POST("/comments", app.addComment)
+	router.POST("/comments/resolve", app.resolveComment)
+	router.POST("/collaborators", app.collaborators)
+	router.GET("/stories/analytics", app.analytics)
 
 	router.GET("/block", app.createdBView)
-	router.POST("/block", app.deleteB)
-	router.GET("/editblock", app.editBView)
-	router.POST("/editblock", app.editB)
+	router.POST("/block", requireTOTP, app.deleteB)
+	router.GET("/editblock", requireTOTP, app.editBView)
+	router.POST("/editblock", requireTOTP, app.editB)
 	router.GET("/{digits:[0-9]+}", app.redirectBlock)
 
 	router.GET("/user/signup", app.userSignupView)
@@ -33,9 +83,31 @@ func (app *application) routes() *gin.Engine {
 
 	router.GET("/user/login", app.userLoginView)
 	router.POST("/user/login", app.userLogin)
+	router.GET("/user/login/oidc/:provider", app.oidcStart)
+	router.GET("/user/login/oidc/:provider/callback", app.oidcCallback)
+	router.GET("/user/login/totp", app.totpLoginView)
+	router.POST("/user/login/totp", app.totpLogin)
 	router.POST("/user/logout", app.userLogout)
 
+	router.GET("/user/verify", app.verifyEmail)
+	router.GET("/user/verify/resend", app.resendVerificationView)
+	router.POST("/user/verify/resend", app.resendVerification)
+
+	router.GET("/user/password/forgot", app.forgotPasswordView)
+	router.POST("/user/password/forgot", app.forgotPassword)
+	router.GET("/user/password/reset", app.resetPasswordView)
+	router.POST("/user/password/reset", app.resetPassword)
+
 	router.GET("/account/view", app.accountView)
+	router.POST("/account/sessions/revoke", app.revokeSession)
+	router.POST("/account/sessions/logout-all", app.logoutEverywhere)
+	router.POST("/account/warnings", app.hiddenWarnings)
+	router.POST("/account/profile", app.updateProfile)
+	router.POST("/account/digest", app.digest)
+
+	router.GET("/account/totp/setup", app.totpSetupView)
+	router.POST("/account/totp/setup", app.totpSetup)
+	router.POST("/account/totp/disable", app.totpDisable)
 
 	router.GET("/account/password/update", app.passwordUpdateView)
 	router.POST("/account/password/update", app.passwordUpdate)
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// searchData is the query and the results shown on the search page.
+type searchData struct {
+	Query   string
+	Results []models.SearchResult
+}
+
+// search finds stories and blocks the user is able to see matching the query.
+func (app *application) search(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if len(query) > 200 {
+		app.fail(c, errBadRequest("The search query is too long.", nil))
+		return
+	}
+
+	data := app.newTemplateData(c)
+	data.Search.Query = query
+	if query != "" {
+		hidden, err := app.hiddenFor(c, app.getID(c))
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		results, err := app.dialogues.Search(c, query, app.getID(c), hidden)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		data.Search.Results = results
+	}
+	app.render(c, http.StatusOK, "search.html", data)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newServer builds the HTTP server for the handler with the configured timeouts and TLS settings.
+func (app *application) newServer(handler http.Handler) (*http.Server, error) {
+	cfg := app.config.Server
+	srv := &http.Server{
+		Addr:         app.config.Addr,
+		Handler:      handler,
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+
+	switch {
+	case cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	case cfg.TLSSelfSigned:
+		host := "localhost"
+		if u, err := url.Parse(app.config.BaseURL); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+		cert, err := selfSignedCertificate(host, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	}
+	return srv, nil
+}
+
+// serve runs the server on the listener until ctx is cancelled, then shuts it down gracefully: the app reports
+// not being ready first, keeps serving for the shutdown delay and then waits for in-flight requests to finish.
+func (app *application) serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	//Serve changes TLSConfig, it is only read before.
+	secure := srv.TLSConfig != nil
+	if secure {
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	app.ready.Store(true)
+	app.logger.Info("Listening", "addr", ln.Addr().String(), "tls", secure)
+
+	select {
+	case err := <-serveErr:
+		app.ready.Store(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	app.ready.Store(false)
+	app.logger.Info("Shutting down", "delay", time.Duration(app.config.Server.ShutdownDelay))
+	time.Sleep(time.Duration(app.config.Server.ShutdownDelay))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(app.config.Server.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// selfSignedCertificate generates a certificate for host valid for a year, for development without a real one.
+func selfSignedCertificate(host string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Dialogue development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func newServerTestApp() *application {
+	cfg := DefaultConfig()
+	return &application{
+		config: &cfg,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// TestServeDrainsRequests cancels the context while a request is in flight: the request must complete, the app
+// must stop being ready and serve must return without an error.
+func TestServeDrainsRequests(t *testing.T) {
+	app := newServerTestApp()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("saved"))
+	})
+	srv, err := app.newServer(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Shutdown begins once the app stopped being ready, it then waits for the request.
+	shuttingDown := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(shuttingDown) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- app.serve(ctx, srv, ln) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	if !app.ready.Load() {
+		t.Error("app is not ready while serving")
+	}
+	cancel()
+	<-shuttingDown
+	if app.ready.Load() {
+		t.Error("app is still ready during shutdown")
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the request finished: %v", err)
+	default:
+	}
+
+	close(release)
+	if got := <-body; got != "saved" {
+		t.Errorf("in-flight request got %q; want %q", got, "saved")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned %v", err)
+	}
+}
+
+func TestServeSelfSignedTLS(t *testing.T) {
+	app := newServerTestApp()
+	app.config.BaseURL = "https://127.0.0.1"
+	app.config.Server.TLSSelfSigned = true
+	srv, err := app.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.serve(ctx, srv, ln)
+
+	cert, err := x509.ParseCertificate(srv.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+}
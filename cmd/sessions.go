@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const sessionCookieName = "session_id"
+
+// session is the data stored in Redis under the session ID.
+type session struct {
+	ID           string `json:"-"`
+	UserID       int    `json:"userID"`
+	CreatedAt    int64  `json:"createdAt"`
+	LastActiveAt int64  `json:"lastActiveAt"`
+	UserAgent    string `json:"userAgent"`
+	IP           string `json:"ip"`
+
+	// Current marks the session of the request that lists sessions, it is not persisted.
+	Current bool `json:"-"`
+}
+
+// expired reports whether the session ran over the idle timeout or the absolute max age.
+func (s *session) expired(now time.Time, idleTimeout, maxAge time.Duration) bool {
+	if now.Sub(time.Unix(s.CreatedAt, 0)) > maxAge {
+		return true
+	}
+	return now.Sub(time.Unix(s.LastActiveAt, 0)) > idleTimeout
+}
+
+// ttl returns how long the session key should live in Redis from now.
+func (s *session) ttl(now time.Time, idleTimeout, maxAge time.Duration) time.Duration {
+	remaining := time.Unix(s.CreatedAt, 0).Add(maxAge).Sub(now)
+	if remaining < idleTimeout {
+		return remaining
+	}
+	return idleTimeout
+}
+
+// Handle identifies the session on the account page without revealing the session ID itself.
+func (s session) Handle() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// LastActive returns the time of the last request made with the session.
+func (s session) LastActive() time.Time {
+	return time.Unix(s.LastActiveAt, 0)
+}
+
+// Device returns a short human readable description of the browser and system used by the session.
+func (s session) Device() string {
+	ua := s.UserAgent
+	var browser, system string
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl/"):
+		browser = "curl"
+	default:
+		browser = "Unknown browser"
+	}
+	switch {
+	case strings.Contains(ua, "Android"):
+		system = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		system = "iOS"
+	case strings.Contains(ua, "Windows"):
+		system = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(ua, "Linux"):
+		system = "Linux"
+	default:
+		return browser
+	}
+	return browser + " on " + system
+}
+
+// sessionExpired checks the session against the configured timeouts.
+func (app *application) sessionExpired(s *session, now time.Time) bool {
+	return s.expired(now, time.Duration(app.config.Cookie.SessionIdleTimeout), time.Duration(app.config.Cookie.SessionMaxAge))
+}
+
+// sessionTTL returns how long the session key should live with the configured timeouts.
+func (app *application) sessionTTL(s *session, now time.Time) time.Duration {
+	return s.ttl(now, time.Duration(app.config.Cookie.SessionIdleTimeout), time.Duration(app.config.Cookie.SessionMaxAge))
+}
+
+// userSessionsKey is the Redis set holding IDs of all sessions that belong to the user.
+func userSessionsKey(userID int) string {
+	return "user:" + strconv.Itoa(userID) + ":sessions"
+}
+
+// saveSession stores the session in Redis and registers it in the user's set of sessions.
+func (app *application) saveSession(c *gin.Context, s *session, now time.Time) error {
+	jsonData, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := app.sessionTTL(s, now)
+	pipe := app.redisClient.TxPipeline()
+	pipe.Set(c, s.ID, jsonData, ttl)
+	pipe.SAdd(c, userSessionsKey(s.UserID), s.ID)
+	pipe.Expire(c, userSessionsKey(s.UserID), time.Duration(app.config.Cookie.SessionMaxAge))
+	_, err = pipe.Exec(c)
+	return err
+}
+
+// getSession reads the session with ID from Redis. It returns nil if the session does not exist.
+func (app *application) getSession(c *gin.Context, sessionID string) (*session, error) {
+	jsonData, err := app.redisClient.Get(c, sessionID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s session
+	if err := json.Unmarshal(jsonData, &s); err != nil {
+		return nil, nil
+	}
+	s.ID = sessionID
+	return &s, nil
+}
+
+// newSession creates a fresh session for the user and sets the cookie. Any session the request already carried
+// is destroyed, so the session ID always rotates on login and on privilege changes.
+func (app *application) newSession(c *gin.Context, userID int) error {
+	if oldID := app.sessionID(c); oldID != "" {
+		if err := app.destroySession(c, oldID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	s := &session{
+		ID:           generateSessionID(),
+		UserID:       userID,
+		CreatedAt:    now.Unix(),
+		LastActiveAt: now.Unix(),
+		UserAgent:    c.Request.UserAgent(),
+		IP:           c.ClientIP(),
+	}
+	if err := app.saveSession(c, s, now); err != nil {
+		return err
+	}
+	app.setCookie(c, sessionCookieName, s.ID, int(time.Duration(app.config.Cookie.SessionIdleTimeout).Seconds()), "/")
+	c.Set(sessionIDContextKey, s.ID)
+	c.Set(userIDContextKey, userID)
+	return nil
+}
+
+// loadSession validates the session carried by the request cookie. Expired sessions are destroyed, valid ones
+// get their idle timeout extended both in Redis and in the cookie.
+func (app *application) loadSession(c *gin.Context) (*session, error) {
+	sessionID, err := c.Cookie(sessionCookieName)
+	if err != nil || sessionID == "" {
+		return nil, nil
+	}
+	s, err := app.getSession(c, sessionID)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if app.sessionExpired(s, now) {
+		app.setCookie(c, sessionCookieName, "", -1, "/")
+		return nil, app.destroySession(c, sessionID)
+	}
+
+	s.LastActiveAt = now.Unix()
+	if err := app.saveSession(c, s, now); err != nil {
+		return nil, err
+	}
+	app.setCookie(c, sessionCookieName, s.ID, int(app.sessionTTL(s, now).Seconds()), "/")
+	return s, nil
+}
+
+// destroySession removes the session with ID and everything stored alongside it.
+func (app *application) destroySession(c *gin.Context, sessionID string) error {
+	s, err := app.getSession(c, sessionID)
+	if err != nil {
+		return err
+	}
+	pipe := app.redisClient.TxPipeline()
+	pipe.Del(c, sessionID, "flash:"+sessionID)
+	if s != nil {
+		pipe.SRem(c, userSessionsKey(s.UserID), sessionID)
+	}
+	_, err = pipe.Exec(c)
+	return err
+}
+
+// destroyUserSessions destroys every session of the user except the one with ID except (may be empty).
+func (app *application) destroyUserSessions(c *gin.Context, userID int, except string) error {
+	ids, err := app.redisClient.SMembers(c, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == except {
+			continue
+		}
+		if err := app.destroySession(c, id); err != nil {
+			return err
+		}
+		// The session may already have expired, in which case destroySession can't find its owner.
+		app.redisClient.SRem(c, userSessionsKey(userID), id)
+	}
+	return nil
+}
+
+// userSessions lists active sessions of the user, most recently used first. Sessions that expired in Redis
+// are pruned from the user's set on the way.
+func (app *application) userSessions(c *gin.Context, userID int) ([]session, error) {
+	ids, err := app.redisClient.SMembers(c, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	current := app.sessionID(c)
+	now := time.Now()
+	var sessions []session
+	for _, id := range ids {
+		s, err := app.getSession(c, id)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil || app.sessionExpired(s, now) {
+			app.redisClient.SRem(c, userSessionsKey(userID), id)
+			continue
+		}
+		s.Current = id == current
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActiveAt > sessions[j].LastActiveAt
+	})
+	return sessions, nil
+}
+
+// sessionID returns ID of the session related to the request, if any.
+func (app *application) sessionID(c *gin.Context) string {
+	if id := c.GetString(sessionIDContextKey); id != "" {
+		return id
+	}
+	id, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// revokeSession signs out one of the user's sessions, chosen on the account page.
+func (app *application) revokeSession(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	sessions, err := app.userSessions(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	var sessionID string
+	for _, s := range sessions {
+		if s.Handle() == c.PostForm("session") {
+			sessionID = s.ID
+			break
+		}
+	}
+	if sessionID == "" {
+		app.notFound(c)
+		return
+	}
+	if err := app.destroySession(c, sessionID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if sessionID == app.sessionID(c) {
+		app.setCookie(c, sessionCookieName, "", -1, "/")
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	app.setFlash(c, "The session has been signed out.")
+	c.Redirect(http.StatusFound, "/account/view")
+}
+
+// logoutEverywhere signs out every session of the user, including the current one.
+func (app *application) logoutEverywhere(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	if err := app.destroyUserSessions(c, userID, ""); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setCookie(c, sessionCookieName, "", -1, "/")
+	app.setCookie(c, "flash_message", "You have been signed out on all devices.", 5, "/")
+	c.Redirect(http.StatusFound, "/user/login")
+}
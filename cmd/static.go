@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staticAssets holds the files of ui/static. Pages link them with a hash of the content in the name, like
+// /static/css/main.1a2b3c4d5e6f.css, so they can be cached forever: a changed file gets a new URL.
+type staticAssets struct {
+	fsys fs.FS
+
+	//hashes maps file names to hashes of their content, names maps hashed names back to file names. Both are
+	//empty in dev mode, where files change while the app runs.
+	hashes map[string]string
+	names  map[string]string
+}
+
+// immutableCache is sent with hashed URLs, the content behind them never changes.
+const immutableCache = "public, max-age=31536000, immutable"
+
+// newStaticAssets hashes every file of fsys, unless hash is false.
+func newStaticAssets(fsys fs.FS, hash bool) (*staticAssets, error) {
+	sa := &staticAssets{fsys: fsys, hashes: map[string]string{}, names: map[string]string{}}
+	if !hash {
+		return sa, nil
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		sa.hashes[name] = hex.EncodeToString(sum[:6])
+		sa.names[hashedName(name, sa.hashes[name])] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sa, nil
+}
+
+// hashedName puts the hash before the extension of the file name.
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// url returns the URL pages link the file with, templates call it as {{static "css/main.css"}}.
+func (sa *staticAssets) url(name string) string {
+	if hash, ok := sa.hashes[name]; ok {
+		return "/static/" + hashedName(name, hash)
+	}
+	return "/static/" + name
+}
+
+// serveStatic serves a static file by its hashed or plain name. Plain names are revalidated on every use.
+func (app *application) serveStatic(c *gin.Context) {
+	sa := app.assets
+	name := strings.TrimPrefix(c.Param("filepath"), "/")
+	if file, ok := sa.names[name]; ok {
+		c.Header("Cache-Control", immutableCache)
+		c.Header("ETag", `"`+sa.hashes[file]+`"`)
+		http.ServeFileFS(c.Writer, c.Request, sa.fsys, file)
+		return
+	}
+
+	info, err := fs.Stat(sa.fsys, name)
+	if err != nil || info.IsDir() {
+		app.notFound(c)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	//Embedded files have no modification time, the hash lets browsers revalidate them.
+	if hash, ok := sa.hashes[name]; ok {
+		c.Header("ETag", `"`+hash+`"`)
+	}
+	http.ServeFileFS(c.Writer, c.Request, sa.fsys, name)
+}
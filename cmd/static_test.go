@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"dialogue/ui"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticAssets(t *testing.T) {
+	app := newErrorTestApp(t)
+	router := app.routes()
+	cssURL := app.assets.url("css/main.css")
+	if cssURL == "/static/css/main.css" {
+		t.Fatal("URL of main.css has no hash")
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		etag   bool
+		status int
+		cache  string
+	}{
+		{"hashed name", cssURL, false, http.StatusOK, immutableCache},
+		{"plain name", "/static/css/main.css", false, http.StatusOK, "no-cache"},
+		{"revalidated", "/static/css/main.css", true, http.StatusNotModified, "no-cache"},
+		{"stale hash", "/static/css/main.000000000000.css", false, http.StatusNotFound, ""},
+		{"directory", "/static/css/", false, http.StatusNotFound, ""},
+		{"outside", "/static/../html/base.html", false, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.etag {
+				req.Header.Set("If-None-Match", `"`+app.assets.hashes["css/main.css"]+`"`)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d; want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Cache-Control"); tt.cache != "" && got != tt.cache {
+				t.Errorf("got Cache-Control %q; want %q", got, tt.cache)
+			}
+			if cookies := rr.Header().Values("Set-Cookie"); len(cookies) != 0 {
+				t.Errorf("asset sets cookies %q", cookies)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/about", nil))
+	if !strings.Contains(rr.Body.String(), cssURL) {
+		t.Errorf("page doesn't link %s", cssURL)
+	}
+}
+
+// TestWatchTemplates edits a copy of the templates in dev mode: a change must show up without a restart and a
+// broken template must not replace the working pages.
+func TestWatchTemplates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, ui.Files); err != nil {
+		t.Fatal(err)
+	}
+	uiFS := os.DirFS(dir)
+	app := newCSRFTestApp()
+	var err error
+	app.assets, err = newStaticAssets(os.DirFS(filepath.Join(dir, "static")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.templates, err = newTemplateCache(uiFS, app.assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.watchTemplates(ctx, filepath.Join(dir, "html"))
+	//Give the watcher time to add the directories.
+	time.Sleep(100 * time.Millisecond)
+
+	about := filepath.Join(dir, "html", "pages", "about.html")
+	render := func() string {
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/about", nil))
+		return rr.Body.String()
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if strings.Contains(render(), want) {
+				return
+			}
+		}
+		t.Fatalf("page never contained %q", want)
+	}
+
+	if err := os.WriteFile(about, []byte(`{{define "title"}}About{{end}}{{define "main"}}Edited while running{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("Edited while running")
+
+	if err := os.WriteFile(about, []byte(`{{define "main"}}{{.Broken`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !strings.Contains(render(), "Edited while running") {
+		t.Error("a broken template replaced the working page")
+	}
+}
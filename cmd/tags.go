@@ -0,0 +1,103 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// suggestionLimit is how many tags the autocompletion offers.
+const suggestionLimit = 10
+
+// hiddenWarningsForm holds the content warnings the reader chose to hide on the account page.
+type hiddenWarningsForm struct {
+	Warnings []string `schema:"warnings"`
+}
+
+// detailsFromForm checks the language, genre, tags and warnings of the story form and returns them as details.
+// Tags are separated by commas and normalized, repeated ones are dropped.
+func detailsFromForm(form *StoryForm) models.StoryDetails {
+	details := models.StoryDetails{Language: form.Language, Genre: form.Genre}
+	form.CheckField(knownLanguage(form.Language), "language", "Choose one of the languages")
+	form.CheckField(form.Genre == "" || slices.Contains(models.Genres, form.Genre), "genre", "Choose one of the genres")
+	for _, warning := range form.Warnings {
+		form.CheckField(slices.Contains(models.ContentWarnings, warning), "warnings", "Choose among the listed warnings")
+		if !slices.Contains(details.Warnings, warning) {
+			details.Warnings = append(details.Warnings, warning)
+		}
+	}
+	for _, field := range strings.Split(form.Tags, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		tag, ok := models.NormalizeTag(field)
+		form.CheckField(ok, "tags", fmt.Sprintf("Tags have up to %d letters, digits or dashes", models.MaxTagLength))
+		if ok && !slices.Contains(details.Tags, tag) {
+			details.Tags = append(details.Tags, tag)
+		}
+	}
+	form.CheckField(len(details.Tags) <= models.MaxTags, "tags", fmt.Sprintf("A story has up to %d tags", models.MaxTags))
+	return details
+}
+
+// suggestTags answers the autocompletion of tags on the story forms with the most used tags starting with q.
+func (app *application) suggestTags(c *gin.Context) {
+	var suggestions []gin.H
+	if prefix, ok := models.NormalizeTag(c.Query("q")); ok {
+		tags, err := app.dialogues.SuggestTags(c, prefix, suggestionLimit)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		for _, tag := range tags {
+			suggestions = append(suggestions, gin.H{"name": tag.Name, "stories": tag.Stories})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": suggestions})
+}
+
+// hiddenWarnings saves the content warnings of stories the reader doesn't want to see in lists.
+func (app *application) hiddenWarnings(c *gin.Context) {
+	userID := app.getID(c)
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	var form hiddenWarningsForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	for _, warning := range form.Warnings {
+		if !validator.PermittedString(warning, models.ContentWarnings...) {
+			app.fail(c, errUnprocessable("Choose among the listed warnings.", nil))
+			return
+		}
+	}
+	if err := app.users.SetHiddenWarnings(c, userID, form.Warnings); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "Stories with the chosen warnings are hidden from now on.")
+	c.Redirect(http.StatusFound, "/account/view")
+}
+
+// hiddenFor returns the warnings the user hides, none for guests.
+func (app *application) hiddenFor(c *gin.Context, userID int) ([]string, error) {
+	if userID == 0 {
+		return nil, nil
+	}
+	user, err := app.users.GetUser(c, userID)
+	if errors.Is(err, models.ErrNoRecord) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user.Hidden(), nil
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
 	"dialogue/internal/models"
+	"fmt"
 	"html/template"
+	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // Different data that could be passed into templates.
@@ -15,47 +25,201 @@ type data struct {
 	UserLoginForm UserLoginForm
 	PasswordForm  accountPasswordUpdateForm
 
+	EmailForm         emailForm
+	PasswordResetForm passwordResetForm
+	TOTP              totpData
+
 	//Data that gathered from the databases.
 	DataDialogues models.DialoguesData
 	UserData      *models.User
+	Sessions      []session
+	Search        searchData
+	Catalogue     catalogueData
+	Details       models.StoryDetails
+	Author        *models.User
+	Profile       profileData
+	Ratings       ratingsData
+	Favorites     []models.FirstBlock
+	Review        reviewData
+	Notifications []notificationView
+	Analytics     analyticsData
 
 	//Data that could be extracted from the context via helper function "newTemplateData".
 	CurrentYear     int
 	Flash           string
 	IsAuthenticated bool
+	SignupEnabled   bool
+	CSRFToken       string
 	UserID          int
+	Unread          int
+
+	//LoginProviders are the single sign-on providers offered on the login page.
+	LoginProviders []*oidcProvider
+
+	//ShowResendVerification offers a new confirmation link on the login page.
+	ShowResendVerification bool
+
+	//Error is shown by the error page.
+	Error errorData
+}
+
+// pages lists every page handlers render. checkPages makes sure all of them exist whenever templates are parsed, so
+// a typo in a page name stops the app instead of failing the request using it; a test keeps the list in sync with
+// the handlers.
+var pages = []string{
+	"about.html",
+	"account.html",
+	"analytics.html",
+	"createFB.html",
+	"editB.html",
+	"editFB.html",
+	"error.html",
+	"forgot.html",
+	"home.html",
+	"login.html",
+	"notifications.html",
+	"password.html",
+	"profile.html",
+	"renderB.html",
+	"renderFB.html",
+	"resend.html",
+	"reset.html",
+	"search.html",
+	"signup.html",
+	"stories.html",
+	"totplogin.html",
+	"totpsetup.html",
+}
+
+// checkPages reports pages which handlers render but the cache doesn't have.
+func checkPages(cache map[string]*template.Template) error {
+	var missing []string
+	for _, page := range pages {
+		if _, ok := cache[page]; !ok {
+			missing = append(missing, page)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing pages: %s", strings.Join(missing, ", "))
+	}
+	return nil
 }
 
-// newTemplateCache parses existing pages once and stores them.
-func newTemplateCache() (map[string]*template.Template, error) {
-	cache := map[string]*template.Template{}
+// templateCache holds the parsed pages. In dev mode they are replaced while requests are rendered, so access is
+// guarded.
+type templateCache struct {
+	fsys  fs.FS
+	funcs template.FuncMap
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// newTemplateCache parses the pages of fsys, which holds the contents of the ui directory.
+func newTemplateCache(fsys fs.FS, assets *staticAssets) (*templateCache, error) {
+	tc := &templateCache{
+		fsys:  fsys,
+		funcs: template.FuncMap{"static": assets.url},
+	}
+	if err := tc.load(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// load parses existing pages and replaces the cached ones. If any page fails to parse or is missing the cached
+// pages are kept.
+func (tc *templateCache) load() error {
+	pages := map[string]*template.Template{}
 	patterns := []string{
-		"./ui/html/pages/firstBlock/*.html",
-		"./ui/html/pages/block/*.html",
-		"./ui/html/pages/users/*.html",
-		"./ui/html/pages/*.html",
+		"html/pages/firstBlock/*.html",
+		"html/pages/block/*.html",
+		"html/pages/users/*.html",
+		"html/pages/*.html",
 	}
-	files, err := globbing(patterns)
+	files, err := globbing(tc.fsys, patterns)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, page := range files {
-		name := filepath.Base(page)
-		ts, err := template.New(name).Funcs(functions).ParseFiles("./ui/html/base.html")
+		name := path.Base(page)
+		ts, err := template.New(name).Funcs(functions).Funcs(tc.funcs).ParseFS(tc.fsys, "html/base.html", "html/partials/*.html", page)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		ts, err = ts.ParseGlob("./ui/html/partials/*.html")
-		if err != nil {
-			return nil, err
+		pages[name] = ts
+	}
+	if err := checkPages(pages); err != nil {
+		return err
+	}
+
+	tc.mu.Lock()
+	tc.pages = pages
+	tc.mu.Unlock()
+	return nil
+}
+
+// get returns the parsed page.
+func (tc *templateCache) get(page string) (*template.Template, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	ts, ok := tc.pages[page]
+	return ts, ok
+}
+
+// uiDir is where dev mode reads templates and static files from.
+const uiDir = "./ui"
+
+// watchTemplates reloads templates whenever a file under dir changes, until ctx is done. A template which fails
+// to parse is logged and the previous pages are served until it is fixed.
+func (app *application) watchTemplates(ctx context.Context, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	//fsnotify doesn't watch subdirectories, each of them is added on its own.
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
 		}
-		ts, err = ts.ParseFiles(page)
-		if err != nil {
-			return nil, err
+		return watcher.Add(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	//Editors save a file in several steps, events are collected for a moment before reloading.
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watcher.Add(event.Name)
+				}
+			}
+			reload = time.After(100 * time.Millisecond)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			app.logger.Warn("Template watcher failed", "error", err)
+		case <-reload:
+			reload = nil
+			if err := app.templates.load(); err != nil {
+				app.logger.Error("Failed to reload templates", "error", err)
+				continue
+			}
+			app.logger.Info("Templates reloaded")
 		}
-		cache[name] = ts
 	}
-	return cache, nil
 }
 
 func humanTime(t time.Time) string {
@@ -63,5 +227,14 @@ func humanTime(t time.Time) string {
 }
 
 var functions = template.FuncMap{
-	"humanTime": humanTime,
+	"humanTime":    humanTime,
+	"csrfField":    csrfField,
+	"languages":    func() []language { return languages },
+	"languageName": languageName,
+	"genres":       func() []string { return models.Genres },
+	"warnings":     func() []string { return models.ContentWarnings },
+	"join":         strings.Join,
+	"has":          slices.Contains[[]string],
+	"initial":      initial,
+	"stars":        stars,
 }
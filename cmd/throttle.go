@@ -0,0 +1,41 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/validator"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// throttled checks whether the attempt identified by keys is allowed. If not, an error telling the user how long
+// to wait is added to the form and true is returned.
+func (app *application) throttled(c *gin.Context, form *validator.Validator, keys ...string) (bool, error) {
+	ok, wait, err := app.throttle.Allow(c, keys...)
+	if err != nil || ok {
+		return false, err
+	}
+	form.AddNonFieldError("Too many attempts. Please try again in " + humanWait(wait) + ".")
+	return true, nil
+}
+
+// recordFailure counts a failed attempt for the key and writes an audit entry if it caused a lockout.
+func (app *application) recordFailure(c *gin.Context, key string, userID int, subject string) error {
+	locked, err := app.throttle.Fail(c, key)
+	if err != nil || !locked {
+		return err
+	}
+	details := fmt.Sprintf("%s locked out for %s after %d failed attempts", key, app.throttle.LockoutDuration, app.throttle.MaxFailures)
+	app.logger.WarnContext(c, "Lockout", "key", key, "duration", app.throttle.LockoutDuration)
+	return app.audit.Insert(models.AuditLockout, userID, subject, c.ClientIP(), details)
+}
+
+// humanWait formats the time to wait rounding it up to seconds or minutes.
+func humanWait(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(d.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"dialogue/internal/models"
+	"dialogue/internal/totp"
+	"dialogue/internal/validator"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer            = "Dialogue"
+	totpPendingCookieName = "totp_pending"
+	totpPendingTTL        = 5 * time.Minute
+	totpSetupTTL          = 10 * time.Minute
+	recoveryCodeCount     = 10
+
+	// popularStoryPlays is how many plays make a story popular enough for its author to need two-factor authentication.
+	popularStoryPlays = 1000
+)
+
+type totpForm struct {
+	Code     string `schema:"code"`
+	Password string `schema:"password"`
+	validator.Validator
+}
+
+// totpData is passed to the pages enrolling and using two-factor authentication.
+type totpData struct {
+	Form          totpForm
+	QRCode        template.URL
+	Secret        string
+	RecoveryCodes []string
+	Required      bool
+}
+
+// popularAuthorPolicy requires two-factor authentication from authors of popular public stories.
+func (app *application) popularAuthorPolicy(ctx context.Context, userID int) (bool, error) {
+	plays, err := app.dialogues.MostPlayed(ctx, userID)
+	return plays >= popularStoryPlays, err
+}
+
+// totpRequired runs the enforcement hook deciding whether the user has to enable two-factor authentication.
+func (app *application) totpRequired(ctx context.Context, userID int) (bool, error) {
+	if app.totpPolicy == nil || userID == 0 {
+		return false, nil
+	}
+	return app.totpPolicy(ctx, userID)
+}
+
+// requireTOTP sends users, who are required to enable two-factor authentication but did not, to the enrollment page.
+func (app *application) requireTOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := app.getID(c)
+		required, err := app.totpRequired(c, userID)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		if !required {
+			c.Next()
+			return
+		}
+		user, err := app.users.GetUser(c, userID)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		if !user.TOTPEnabled {
+			app.setFlash(c, "Your stories are popular! Please, enable two-factor authentication to keep editing them.")
+			c.Redirect(http.StatusFound, "/account/totp/setup")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// startTOTPLogin remembers the user who passed the password check and waits for the second factor.
+func (app *application) startTOTPLogin(c *gin.Context, userID int) error {
+	pendingID := randomToken()
+	if err := app.redisClient.Set(c, "totp-login:"+pendingID, userID, totpPendingTTL).Err(); err != nil {
+		return err
+	}
+	app.setCookie(c, totpPendingCookieName, pendingID, int(totpPendingTTL.Seconds()), "/")
+	return nil
+}
+
+// pendingTOTPLogin returns ID of the user waiting for the second login step, zero if there is none.
+func (app *application) pendingTOTPLogin(c *gin.Context) (string, int, error) {
+	pendingID, err := c.Cookie(totpPendingCookieName)
+	if err != nil || pendingID == "" {
+		return "", 0, nil
+	}
+	userID, err := app.redisClient.Get(c, "totp-login:"+pendingID).Int()
+	if errors.Is(err, redis.Nil) {
+		return "", 0, nil
+	}
+	return pendingID, userID, err
+}
+
+// checkSecondFactor accepts either a current TOTP code, which can be used only once, or one of the recovery codes.
+func (app *application) checkSecondFactor(c *gin.Context, user *models.User, code string) (ok, recovery bool, err error) {
+	if step, valid := totp.Validate(user.TOTPSecret, code, time.Now(), 1); valid {
+		key := "totp-used:" + strconv.Itoa(user.ID) + ":" + strconv.FormatInt(step, 10)
+		fresh, err := app.redisClient.SetNX(c, key, 1, 3*totp.Period).Result()
+		return fresh, false, err
+	}
+	ok, err = app.users.UseRecoveryCode(c, user.ID, code)
+	return ok, ok, err
+}
+
+// totpLoginView renders the second step of the login asking for the code from the authenticator app.
+func (app *application) totpLoginView(c *gin.Context) {
+	_, userID, err := app.pendingTOTPLogin(c)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if userID == 0 {
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	data := app.newTemplateData(c)
+	app.render(c, http.StatusOK, "totplogin.html", data)
+}
+
+// totpLogin finishes the login of the user who passed the password check once the second factor is valid.
+func (app *application) totpLogin(c *gin.Context) {
+	pendingID, userID, err := app.pendingTOTPLogin(c)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if userID == 0 {
+		app.setFlash(c, "The login has expired. Please, log in again.")
+		c.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	var form totpForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+
+	if !form.Valid() {
+		data := app.newTemplateData(c)
+		data.TOTP.Form = form
+		app.render(c, http.StatusUnprocessableEntity, "totplogin.html", data)
+		return
+	}
+
+	userKey := "totp:user:" + strconv.Itoa(userID)
+	throttled, err := app.throttled(c, &form.Validator, "totp:ip:"+c.ClientIP(), userKey)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if throttled {
+		data := app.newTemplateData(c)
+		data.TOTP.Form = form
+		app.render(c, http.StatusTooManyRequests, "totplogin.html", data)
+		return
+	}
+
+	user, err := app.users.GetUser(c, userID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	ok, recovery, err := app.checkSecondFactor(c, user, form.Code)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if !ok {
+		app.metrics.LoginFailures.WithLabelValues("totp").Inc()
+		if err := app.recordFailure(c, userKey, userID, user.Email); err != nil {
+			app.serverError(c, err)
+			return
+		}
+		form.AddFieldError("code", "The code is incorrect")
+		data := app.newTemplateData(c)
+		data.TOTP.Form = form
+		app.render(c, http.StatusUnprocessableEntity, "totplogin.html", data)
+		return
+	}
+	if err := app.throttle.Succeed(c, userKey); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	app.redisClient.Del(c, "totp-login:"+pendingID)
+	app.setCookie(c, totpPendingCookieName, "", -1, "/")
+	if err := app.newSession(c, userID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if recovery {
+		app.setFlash(c, "You logged in with a recovery code. It can't be used again.")
+	} else {
+		app.setFlash(c, "You logged in with a geat success.")
+	}
+	c.Redirect(http.StatusFound, "/home")
+}
+
+// totpSetupView generates a new secret and renders it as a QR code to be scanned by an authenticator app.
+func (app *application) totpSetupView(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	//With two-factor authentication enabled the page offers to disable it instead.
+	if user.TOTPEnabled {
+		required, err := app.totpRequired(c, user.ID)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		data := app.newTemplateData(c)
+		data.TOTP.Required = required
+		app.render(c, http.StatusOK, "totpsetup.html", data)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.redisClient.Set(c, "totp-setup:"+app.sessionID(c), secret, totpSetupTTL).Err(); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	data, err := app.totpSetupData(c, user, secret)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.render(c, http.StatusOK, "totpsetup.html", data)
+}
+
+// totpSetup enables two-factor authentication once the user proves the app generates valid codes, and shows
+// the recovery codes for the only time.
+func (app *application) totpSetup(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	secret, err := app.redisClient.Get(c, "totp-setup:"+app.sessionID(c)).Result()
+	if errors.Is(err, redis.Nil) {
+		app.setFlash(c, "The setup has expired. Please, scan the new code.")
+		c.Redirect(http.StatusFound, "/account/totp/setup")
+		return
+	} else if err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	var form totpForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+	if form.Valid() {
+		_, ok := totp.Validate(secret, form.Code, time.Now(), 1)
+		form.CheckField(ok, "code", "The code is incorrect")
+	}
+	if !form.Valid() {
+		data, err := app.totpSetupData(c, user, secret)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		data.TOTP.Form = form
+		app.render(c, http.StatusUnprocessableEntity, "totpsetup.html", data)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if err := app.users.EnableTOTP(c, user.ID, secret, codes); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.redisClient.Del(c, "totp-setup:"+app.sessionID(c))
+
+	//Enabling the second factor changes privileges of the session, so it is rotated.
+	if err := app.newSession(c, user.ID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+
+	data := app.newTemplateData(c)
+	data.TOTP.RecoveryCodes = codes
+	app.render(c, http.StatusOK, "totpsetup.html", data)
+}
+
+// totpDisable turns off two-factor authentication after checking the password and a code.
+func (app *application) totpDisable(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	required, err := app.totpRequired(c, user.ID)
+	if err != nil {
+		app.serverError(c, err)
+		return
+	}
+	if required {
+		app.setFlash(c, "Two-factor authentication is required for authors of popular stories.")
+		c.Redirect(http.StatusFound, "/account/view")
+		return
+	}
+
+	var form totpForm
+	if err := app.parse(c, &form); err != nil {
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+
+	userKey := "totp:user:" + strconv.Itoa(user.ID)
+	if form.Valid() {
+		throttled, err := app.throttled(c, &form.Validator, userKey)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		if throttled {
+			data := app.newTemplateData(c)
+			data.TOTP.Form = form
+			app.render(c, http.StatusTooManyRequests, "totpsetup.html", data)
+			return
+		}
+	}
+	failed := false
+	if form.Valid() {
+		_, err := app.users.Authenticate(c, user.Email, form.Password)
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			form.AddFieldError("password", "Password is incorrect")
+			failed = true
+		} else if err != nil {
+			app.serverError(c, err)
+			return
+		}
+	}
+	if form.Valid() {
+		ok, _, err := app.checkSecondFactor(c, user, form.Code)
+		if err != nil {
+			app.serverError(c, err)
+			return
+		}
+		form.CheckField(ok, "code", "The code is incorrect")
+		failed = !ok
+	}
+	if !form.Valid() {
+		if failed {
+			if err := app.recordFailure(c, userKey, user.ID, user.Email); err != nil {
+				app.serverError(c, err)
+				return
+			}
+		}
+		data := app.newTemplateData(c)
+		data.TOTP.Form = form
+		app.render(c, http.StatusUnprocessableEntity, "totpsetup.html", data)
+		return
+	}
+
+	if err := app.users.DisableTOTP(c, user.ID); err != nil {
+		app.serverError(c, err)
+		return
+	}
+	app.setFlash(c, "Two-factor authentication has been disabled.")
+	c.Redirect(http.StatusFound, "/account/view")
+}
+
+// totpSetupData prepares the enrollment page with the secret both as a QR code and as text.
+func (app *application) totpSetupData(c *gin.Context, user *models.User, secret string) (*data, error) {
+	png, err := qrcode.Encode(totp.URL(totpIssuer, user.Email, secret), qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+	required, err := app.totpRequired(c, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	data := app.newTemplateData(c)
+	data.TOTP.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	data.TOTP.Secret = secret
+	data.TOTP.Required = required
+	return data, nil
+}
+
+// currentUser gets the logged in user, sending visitors to the login page. It returns false if the handler should stop.
+func (app *application) currentUser(c *gin.Context) (*models.User, bool) {
+	user, err := app.users.GetUser(c, app.getID(c))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			c.Redirect(http.StatusFound, "/user/login")
+		} else {
+			app.serverError(c, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// generateRecoveryCodes returns n random codes formatted like "abcde-fghij".
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
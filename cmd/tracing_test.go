@@ -0,0 +1,65 @@
+package main
+
+import (
+	"dialogue/internal/models"
+	"dialogue/internal/tracing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// TestTracingSpans checks that a request produces a span for the route with spans of the model methods and SQL
+// statements nested below it.
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	//Dry run builds statements and runs the callbacks without a database.
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(tracing.GormPlugin{System: "postgresql"}); err != nil {
+		t.Fatal(err)
+	}
+	app := newCSRFTestApp()
+	app.dialogues = &models.DialogueModel{DB: db}
+
+	app.routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/firstblock?id=1", nil))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	parents := make(map[string]string)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	for _, s := range recorder.Ended() {
+		for name, p := range spans {
+			if p.SpanContext().SpanID() == s.Parent().SpanID() {
+				parents[s.Name()] = name
+			}
+		}
+	}
+
+	for child, parent := range map[string]string{
+		"DialogueModel.CreatedFBView":  "/firstblock",
+		"DialogueModel.RetrieveBlocks": "DialogueModel.CreatedFBView",
+		"gorm.query":                   "DialogueModel.RetrieveBlocks",
+	} {
+		if _, ok := spans[child]; !ok {
+			t.Errorf("span %s is missing, got %v", child, recorder.Ended())
+			continue
+		}
+		if parents[child] != parent {
+			t.Errorf("span %s has parent %q; want %q", child, parents[child], parent)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// GormLogger writes gorm's messages and statements to a slog logger. Statements are logged at debug level, slow
+// ones as warnings and failed ones as errors.
+type GormLogger struct {
+	Logger        *slog.Logger
+	SlowThreshold time.Duration
+}
+
+func (l *GormLogger) LogMode(logger.LogLevel) logger.Interface {
+	//Levels are controlled by the slog handler.
+	return l
+}
+
+func (l *GormLogger) Info(ctx context.Context, msg string, data ...any) {
+	l.Logger.InfoContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l *GormLogger) Warn(ctx context.Context, msg string, data ...any) {
+	l.Logger.WarnContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l *GormLogger) Error(ctx context.Context, msg string, data ...any) {
+	l.Logger.ErrorContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	elapsed := time.Since(begin)
+	level := slog.LevelDebug
+	msg := "SQL statement"
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		level, msg = slog.LevelError, "SQL statement failed"
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold:
+		level, msg = slog.LevelWarn, "Slow SQL statement"
+	}
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	sql, rows := fc()
+	attrs := []any{slog.String("sql", sql), slog.Int64("rows", rows), slog.Duration("elapsed", elapsed)}
+	if level == slog.LevelError {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	l.Logger.Log(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := With(context.Background(), "request_id", "abc")
+	child := With(parent, "user_id", 7)
+	With(parent, "user_id", 8) //Must not leak into child.
+	logger.InfoContext(child, "hello", "page", "home")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "hello" || record["request_id"] != "abc" || record["user_id"] != float64(7) || record["page"] != "home" {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+func TestNewRejectsInvalidSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if _, err := New(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "text", "warn")
+	logger.Info("dropped")
+	logger.Warn("kept")
+	if strings.Contains(buf.String(), "dropped") || !strings.Contains(buf.String(), "kept") {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestGormLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "text", "debug")
+	l := &GormLogger{Logger: logger, SlowThreshold: time.Second}
+	ctx := With(context.Background(), "request_id", "abc")
+	statement := func() (string, int64) { return "SELECT 1", 1 }
+
+	tests := []struct {
+		name  string
+		begin time.Time
+		err   error
+		want  string
+	}{
+		{"statement", time.Now(), nil, "level=DEBUG"},
+		{"slow statement", time.Now().Add(-2 * time.Second), nil, "level=WARN"},
+		{"failed statement", time.Now(), errors.New("boom"), "level=ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			l.Trace(ctx, tt.begin, statement, tt.err)
+			out := buf.String()
+			if !strings.Contains(out, tt.want) || !strings.Contains(out, `sql="SELECT 1"`) || !strings.Contains(out, "request_id=abc") {
+				t.Errorf("unexpected output %q", out)
+			}
+		})
+	}
+
+	//Statements aren't even rendered when debug logs are off.
+	quiet, _ := New(&buf, "text", "info")
+	buf.Reset()
+	rendered := false
+	(&GormLogger{Logger: quiet}).Trace(ctx, time.Now(), func() (string, int64) { rendered = true; return "", 0 }, nil)
+	if rendered || buf.Len() != 0 {
+		t.Error("debug statement was rendered")
+	}
+}
@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxMailer(t *testing.T) {
+	m := &OutboxMailer{Dir: t.TempDir(), From: "Dialogue <no-reply@example.com>"}
+	err := m.Send(context.Background(), Message{
+		To:      "Reader <reader@example.com>",
+		Subject: "Hello\r\nBcc: evil@example.com",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(m.Dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("got %d files in outbox; want 1", len(files))
+	}
+	content, _ := os.ReadFile(files[0])
+	for _, want := range []string{"To: Reader <reader@example.com>\r\n", "Subject: HelloBcc: evil@example.com\r\n", "line one\r\nline two"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("message does not contain %q:\n%s", want, content)
+		}
+	}
+}
+
+func TestOutboxMailerInvalidAddress(t *testing.T) {
+	m := &OutboxMailer{Dir: t.TempDir()}
+	if err := m.Send(context.Background(), Message{To: "not an address"}); err == nil {
+		t.Error("expected an error for invalid recipient")
+	}
+}
+
+func TestOutboxMailerFileNames(t *testing.T) {
+	root := t.TempDir()
+	m := &OutboxMailer{Dir: filepath.Join(root, "outbox")}
+	for _, to := range []string{"a/b@example.com", `"x/../../../y"@example.com`, `"..\\..\\y"@example.com`} {
+		if err := m.Send(context.Background(), Message{To: to, Subject: "Hi", Body: "Hello"}); err != nil {
+			t.Errorf("sending to %s: %v", to, err)
+		}
+	}
+	files, _ := os.ReadDir(m.Dir)
+	if len(files) != 3 {
+		t.Errorf("got %d files in the outbox; want 3", len(files))
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("got %d entries next to the outbox; want the outbox only", len(entries))
+	}
+}
+
+// TestSMTPMailerGivesUp talks to a server which accepts connections but never greets: Send returns once the context
+// is done instead of waiting for it.
+func TestSMTPMailerGivesUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		conn.Close()
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	m := &SMTPMailer{Host: "127.0.0.1", Port: addr.Port, From: "no-reply@example.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := m.Send(ctx, Message{To: "reader@example.com", Subject: "Hi", Body: "Hello"}); err == nil {
+		t.Error("expected an error from a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// OutboxMailer writes every message as an .eml file into Dir instead of sending it.
+type OutboxMailer struct {
+	Dir  string
+	From string
+
+	mu   sync.Mutex
+	sent int
+}
+
+func (m *OutboxMailer) Send(_ context.Context, msg Message) error {
+	to, err := address(msg.To)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.sent++
+	n := m.sent
+	m.mu.Unlock()
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%03d-%s.eml", now.Format("20060102T150405"), n, fileSafe(to))
+	path := filepath.Join(m.Dir, name)
+	if filepath.Dir(path) != filepath.Clean(m.Dir) {
+		return fmt.Errorf("mailer: file name %q leaves the outbox", name)
+	}
+	return os.WriteFile(path, format(m.From, msg, now), 0o644)
+}
+
+// fileSafe turns the address into a part of a file name: characters other than letters, digits and ".@+-" become
+// "_", the result is cut to 64 bytes and ends with a hash of the address, so different addresses don't collide.
+func fileSafe(address string) string {
+	safe := []byte(address)
+	for i, b := range safe {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '.', b == '@', b == '+', b == '-':
+		default:
+			safe[i] = '_'
+		}
+	}
+	if len(safe) > 64 {
+		safe = safe[:64]
+	}
+	sum := sha256.Sum256([]byte(address))
+	return string(safe) + "-" + hex.EncodeToString(sum[:4])
+}
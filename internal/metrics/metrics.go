@@ -0,0 +1,121 @@
+// Package metrics collects Prometheus metrics of HTTP requests, database queries, Redis commands and of what
+// readers and authors do with stories.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dialogue"
+
+// Metrics holds all collectors of the app registered on their own registry.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	HTTPRequests  *prometheus.CounterVec
+	HTTPDuration  *prometheus.HistogramVec
+	DBDuration    *prometheus.HistogramVec
+	RedisDuration *prometheus.HistogramVec
+
+	StoriesCreated      prometheus.Counter
+	BlocksEdited        prometheus.Counter
+	PlaythroughsStarted prometheus.Counter
+	LoginFailures       *prometheus.CounterVec
+}
+
+// New creates the collectors and registers them together with the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		HTTPRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		HTTPDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		DBDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Latency of database queries by operation, table and result.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "table", "result"}),
+		RedisDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "redis_command_duration_seconds",
+			Help:      "Latency of Redis commands and pipelines by command and result.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"command", "result"}),
+		StoriesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stories_created_total",
+			Help:      "Stories created.",
+		}),
+		BlocksEdited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "blocks_edited_total",
+			Help:      "Edits of first blocks and blocks of stories.",
+		}),
+		PlaythroughsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "playthroughs_started_total",
+			Help:      "Stories opened by readers other than their authors.",
+		}),
+		LoginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "login_failures_total",
+			Help:      "Failed logins by the factor which failed.",
+		}, []string{"factor"}),
+	}
+	//Known label values are initialized, so their series exist before the first failure.
+	for _, factor := range []string{"password", "totp"} {
+		m.LoginFailures.WithLabelValues(factor)
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.HTTPRequests, m.HTTPDuration, m.DBDuration, m.RedisDuration,
+		m.StoriesCreated, m.BlocksEdited, m.PlaythroughsStarted, m.LoginFailures,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// Middleware observes requests by the route pattern they matched, not by the path, so IDs in paths don't
+// create new series.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.HTTPRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		m.HTTPDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// result is the value of the result label for err.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// gathered returns the names of all metric families the registry exposes.
+func gathered(t *testing.T, m *Metrics) map[string]bool {
+	t.Helper()
+	families, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	return names
+}
+
+func TestDomainMetricsRegistered(t *testing.T) {
+	names := gathered(t, New())
+	for _, name := range []string{
+		"dialogue_stories_created_total",
+		"dialogue_blocks_edited_total",
+		"dialogue_playthroughs_started_total",
+		"dialogue_login_failures_total",
+		"go_goroutines",
+	} {
+		if !names[name] {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New()
+	router := gin.New()
+	router.Use(m.Middleware())
+	router.GET("/block", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, path := range []string{"/block?id=1", "/block?id=2", "/missing"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := testutil.ToFloat64(m.HTTPRequests.WithLabelValues("/block", "GET", "200")); got != 2 {
+		t.Errorf("requests of /block: got %v; want 2", got)
+	}
+	if got := testutil.ToFloat64(m.HTTPRequests.WithLabelValues("unmatched", "GET", "404")); got != 1 {
+		t.Errorf("unmatched requests: got %v; want 1", got)
+	}
+	if !gathered(t, m)["dialogue_http_request_duration_seconds"] {
+		t.Error("request duration is not registered")
+	}
+}
+
+func TestGormPlugin(t *testing.T) {
+	m := New()
+	//Dry run builds statements and runs the callbacks without a database.
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(GormPlugin{Metrics: m}); err != nil {
+		t.Fatal(err)
+	}
+
+	type Story struct {
+		ID    int
+		Title string
+	}
+	db.Create(&Story{Title: "t"})
+	db.Find(&[]Story{})
+
+	if got := testutil.CollectAndCount(m.DBDuration); got != 2 {
+		t.Errorf("got %d series of query durations; want 2", got)
+	}
+	if !gathered(t, m)["dialogue_db_query_duration_seconds"] {
+		t.Error("query duration is not registered")
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	m := New()
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	client.AddHook(RedisHook{Metrics: m})
+	defer client.Close()
+
+	//Commands fail without a server, which is observed as well.
+	client.Get(context.Background(), "key")
+
+	families, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "dialogue_redis_command_duration_seconds" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["command"] == "get" && labels["result"] == "error" && metric.GetHistogram().GetSampleCount() == 1 {
+				return
+			}
+		}
+	}
+	t.Error("the failed GET was not observed")
+}
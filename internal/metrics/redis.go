@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook times every command and pipeline sent to Redis. Register it with client.AddHook.
+type RedisHook struct {
+	Metrics *Metrics
+}
+
+func (h RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := next(ctx, network, addr)
+		h.observe("dial", start, err)
+		return conn, err
+	}
+}
+
+func (h RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.observe(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (h RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.observe("pipeline", start, err)
+		return err
+	}
+}
+
+func (h RedisHook) observe(command string, start time.Time, err error) {
+	//A missing key is an answer, not a failure of Redis.
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	h.Metrics.RedisDuration.WithLabelValues(command, result(err)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,85 @@
+package mockoidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// TestAuthorizationCodeFlow runs the whole flow the way the app does: discovery, authorization with PKCE,
+// code exchange and ID token verification.
+func TestAuthorizationCodeFlow(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	issuer, err := New("http://"+ts.Listener.Addr().String(), "dialogue", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.Handler = issuer
+	ts.Start()
+	defer ts.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, issuer.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := oauth2.Config{
+		ClientID:     "dialogue",
+		ClientSecret: "secret",
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  "http://app.test/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	//Sign in on the authorization page and catch the redirect back to the app.
+	authURL, _ := url.Parse(config.AuthCodeURL("state-1", oidc.Nonce("nonce-1"), oauth2.S256ChallengeOption(verifier)))
+	form := authURL.Query()
+	form.Set("email", "reader@example.com")
+	form.Set("email_verified", "true")
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Post(issuer.Issuer+"/authorize", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Query().Get("state") != "state-1" {
+		t.Fatalf("unexpected redirect %q", resp.Header.Get("Location"))
+	}
+
+	//Exchanging the code without the PKCE verifier must fail.
+	if _, err := config.Exchange(ctx, callback.Query().Get("code")); err == nil {
+		t.Fatal("code exchanged without the PKCE verifier")
+	}
+
+	//The code was consumed by the failed attempt, so sign in again and exchange it properly.
+	resp, _ = client.Post(issuer.Issuer+"/authorize", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+	token, err := config.Exchange(ctx, callback.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "dialogue"}).Verify(ctx, rawIDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Nonce != "nonce-1" || claims.Email != "reader@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected ID token: nonce %q, claims %+v", idToken.Nonce, claims)
+	}
+}
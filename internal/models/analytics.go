@@ -0,0 +1,204 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reading is one anonymous walk of a reader through a story, from opening the first block on. It is known by a
+// hash of a random cookie only, never by the user, so the picks can't be traced back to anybody.
+type Reading struct {
+	ID        string `gorm:"primaryKey;type:text"`
+	StoryID   int    `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// Pick is a move of a reading from a block to another one via an option.
+type Pick struct {
+	ID        int    `gorm:"primaryKey"`
+	ReadingID string `gorm:"type:text;index"`
+	StoryID   int    `gorm:"index"`
+	FromBlock int    //0 for the first block of the story.
+	ToBlock   int
+	CreatedAt time.Time
+}
+
+// ReadingStats sums up the readings of a story. Blocks are keyed by ID, 0 being the first block.
+type ReadingStats struct {
+	Readings  int
+	Steps     int            //All picks of all readings.
+	Completed int            //Readings which reached one of the endings.
+	Picks     map[[2]int]int //By the block picked from and the block picked.
+	Reached   map[int]int    //Readings which reached the block.
+	Left      map[int]int    //Readings which picked an option on the block.
+}
+
+// StartReading records that a reading of the story has begun.
+func (dm *DialogueModel) StartReading(ctx context.Context, storyID int, readingID string) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.StartReading")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Reading{ID: readingID, StoryID: storyID}).Error
+}
+
+// RecordPick records that the reading moved from a block of the story to another one. It returns ErrNoRecord if the
+// reading isn't one of the story.
+func (dm *DialogueModel) RecordPick(ctx context.Context, readingID string, storyID, fromBlock, toBlock int) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.RecordPick")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var count int64
+	if err := db.Model(&Reading{}).Where("id = ? AND story_id = ?", readingID, storyID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRecord
+	}
+	return db.Create(&Pick{ReadingID: readingID, StoryID: storyID, FromBlock: fromBlock, ToBlock: toBlock}).Error
+}
+
+// ReadingStats sums up the readings of the story, a reading is completed when it reaches one of the endings.
+func (dm *DialogueModel) ReadingStats(ctx context.Context, storyID int, endings []int) (ReadingStats, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.ReadingStats")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	stats := ReadingStats{Picks: make(map[[2]int]int), Reached: make(map[int]int), Left: make(map[int]int)}
+
+	var readings int64
+	if err := db.Model(&Reading{}).Where("story_id = ?", storyID).Count(&readings).Error; err != nil {
+		return stats, err
+	}
+	stats.Readings = int(readings)
+	stats.Reached[0] = stats.Readings
+
+	picks := func() *gorm.DB { return db.Model(&Pick{}).Where("story_id = ?", storyID) }
+	var moves []struct{ FromBlock, ToBlock, Count int }
+	if err := picks().Select("from_block, to_block, count(*) AS count").Group("from_block, to_block").Scan(&moves).Error; err != nil {
+		return stats, err
+	}
+	for _, move := range moves {
+		stats.Picks[[2]int{move.FromBlock, move.ToBlock}] = move.Count
+		stats.Steps += move.Count
+	}
+
+	var blocks []struct{ Block, Count int }
+	if err := picks().Select("to_block AS block, count(DISTINCT reading_id) AS count").Group("to_block").Scan(&blocks).Error; err != nil {
+		return stats, err
+	}
+	for _, block := range blocks {
+		stats.Reached[block.Block] = block.Count
+	}
+	blocks = nil
+	if err := picks().Select("from_block AS block, count(DISTINCT reading_id) AS count").Group("from_block").Scan(&blocks).Error; err != nil {
+		return stats, err
+	}
+	for _, block := range blocks {
+		stats.Left[block.Block] = block.Count
+	}
+
+	if len(endings) > 0 {
+		var completed int64
+		err := picks().Where("to_block IN ?", endings).Distinct("reading_id").Count(&completed).Error
+		if err != nil {
+			return stats, err
+		}
+		stats.Completed = int(completed)
+	}
+	return stats, nil
+}
+
+// StartReading records that a reading of the story has begun.
+func (mm *MemoryDialogueModel) StartReading(ctx context.Context, storyID int, readingID string) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if _, ok := mm.readings[readingID]; !ok {
+		mm.readings[readingID] = Reading{ID: readingID, StoryID: storyID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+// RecordPick records that the reading moved from a block of the story to another one. It returns ErrNoRecord if the
+// reading isn't one of the story.
+func (mm *MemoryDialogueModel) RecordPick(ctx context.Context, readingID string, storyID, fromBlock, toBlock int) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if reading, ok := mm.readings[readingID]; !ok || reading.StoryID != storyID {
+		return ErrNoRecord
+	}
+	mm.lastPickID++
+	mm.picks = append(mm.picks, Pick{
+		ID:        mm.lastPickID,
+		ReadingID: readingID,
+		StoryID:   storyID,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// ReadingStats sums up the readings of the story, a reading is completed when it reaches one of the endings.
+func (mm *MemoryDialogueModel) ReadingStats(ctx context.Context, storyID int, endings []int) (ReadingStats, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	stats := ReadingStats{Picks: make(map[[2]int]int), Reached: make(map[int]int), Left: make(map[int]int)}
+	for _, reading := range mm.readings {
+		if reading.StoryID == storyID {
+			stats.Readings++
+		}
+	}
+	stats.Reached[0] = stats.Readings
+
+	ending := make(map[int]bool)
+	for _, id := range endings {
+		ending[id] = true
+	}
+	type visit struct {
+		reading string
+		block   int
+	}
+	reached, left := make(map[visit]bool), make(map[visit]bool)
+	completed := make(map[string]bool)
+	for _, pick := range mm.picks {
+		if pick.StoryID != storyID {
+			continue
+		}
+		stats.Picks[[2]int{pick.FromBlock, pick.ToBlock}]++
+		stats.Steps++
+		if key := (visit{pick.ReadingID, pick.ToBlock}); !reached[key] {
+			reached[key] = true
+			stats.Reached[pick.ToBlock]++
+		}
+		if key := (visit{pick.ReadingID, pick.FromBlock}); !left[key] {
+			left[key] = true
+			stats.Left[pick.FromBlock]++
+		}
+		if ending[pick.ToBlock] {
+			completed[pick.ReadingID] = true
+		}
+	}
+	stats.Completed = len(completed)
+	return stats, nil
+}
+
+// deleteReadings drops the readings of the story and their picks. It must be called with mu held.
+func (mm *MemoryDialogueModel) deleteReadings(storyID int) {
+	for id, reading := range mm.readings {
+		if reading.StoryID == storyID {
+			delete(mm.readings, id)
+		}
+	}
+	picks := mm.picks[:0]
+	for _, pick := range mm.picks {
+		if pick.StoryID != storyID {
+			picks = append(picks, pick)
+		}
+	}
+	mm.picks = picks
+}
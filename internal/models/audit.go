@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Audit actions.
+const (
+	AuditLockout = "lockout"
+)
+
+type AuditEntry struct {
+	ID      int    `gorm:"primary_key"`
+	Action  string `gorm:"type:text;index"`
+	UserID  int
+	Subject string `gorm:"type:text"`
+	IP      string `gorm:"type:text"`
+	Details string `gorm:"type:text"`
+
+	CreatedAt time.Time
+}
+
+type AuditModel struct {
+	DB *gorm.DB
+}
+
+// Insert records a security relevant event. Subject is what the event is about, e.g. an email or an IP address.
+func (am *AuditModel) Insert(action string, userID int, subject, ip, details string) error {
+	entry := AuditEntry{
+		Action:  action,
+		UserID:  userID,
+		Subject: subject,
+		IP:      ip,
+		Details: details,
+	}
+	return am.DB.Create(&entry).Error
+}
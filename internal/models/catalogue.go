@@ -0,0 +1,306 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Orders of the catalogue.
+const (
+	SortNewest  = "newest"
+	SortUpdated = "updated"
+	SortPlayed  = "played"
+	SortRated   = "rated"
+)
+
+// Lengths of stories, by the number of blocks besides the first one.
+const (
+	LengthShort  = "short"  //Up to shortStory blocks.
+	LengthMedium = "medium" //Up to mediumStory blocks.
+	LengthLong   = "long"
+)
+
+const (
+	shortStory  = 10
+	mediumStory = 50
+)
+
+// Sizes of catalogue pages.
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// ErrInvalidCursor is returned for cursors which weren't made by the catalogue or belong to another order.
+var ErrInvalidCursor = errors.New("models: invalid cursor")
+
+// CatalogueQuery selects and orders the stories of a catalogue page. Empty filters match every story.
+type CatalogueQuery struct {
+	UserID int  //The reader.
+	Mine   bool //Lists stories of the reader including private ones, instead of public stories of everyone.
+
+	Sort         string
+	AuthorID     int
+	Language     string
+	Length       string
+	Genre        string
+	Tag          string
+	HideWarnings []string //Leaves out stories carrying any of the warnings, except the user's own.
+
+	Cursor string //Next of the previous page, empty for the first page.
+	Limit  int
+}
+
+// CatalogueStory is a story listed in the catalogue with the number of its blocks besides the first one.
+type CatalogueStory struct {
+	FirstBlock
+	Blocks int
+}
+
+// CataloguePage is a page of the catalogue, Next is the cursor of the following page or empty on the last one.
+type CataloguePage struct {
+	Stories []CatalogueStory
+	Next    string
+}
+
+// StoryDetails describe a story besides its text, they are set apart from the blocks.
+type StoryDetails struct {
+	Language string
+	Genre    string
+	Tags     []string
+	Warnings []string
+}
+
+// cursor is the position of the last story of a page in the order of the catalogue.
+type cursor struct {
+	Sort    string    `json:"s"`
+	ID      int       `json:"i"`
+	Updated time.Time `json:"u,omitempty"`
+	Plays   int       `json:"p,omitempty"`
+	Rating  float64   `json:"r,omitempty"`
+}
+
+func newCursor(sort string, story FirstBlock) string {
+	c := cursor{Sort: sort, ID: story.ID}
+	switch sort {
+	case SortUpdated:
+		c.Updated = story.UpdatedAt
+	case SortPlayed:
+		c.Plays = story.Plays
+	case SortRated:
+		c.Rating = story.Rating
+	}
+	jsonData, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+func parseCursor(s, sort string) (c cursor, err error) {
+	jsonData, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(jsonData, &c); err != nil || c.Sort != sort {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// normalize fills the defaults of the query.
+func (q *CatalogueQuery) normalize() {
+	if q.Sort == "" {
+		q.Sort = SortNewest
+	}
+	if q.Limit <= 0 || q.Limit > MaxPageSize {
+		q.Limit = DefaultPageSize
+	}
+}
+
+// page cuts the stories fetched one over the limit to the page, the extra story tells there is a next one.
+func (q *CatalogueQuery) page(stories []CatalogueStory) CataloguePage {
+	if len(stories) <= q.Limit {
+		return CataloguePage{Stories: stories}
+	}
+	stories = stories[:q.Limit]
+	return CataloguePage{Stories: stories, Next: newCursor(q.Sort, stories[len(stories)-1].FirstBlock)}
+}
+
+// blockCount counts blocks of the story in the row of first_blocks.
+const blockCount = "(SELECT count(*) FROM blocks WHERE blocks.story_id = first_blocks.id)"
+
+// Catalogue returns a page of stories matching the query, continuing after the cursor of the query.
+func (dm *DialogueModel) Catalogue(ctx context.Context, q CatalogueQuery) (CataloguePage, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Catalogue")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	q.normalize()
+
+	tx := db.Table("first_blocks").Select("first_blocks.*, " + blockCount + " AS blocks").Where("deleted_at IS NULL")
+	if q.Mine {
+		tx = tx.Where("user_id = ?", q.UserID)
+	} else {
+		tx = tx.Where("privacy = false")
+	}
+	if q.AuthorID != 0 {
+		tx = tx.Where("user_id = ?", q.AuthorID)
+	}
+	if q.Language != "" {
+		tx = tx.Where("language = ?", q.Language)
+	}
+	if q.Genre != "" {
+		tx = tx.Where("genre = ?", q.Genre)
+	}
+	if q.Tag != "" {
+		tx = tx.Where("EXISTS (SELECT 1 FROM story_tags WHERE story_tags.story_id = first_blocks.id AND kind = ? AND name = ?)", kindTag, q.Tag)
+	}
+	tx = hideWarnings(tx, q.UserID, q.HideWarnings)
+	switch q.Length {
+	case LengthShort:
+		tx = tx.Where(blockCount+" <= ?", shortStory)
+	case LengthMedium:
+		tx = tx.Where(blockCount+" > ? AND "+blockCount+" <= ?", shortStory, mediumStory)
+	case LengthLong:
+		tx = tx.Where(blockCount+" > ?", mediumStory)
+	}
+
+	var after *cursor
+	if q.Cursor != "" {
+		c, err := parseCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return CataloguePage{}, err
+		}
+		after = &c
+	}
+	//Stories are ordered by ID last, so a cursor points between two stories even if their keys are equal.
+	switch q.Sort {
+	case SortUpdated:
+		tx = tx.Order("updated_at DESC, id DESC")
+		if after != nil {
+			tx = tx.Where("(updated_at < ? OR (updated_at = ? AND id < ?))", after.Updated, after.Updated, after.ID)
+		}
+	case SortPlayed:
+		tx = tx.Order("plays DESC, id DESC")
+		if after != nil {
+			tx = tx.Where("(plays < ? OR (plays = ? AND id < ?))", after.Plays, after.Plays, after.ID)
+		}
+	case SortRated:
+		tx = tx.Order("rating DESC, id DESC")
+		if after != nil {
+			tx = tx.Where("(rating < ? OR (rating = ? AND id < ?))", after.Rating, after.Rating, after.ID)
+		}
+	default:
+		tx = tx.Order("id DESC")
+		if after != nil {
+			tx = tx.Where("id < ?", after.ID)
+		}
+	}
+
+	var stories []CatalogueStory
+	if err := tx.Limit(q.Limit + 1).Find(&stories).Error; err != nil {
+		return CataloguePage{}, err
+	}
+	return q.page(stories), nil
+}
+
+// SetDetails replaces the details of the story with ID.
+func (dm *DialogueModel) SetDetails(ctx context.Context, id int, details StoryDetails) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.SetDetails")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&FirstBlock{}).Where("id = ?", id).UpdateColumns(map[string]any{
+			"language": details.Language,
+			"genre":    details.Genre,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return replaceTags(tx, id, details)
+	})
+}
+
+// Catalogue returns a page of stories matching the query, continuing after the cursor of the query.
+func (mm *MemoryDialogueModel) Catalogue(ctx context.Context, q CatalogueQuery) (CataloguePage, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	q.normalize()
+
+	var after *FirstBlock
+	if q.Cursor != "" {
+		c, err := parseCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return CataloguePage{}, err
+		}
+		after = &FirstBlock{ID: c.ID, UpdatedAt: c.Updated, Plays: c.Plays, Rating: c.Rating}
+	}
+	//before reports whether the story a comes first in the order of the catalogue.
+	before := func(a, b FirstBlock) bool {
+		switch q.Sort {
+		case SortUpdated:
+			if !a.UpdatedAt.Equal(b.UpdatedAt) {
+				return a.UpdatedAt.After(b.UpdatedAt)
+			}
+		case SortPlayed:
+			if a.Plays != b.Plays {
+				return a.Plays > b.Plays
+			}
+		case SortRated:
+			if a.Rating != b.Rating {
+				return a.Rating > b.Rating
+			}
+		}
+		return a.ID > b.ID
+	}
+
+	var stories []CatalogueStory
+	for _, fb := range mm.firstBlocks {
+		if fb.DeletedAt != nil || q.Mine && fb.UserID != q.UserID || !q.Mine && fb.Privacy {
+			continue
+		}
+		if q.AuthorID != 0 && fb.UserID != q.AuthorID || q.Language != "" && fb.Language != q.Language {
+			continue
+		}
+		if q.Genre != "" && fb.Genre != q.Genre || q.Tag != "" && !mm.hasTag(fb.ID, kindTag, q.Tag) {
+			continue
+		}
+		if mm.hidden(fb, q.UserID, q.HideWarnings) {
+			continue
+		}
+		blocks := len(mm.storyBlocks(fb.ID))
+		switch {
+		case q.Length == LengthShort && blocks > shortStory,
+			q.Length == LengthMedium && (blocks <= shortStory || blocks > mediumStory),
+			q.Length == LengthLong && blocks <= mediumStory:
+			continue
+		}
+		if after != nil && !before(*after, fb) {
+			continue
+		}
+		stories = append(stories, CatalogueStory{FirstBlock: fb, Blocks: blocks})
+	}
+	sort.Slice(stories, func(i, j int) bool { return before(stories[i].FirstBlock, stories[j].FirstBlock) })
+	if len(stories) > q.Limit+1 {
+		stories = stories[:q.Limit+1]
+	}
+	return q.page(stories), nil
+}
+
+// SetDetails replaces the details of the story with ID.
+func (mm *MemoryDialogueModel) SetDetails(ctx context.Context, id int, details StoryDetails) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if story, ok := mm.firstBlocks[id]; ok {
+		story.Language = details.Language
+		story.Genre = details.Genre
+		mm.firstBlocks[id] = story
+		mm.tags[id] = storyTags(id, details)
+	}
+	return nil
+}
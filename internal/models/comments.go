@@ -0,0 +1,323 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Collaborator is a user the author invited to review the story. Collaborators read and write comments on its
+// blocks, only the author edits the story.
+type Collaborator struct {
+	StoryID   int `gorm:"primaryKey;autoIncrement:false"`
+	UserID    int `gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time
+}
+
+// Comment is a note on a block of a story. The first comment starts a thread, replies point to it with ParentID.
+type Comment struct {
+	ID       int `gorm:"primaryKey"`
+	StoryID  int `gorm:"index:idx_comments_block"`
+	BlockID  int `gorm:"index:idx_comments_block"` //0 for the first block of the story.
+	ParentID int //The first comment of the thread, 0 for the first comment itself.
+	UserID   int
+	Body     string `gorm:"type:text"`
+	Mentions JSON   `gorm:"default:'[]'"` //IDs of the mentioned users.
+	Resolved bool   //Set on the first comment of the thread.
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Mentioned returns the IDs of the users the comment mentions.
+func (c *Comment) Mentioned() []int {
+	var ids []int
+	json.Unmarshal(c.Mentions, &ids)
+	return ids
+}
+
+// CommentCount sums up the comments on a block: all of them and the threads not resolved yet.
+type CommentCount struct {
+	Comments int
+	Open     int
+}
+
+// threadRoot checks that the parent of a reply is on the same block and returns the first comment of its thread,
+// so replies to replies stay in one thread.
+func threadRoot(comment Comment, parent Comment) (int, error) {
+	if parent.ID == 0 || parent.StoryID != comment.StoryID || parent.BlockID != comment.BlockID {
+		return 0, ErrNoRecord
+	}
+	if parent.ParentID != 0 {
+		return parent.ParentID, nil
+	}
+	return parent.ID, nil
+}
+
+// AddCollaborator invites the user to review the story.
+func (dm *DialogueModel) AddCollaborator(ctx context.Context, storyID, userID int) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.AddCollaborator")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Collaborator{StoryID: storyID, UserID: userID}).Error
+}
+
+// RemoveCollaborator takes the user off the reviewers of the story.
+func (dm *DialogueModel) RemoveCollaborator(ctx context.Context, storyID, userID int) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.RemoveCollaborator")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Where("story_id = ? AND user_id = ?", storyID, userID).Delete(&Collaborator{}).Error
+}
+
+// Collaborators returns the IDs of the users reviewing the story, the earliest invited first.
+func (dm *DialogueModel) Collaborators(ctx context.Context, storyID int) ([]int, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Collaborators")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var ids []int
+	err := db.Model(&Collaborator{}).Where("story_id = ?", storyID).Order("created_at, user_id").Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// IsCollaborator reports whether the user reviews the story.
+func (dm *DialogueModel) IsCollaborator(ctx context.Context, storyID, userID int) (bool, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.IsCollaborator")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&Collaborator{}).Where("story_id = ? AND user_id = ?", storyID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// AddComment saves the comment and sets its ID. A reply joins the thread of its parent, which must be on the same
+// block, or ErrNoRecord is returned.
+func (dm *DialogueModel) AddComment(ctx context.Context, comment *Comment) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.AddComment")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	if comment.ParentID != 0 {
+		var parent Comment
+		if err := db.Where("id = ?", comment.ParentID).Find(&parent).Error; err != nil {
+			return err
+		}
+		root, err := threadRoot(*comment, parent)
+		if err != nil {
+			return err
+		}
+		comment.ParentID = root
+	}
+	if comment.Mentions == nil {
+		comment.Mentions = JSON("[]")
+	}
+	comment.Resolved = false
+	return db.Create(comment).Error
+}
+
+// GetComment gets the comment with ID.
+func (dm *DialogueModel) GetComment(ctx context.Context, id int) (*Comment, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.GetComment")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var comment Comment
+	err := db.Where("id = ?", id).First(&comment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// Comments returns the comments on the block of the story in the order they were written.
+func (dm *DialogueModel) Comments(ctx context.Context, storyID, blockID int) ([]Comment, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Comments")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var comments []Comment
+	err := db.Where("story_id = ? AND block_id = ?", storyID, blockID).Order("id").Find(&comments).Error
+	return comments, err
+}
+
+// SetResolved resolves the thread started by the comment with ID, or opens it again.
+func (dm *DialogueModel) SetResolved(ctx context.Context, id int, resolved bool) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.SetResolved")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Model(&Comment{}).Where("id = ? AND parent_id = 0", id).Update("resolved", resolved).Error
+}
+
+// CommentCounts counts the comments on every commented block of the story, by block ID.
+func (dm *DialogueModel) CommentCounts(ctx context.Context, storyID int) (map[int]CommentCount, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.CommentCounts")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var rows []struct {
+		BlockID  int
+		Comments int
+		Open     int
+	}
+	err := db.Model(&Comment{}).
+		Select("block_id, count(*) AS comments, sum(CASE WHEN parent_id = 0 AND resolved = false THEN 1 ELSE 0 END) AS open").
+		Where("story_id = ?", storyID).Group("block_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int]CommentCount, len(rows))
+	for _, row := range rows {
+		counts[row.BlockID] = CommentCount{Comments: row.Comments, Open: row.Open}
+	}
+	return counts, nil
+}
+
+// AddCollaborator invites the user to review the story.
+func (mm *MemoryDialogueModel) AddCollaborator(ctx context.Context, storyID, userID int) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	key := [2]int{storyID, userID}
+	if _, ok := mm.collaborators[key]; !ok {
+		mm.collaborators[key] = Collaborator{StoryID: storyID, UserID: userID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+// RemoveCollaborator takes the user off the reviewers of the story.
+func (mm *MemoryDialogueModel) RemoveCollaborator(ctx context.Context, storyID, userID int) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	delete(mm.collaborators, [2]int{storyID, userID})
+	return nil
+}
+
+// Collaborators returns the IDs of the users reviewing the story, the earliest invited first.
+func (mm *MemoryDialogueModel) Collaborators(ctx context.Context, storyID int) ([]int, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var collaborators []Collaborator
+	for _, collaborator := range mm.collaborators {
+		if collaborator.StoryID == storyID {
+			collaborators = append(collaborators, collaborator)
+		}
+	}
+	sort.Slice(collaborators, func(i, j int) bool {
+		if !collaborators[i].CreatedAt.Equal(collaborators[j].CreatedAt) {
+			return collaborators[i].CreatedAt.Before(collaborators[j].CreatedAt)
+		}
+		return collaborators[i].UserID < collaborators[j].UserID
+	})
+	var ids []int
+	for _, collaborator := range collaborators {
+		ids = append(ids, collaborator.UserID)
+	}
+	return ids, nil
+}
+
+// IsCollaborator reports whether the user reviews the story.
+func (mm *MemoryDialogueModel) IsCollaborator(ctx context.Context, storyID, userID int) (bool, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	_, ok := mm.collaborators[[2]int{storyID, userID}]
+	return ok, nil
+}
+
+// AddComment saves the comment and sets its ID. A reply joins the thread of its parent, which must be on the same
+// block, or ErrNoRecord is returned.
+func (mm *MemoryDialogueModel) AddComment(ctx context.Context, comment *Comment) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if comment.ParentID != 0 {
+		root, err := threadRoot(*comment, mm.comments[comment.ParentID])
+		if err != nil {
+			return err
+		}
+		comment.ParentID = root
+	}
+	if comment.Mentions == nil {
+		comment.Mentions = JSON("[]")
+	}
+	mm.lastCommentID++
+	now := time.Now()
+	comment.ID, comment.Resolved, comment.CreatedAt, comment.UpdatedAt = mm.lastCommentID, false, now, now
+	mm.comments[comment.ID] = *comment
+	return nil
+}
+
+// GetComment gets the comment with ID.
+func (mm *MemoryDialogueModel) GetComment(ctx context.Context, id int) (*Comment, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	comment, ok := mm.comments[id]
+	if !ok {
+		return nil, ErrNoRecord
+	}
+	return &comment, nil
+}
+
+// Comments returns the comments on the block of the story in the order they were written.
+func (mm *MemoryDialogueModel) Comments(ctx context.Context, storyID, blockID int) ([]Comment, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var comments []Comment
+	for _, comment := range mm.comments {
+		if comment.StoryID == storyID && comment.BlockID == blockID {
+			comments = append(comments, comment)
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].ID < comments[j].ID })
+	return comments, nil
+}
+
+// SetResolved resolves the thread started by the comment with ID, or opens it again.
+func (mm *MemoryDialogueModel) SetResolved(ctx context.Context, id int, resolved bool) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if comment, ok := mm.comments[id]; ok && comment.ParentID == 0 {
+		comment.Resolved = resolved
+		comment.UpdatedAt = time.Now()
+		mm.comments[id] = comment
+	}
+	return nil
+}
+
+// CommentCounts counts the comments on every commented block of the story, by block ID.
+func (mm *MemoryDialogueModel) CommentCounts(ctx context.Context, storyID int) (map[int]CommentCount, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	counts := make(map[int]CommentCount)
+	for _, comment := range mm.comments {
+		if comment.StoryID != storyID {
+			continue
+		}
+		count := counts[comment.BlockID]
+		count.Comments++
+		if comment.ParentID == 0 && !comment.Resolved {
+			count.Open++
+		}
+		counts[comment.BlockID] = count
+	}
+	return counts, nil
+}
+
+// deleteComments deletes the comments matching. It must be called with mu held.
+func (mm *MemoryDialogueModel) deleteComments(match func(Comment) bool) {
+	for id, comment := range mm.comments {
+		if match(comment) {
+			delete(mm.comments, id)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 	"strings"
@@ -14,9 +15,14 @@ type FirstBlock struct {
 	UserID     int
 	ID         int `gorm:"primary_key"`
 	Privacy    bool
+	Plays      int     `gorm:"default:0"`
+	Language   string  `gorm:"type:text;default:''"` //ISO 639-1 code, empty if unknown.
+	Genre      string  `gorm:"type:text;default:''"` //One of Genres, empty if none.
+	Rating     float64 `gorm:"default:0"`            //Average stars of the ratings, kept up to date by Rate.
+	Ratings    int     `gorm:"default:0"`            //Number of the ratings.
 
-	FirstBlockContent string          `gorm:"type:text"`
-	FirstBlockOptions json.RawMessage `gorm:"type:json;default:'{}'"`
+	FirstBlockContent string `gorm:"type:text"`
+	FirstBlockOptions JSON   `gorm:"default:'{}'"`
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -28,8 +34,8 @@ type Block struct {
 	StoryID int
 	ID      int `gorm:"primary_key"`
 
-	BlockContent string          `gorm:"type:text"`
-	BlockOptions json.RawMessage `gorm:"type:json;default:'{}'"`
+	BlockContent string `gorm:"type:text"`
+	BlockOptions JSON   `gorm:"default:'{}'"`
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -56,14 +62,20 @@ type DialogueModel struct {
 }
 
 // RetrieveBlocks gets all blocks, including the starting one, that are parts of a story with ID.
-func (dm *DialogueModel) RetrieveBlocks(id int) (retrievedBlocks RelatedToStoryBlocks) {
-	dm.DB.Model(&FirstBlock{}).Where("id = ?", id).First(&retrievedBlocks.FirstBlock)
-	dm.DB.Model(&Block{}).Where("story_id = ?", id).Order("id").Scan(&retrievedBlocks.OtherBlocks)
+func (dm *DialogueModel) RetrieveBlocks(ctx context.Context, id int) (retrievedBlocks RelatedToStoryBlocks) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.RetrieveBlocks")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	db.Model(&FirstBlock{}).Where("id = ?", id).First(&retrievedBlocks.FirstBlock)
+	db.Model(&Block{}).Where("story_id = ?", id).Order("id").Scan(&retrievedBlocks.OtherBlocks)
 	return retrievedBlocks
 }
 
 // CreateFB inserts starting block (FB - first block) into the database.
-func (dm *DialogueModel) CreateFB(userid int, firstBlockTitle, firstBlockContent string, firstBlockOptions []string, privacy bool) (id int) {
+func (dm *DialogueModel) CreateFB(ctx context.Context, userid int, firstBlockTitle, firstBlockContent string, firstBlockOptions []string, privacy bool) (id int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.CreateFB")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	var (
 		newFirstBlock FirstBlock       //Variable to store data related to new first block of a story.
 		blocksSlice   []Block          //Store new created blocks related to fresh story.
@@ -72,17 +84,17 @@ func (dm *DialogueModel) CreateFB(userid int, firstBlockTitle, firstBlockContent
 	)
 
 	//Create empty first block and blocks that are related to options of first block.
-	dm.DB.Create(&newFirstBlock)
+	db.Create(&newFirstBlock)
 	for range firstBlockOptions {
 		var block Block = Block{
 			StoryID: newFirstBlock.ID,
 			UserID:  userid,
 		}
-		dm.DB.Create(&block)
+		db.Create(&block)
 	}
 
 	//Get IDs of new created blocks, collect them, make option-block ID relationships and store it as json.
-	dm.DB.Model(&Block{}).Select("ID").Limit(len(firstBlockOptions)).Order("id desc").Scan(&blocksSlice)
+	db.Model(&Block{}).Select("ID").Limit(len(firstBlockOptions)).Order("id desc").Scan(&blocksSlice)
 	reverseSlice(blocksSlice)
 	for i, v := range blocksSlice {
 		mapIDtitle := make(map[int]string)
@@ -99,20 +111,23 @@ func (dm *DialogueModel) CreateFB(userid int, firstBlockTitle, firstBlockContent
 		FirstBlockContent: firstBlockContent,
 		FirstBlockOptions: jsonData,
 	}
-	dm.DB.Select("ID").Last(&firstBlockID)
-	dm.DB.Model(&FirstBlock{}).Where("id = ?", firstBlockID.ID).Updates(&newFirstBlock)
+	db.Select("ID").Last(&firstBlockID)
+	db.Model(&FirstBlock{}).Where("id = ?", firstBlockID.ID).Updates(&newFirstBlock)
 	return firstBlockID.ID
 }
 
 // CreatedFBView gets the nessessary data related to fresh created story and pass it to render the view.
-func (dm *DialogueModel) CreatedFBView(id int) (data DialoguesData) {
+func (dm *DialogueModel) CreatedFBView(ctx context.Context, id int) (data DialoguesData) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.CreatedFBView")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	var (
 		firstBlock FirstBlock       //Where data related to first block of fresh story be collected.
 		options    []map[int]string //Where unmarshalled options-id relationships stored.
 	)
 
 	//Get the fresh created story.
-	dm.DB.First(&firstBlock, id)
+	db.First(&firstBlock, id)
 
 	//Unmarshall option-ID from json.
 	json.Unmarshal(firstBlock.FirstBlockOptions, &options)
@@ -120,84 +135,128 @@ func (dm *DialogueModel) CreatedFBView(id int) (data DialoguesData) {
 	//Gather all new data and pass it to render the view.
 	data.FirstBlock = firstBlock
 	data.OptionsToBlocks = options
-	data.RelatedToStoryBlocks = dm.RetrieveBlocks(id)
+	data.RelatedToStoryBlocks = dm.RetrieveBlocks(ctx, id)
 	return data
 }
 
 // EditFB updates info about the first block user editing.
-func (dm *DialogueModel) EditFB(id, userID int, blockTitle, blockContent string, blockOptions []string) {
+func (dm *DialogueModel) EditFB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.EditFB")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 
 	//Get all existing information about the first block that is about to be edited.
 	var (
 		editingFB        FirstBlock
 		retrievedOptions []map[int]string
 	)
-	dm.DB.Model(&FirstBlock{}).Where("id = ?", id).Find(&editingFB)
+	db.Model(&FirstBlock{}).Where("id = ?", id).Find(&editingFB)
 	idProviding := editingFB.ID
 	json.Unmarshal(editingFB.FirstBlockOptions, &retrievedOptions)
 
 	//Gather all new options for the block and update info.
-	result := dm.recreateOptions(blockOptions, retrievedOptions, idProviding, userID)
+	result := dm.recreateOptions(ctx, blockOptions, retrievedOptions, idProviding, userID)
 	editingFB = FirstBlock{
 		StoryTitle:        blockTitle,
 		FirstBlockContent: blockContent,
 		FirstBlockOptions: result,
 	}
-	dm.DB.Model(&FirstBlock{}).Where("id = ?", id).Updates(&editingFB)
+	db.Model(&FirstBlock{}).Where("id = ?", id).Updates(&editingFB)
 }
 
 // DeleteFB deletes the whole story with ID.
-func (dm *DialogueModel) DeleteFB(id int) {
-	dm.DB.Unscoped().Where("id = ?", id).Delete(&FirstBlock{})
-	dm.DB.Unscoped().Where("story_id = ?", id).Delete(&Block{})
+func (dm *DialogueModel) DeleteFB(ctx context.Context, id int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.DeleteFB")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	db.Unscoped().Where("id = ?", id).Delete(&FirstBlock{})
+	db.Unscoped().Where("story_id = ?", id).Delete(&Block{})
+	db.Where("story_id = ?", id).Delete(&StoryTag{})
+	db.Where("story_id = ?", id).Delete(&Rating{})
+	db.Where("story_id = ?", id).Delete(&Favorite{})
+	db.Where("story_id = ?", id).Delete(&Comment{})
+	db.Where("story_id = ?", id).Delete(&Collaborator{})
+	db.Where("story_id = ?", id).Delete(&Reading{})
+	db.Where("story_id = ?", id).Delete(&Pick{})
 }
 
 // EditBView gets the data related to the block of the story and pass it to render.
-func (dm *DialogueModel) EditBView(id int) (data DialoguesData) {
+func (dm *DialogueModel) EditBView(ctx context.Context, id int) (data DialoguesData) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.EditBView")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 
 	//Get existing data about block that about to be edited.
-	dm.DB.First(&data.Block, id)
+	db.First(&data.Block, id)
 	var result []map[int]string
 	json.Unmarshal(data.Block.BlockOptions, &result)
 	data.OptionsToBlocks = result
-	data.RelatedToStoryBlocks = dm.RetrieveBlocks(data.Block.StoryID)
+	data.RelatedToStoryBlocks = dm.RetrieveBlocks(ctx, data.Block.StoryID)
 	return data
 }
 
 // EditB update info about the block user editing.
-func (dm *DialogueModel) EditB(id, userID int, blockTitle, blockContent string, blockOptions []string) {
+func (dm *DialogueModel) EditB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.EditB")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 
 	//Get all existing information about the block that is about to be edited.
 	var (
 		editingBlock     Block
 		retrievedOptions []map[int]string
 	)
-	dm.DB.Model(&Block{}).Where("id = ?", id).Find(&editingBlock)
+	db.Model(&Block{}).Where("id = ?", id).Find(&editingBlock)
 	idProviding := editingBlock.StoryID
 	json.Unmarshal(editingBlock.BlockOptions, &retrievedOptions)
 
 	//Gather all new options for the block and update info.
-	result := dm.recreateOptions(blockOptions, retrievedOptions, idProviding, userID)
+	result := dm.recreateOptions(ctx, blockOptions, retrievedOptions, idProviding, userID)
 	editingBlock = Block{
 		BlockContent: blockContent,
 		BlockOptions: result,
 	}
-	dm.DB.Model(&Block{}).Where("id = ?", id).Updates(&editingBlock)
+	db.Model(&Block{}).Where("id = ?", id).Updates(&editingBlock)
 }
 
 // DeleteB deletes block and it's appearances in other blocks with provided ID.
-func (dm *DialogueModel) DeleteB(id int) {
+func (dm *DialogueModel) DeleteB(ctx context.Context, id int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.DeleteB")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	var block Block
-	dm.DB.Where("id = ?", id).First(&block)
-	dm.deleteBlock(id, block.StoryID)
+	db.Where("id = ?", id).First(&block)
+	dm.deleteBlock(ctx, id, block.StoryID)
 }
 
-// Latest gathers 10 latest stories that user is able to see and displays it at the home page.
-func (dm *DialogueModel) Latest(userID int) (storiesToDisplay []FirstBlock) {
-	dm.DB.Model(&FirstBlock{}).Where("(privacy = false) OR (privacy = true AND user_id = ?)", userID).Limit(10).Order("id desc").Find(&storiesToDisplay)
+// Latest gathers 10 latest stories that user is able to see and displays it at the home page. Stories carrying
+// the hidden warnings are left out.
+func (dm *DialogueModel) Latest(ctx context.Context, userID int, hidden []string) (storiesToDisplay []FirstBlock) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Latest")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	tx := db.Model(&FirstBlock{}).Where("((privacy = false) OR (privacy = true AND user_id = ?))", userID)
+	hideWarnings(tx, userID, hidden).Limit(10).Order("id desc").Find(&storiesToDisplay)
 	return storiesToDisplay
 }
 
+// CountPlay counts one more reader who started the story with ID.
+func (dm *DialogueModel) CountPlay(ctx context.Context, id int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.CountPlay")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	db.Model(&FirstBlock{}).Where("id = ?", id).UpdateColumn("plays", gorm.Expr("plays + 1"))
+}
+
+// MostPlayed returns the number of plays of the most popular public story written by the user.
+func (dm *DialogueModel) MostPlayed(ctx context.Context, userID int) (plays int, err error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.MostPlayed")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	err = db.Model(&FirstBlock{}).Select("coalesce(max(plays), 0)").Where("user_id = ? AND privacy = false", userID).Scan(&plays).Error
+	return plays, err
+}
+
 // reverseSlice to reverse slice of blocks.
 func reverseSlice(slice []Block) {
 	n := len(slice)
@@ -207,7 +266,10 @@ func reverseSlice(slice []Block) {
 }
 
 // recreateOptions recreating options of the starting (first) block or other blocks of the story.
-func (dm *DialogueModel) recreateOptions(blockOptions []string, retrievedOptions []map[int]string, id, userID int) []byte {
+func (dm *DialogueModel) recreateOptions(ctx context.Context, blockOptions []string, retrievedOptions []map[int]string, id, userID int) []byte {
+	ctx, span := tracer.Start(ctx, "DialogueModel.recreateOptions")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	for _, v := range blockOptions {
 		command, newOption, _ := strings.Cut(v, " ")
 		switch command {
@@ -218,7 +280,7 @@ func (dm *DialogueModel) recreateOptions(blockOptions []string, retrievedOptions
 				StoryID: id,
 				UserID:  userID,
 			}
-			dm.DB.Create(&block)
+			db.Create(&block)
 			newOpt := make(map[int]string)
 			newOpt[block.ID] = newOption
 			retrievedOptions = append(retrievedOptions, newOpt)
@@ -249,11 +311,11 @@ func (dm *DialogueModel) recreateOptions(blockOptions []string, retrievedOptions
 			idString, _, _ := strings.Cut(newOption, " ")
 			id, _ := strconv.Atoi(idString)
 			var storyID Block
-			err := dm.DB.Where("id = ?", id).Find(&storyID).Error
+			err := db.Where("id = ?", id).Find(&storyID).Error
 			if err != nil {
 				continue
 			}
-			dm.deleteBlock(id, storyID.StoryID)
+			dm.deleteBlock(ctx, id, storyID.StoryID)
 			retrievedOptions = remove(retrievedOptions, id)
 		default:
 			continue
@@ -264,9 +326,12 @@ func (dm *DialogueModel) recreateOptions(blockOptions []string, retrievedOptions
 }
 
 // deleteBlock deletes block with ID and all blocks related to it if they no longer have connections to other blocks.
-func (dm *DialogueModel) deleteBlock(targetID, storyID int) {
+func (dm *DialogueModel) deleteBlock(ctx context.Context, targetID, storyID int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.deleteBlock")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	var allBlocks []Block
-	dm.DB.Where("story_id = ?", storyID).Find(&allBlocks)
+	db.Where("story_id = ?", storyID).Find(&allBlocks)
 	parentCount := make(map[int]int)
 	for _, block := range allBlocks {
 		var unmarshaledOpts []map[int]string
@@ -283,10 +348,11 @@ func (dm *DialogueModel) deleteBlock(targetID, storyID int) {
 	var cascadeDelete func(int)
 	cascadeDelete = func(blockID int) {
 		var block Block
-		if err := dm.DB.First(&block, blockID).Error; err != nil {
+		if err := db.First(&block, blockID).Error; err != nil {
 			return
 		}
-		dm.DB.Unscoped().Delete(&block)
+		db.Unscoped().Delete(&block)
+		db.Where("story_id = ? AND block_id = ?", storyID, blockID).Delete(&Comment{})
 		var unmarshaledOpts2 []map[int]string
 		json.Unmarshal(block.BlockOptions, &unmarshaledOpts2)
 		for _, childID := range unmarshaledOpts2 {
@@ -302,7 +368,7 @@ func (dm *DialogueModel) deleteBlock(targetID, storyID int) {
 		}
 	}
 	cascadeDelete(targetID)
-	dm.clearOptions(targetID, storyID)
+	dm.clearOptions(ctx, targetID, storyID)
 }
 
 // remove removes one block from a map.
@@ -321,9 +387,12 @@ Loop:
 }
 
 // clearOptions searches for the block that was deleted to appear in other blocks' options and delete them.
-func (dm *DialogueModel) clearOptions(id, storyID int) {
+func (dm *DialogueModel) clearOptions(ctx context.Context, id, storyID int) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.clearOptions")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
 	var relatedBlocks []Block
-	dm.DB.Model(&Block{}).Where("story_id = ?", storyID).Find(&relatedBlocks)
+	db.Model(&Block{}).Where("story_id = ?", storyID).Find(&relatedBlocks)
 	for _, b := range relatedBlocks {
 		var unmarshaledOpts []map[int]string
 		json.Unmarshal(b.BlockOptions, &unmarshaledOpts)
@@ -335,6 +404,7 @@ func (dm *DialogueModel) clearOptions(id, storyID int) {
 				}
 			}
 		}
-		dm.DB.Model(&Block{}).Where("id = ?", b.ID).Update("block_options", &newOpts)
+		jsonData, _ := json.Marshal(newOpts)
+		db.Model(&Block{}).Where("id = ?", b.ID).Update("block_options", JSON(jsonData))
 	}
 }
@@ -2,10 +2,42 @@ package models
 
 import (
 	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 var (
 	ErrNoRecord           = errors.New("models: no matching record found")
 	ErrInvalidCredentials = errors.New("models: invalid credentials")
 	ErrDuplicateEmail     = errors.New("models: duplicate email")
+	ErrInvalidToken       = errors.New("models: invalid or expired token")
+	ErrUnverifiedEmail    = errors.New("models: email is not verified")
 )
+
+// violatesUnique reports whether err is a violation of the unique index. PostgreSQL names the index, SQLite names
+// the indexed column as table.column unless the index is on an expression.
+func violatesUnique(err error, index, column string) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505" && pgErr.ConstraintName == index
+	}
+	_, failed, ok := strings.Cut(err.Error(), "UNIQUE constraint failed: ")
+	if !ok {
+		return false
+	}
+	failed, _, _ = strings.Cut(failed, " (")
+	return failed == "index '"+index+"'" || column != "" && failed == column
+}
+
+// userCreateError maps the unique violations of creating a user to ErrDuplicateNickname and ErrDuplicateEmail, other
+// errors are returned unchanged.
+func userCreateError(err error) error {
+	switch {
+	case violatesUnique(err, "idx_users_nick_name", ""):
+		return ErrDuplicateNickname
+	case violatesUnique(err, "idx_users_email", "users.email"):
+		return ErrDuplicateEmail
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"context"
+	"sort"
+)
+
+// MaxSitemapStories is the most stories a sitemap lists, search engines read up to 50,000 addresses per sitemap.
+const MaxSitemapStories = 50000
+
+// SitemapStories returns the public stories which aren't deleted, the newest first, with their IDs and update times
+// only.
+func (dm *DialogueModel) SitemapStories(ctx context.Context, limit int) ([]FirstBlock, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.SitemapStories")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var stories []FirstBlock
+	err := db.Select("id, updated_at").Where("privacy = false AND deleted_at IS NULL").Order("id DESC").Limit(limit).Find(&stories).Error
+	return stories, err
+}
+
+// SitemapStories returns the public stories which aren't deleted, the newest first, with their IDs and update times
+// only.
+func (mm *MemoryDialogueModel) SitemapStories(ctx context.Context, limit int) ([]FirstBlock, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var stories []FirstBlock
+	for _, fb := range mm.firstBlocks {
+		if !fb.Privacy && fb.DeletedAt == nil {
+			stories = append(stories, FirstBlock{ID: fb.ID, UpdatedAt: fb.UpdatedAt})
+		}
+	}
+	sort.Slice(stories, func(i, j int) bool { return stories[i].ID > stories[j].ID })
+	if len(stories) > limit {
+		stories = stories[:limit]
+	}
+	return stories, nil
+}
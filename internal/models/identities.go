@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Identity links a user to an account at an external OpenID Connect provider.
+type Identity struct {
+	ID       int    `gorm:"primary_key"`
+	UserID   int    `gorm:"index"`
+	Provider string `gorm:"type:text;uniqueIndex:idx_identity_subject"`
+	Subject  string `gorm:"type:text;uniqueIndex:idx_identity_subject"`
+	Email    string `gorm:"type:text"`
+
+	CreatedAt time.Time
+}
+
+// GetByIdentity gets the user linked to the subject at the provider.
+func (um *UserModel) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.GetByIdentity")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var identity Identity
+	err := db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return um.GetUser(ctx, identity.UserID)
+}
+
+// LinkIdentity links the user to the subject at the provider.
+func (um *UserModel) LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.LinkIdentity")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	identity := Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+	}
+	return db.Create(&identity).Error
+}
+
+// InsertExternal creates a user signing up through a provider which verified the email. The account gets a random
+// password nobody knows, it can be set later with the password reset, and a free nickname made of the name.
+func (um *UserModel) InsertExternal(ctx context.Context, name, email string) (int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.InsertExternal")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword(password, um.bcryptCost())
+	if err != nil {
+		return 0, err
+	}
+	name, err = freeNickname(name, func(nickname string) (bool, error) { return nicknameTaken(db, nickname) })
+	if err != nil {
+		return 0, err
+	}
+	user := User{
+		NickName:       name,
+		Email:          email,
+		HashedPassword: hashedPassword,
+		EmailVerified:  true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return 0, userCreateError(err)
+	}
+	return user.ID, nil
+}
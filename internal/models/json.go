@@ -0,0 +1,42 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// JSON is a JSON document stored in a column of the type the database has for it: json in PostgreSQL, text
+// elsewhere. It is written as text, which every driver accepts.
+type JSON []byte
+
+// GormDBDataType picks the column type for the dialect.
+func (JSON) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "postgres" {
+		return "json"
+	}
+	return "text"
+}
+
+func (j JSON) Value() (driver.Value, error) {
+	if j == nil {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+func (j *JSON) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append(JSON(nil), v...)
+	case string:
+		*j = JSON(v)
+	default:
+		return fmt.Errorf("models: can't scan %T into JSON", src)
+	}
+	return nil
+}
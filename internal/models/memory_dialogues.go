@@ -0,0 +1,357 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDialogueModel keeps stories in memory and behaves like DialogueModel, it is meant for tests.
+type MemoryDialogueModel struct {
+	mu            sync.Mutex
+	firstBlocks   map[int]FirstBlock
+	blocks        map[int]Block
+	tags          map[int][]StoryTag
+	ratings       map[[2]int]Rating   //By story and user ID.
+	favorites     map[[2]int]Favorite //By story and user ID.
+	comments      map[int]Comment
+	collaborators map[[2]int]Collaborator //By story and user ID.
+	readings      map[string]Reading
+	picks         []Pick
+	lastCommentID int
+	lastPickID    int
+	lastFBID      int
+	lastBlockID   int
+}
+
+// init creates the maps on first use, so the zero value is ready to use. It must be called with mu held.
+func (mm *MemoryDialogueModel) init() {
+	if mm.firstBlocks == nil {
+		mm.firstBlocks = make(map[int]FirstBlock)
+		mm.blocks = make(map[int]Block)
+		mm.tags = make(map[int][]StoryTag)
+		mm.ratings = make(map[[2]int]Rating)
+		mm.favorites = make(map[[2]int]Favorite)
+		mm.comments = make(map[int]Comment)
+		mm.collaborators = make(map[[2]int]Collaborator)
+		mm.readings = make(map[string]Reading)
+	}
+}
+
+// RetrieveBlocks gets all blocks, including the starting one, that are parts of a story with ID.
+func (mm *MemoryDialogueModel) RetrieveBlocks(ctx context.Context, id int) RelatedToStoryBlocks {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	return mm.retrieveBlocks(id)
+}
+
+func (mm *MemoryDialogueModel) retrieveBlocks(id int) (retrievedBlocks RelatedToStoryBlocks) {
+	retrievedBlocks.FirstBlock = mm.firstBlocks[id]
+	retrievedBlocks.OtherBlocks = mm.storyBlocks(id)
+	return retrievedBlocks
+}
+
+// storyBlocks returns blocks of the story ordered by ID.
+func (mm *MemoryDialogueModel) storyBlocks(storyID int) []Block {
+	var blocks []Block
+	for _, block := range mm.blocks {
+		if block.StoryID == storyID {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].ID < blocks[j].ID })
+	return blocks
+}
+
+// createBlock adds an empty block to the story, like a new row gets the column defaults.
+func (mm *MemoryDialogueModel) createBlock(storyID, userID int) Block {
+	mm.lastBlockID++
+	now := time.Now()
+	block := Block{
+		ID:           mm.lastBlockID,
+		StoryID:      storyID,
+		UserID:       userID,
+		BlockOptions: JSON("{}"),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	mm.blocks[block.ID] = block
+	return block
+}
+
+// CreateFB inserts starting block (FB - first block) of a new story.
+func (mm *MemoryDialogueModel) CreateFB(ctx context.Context, userid int, firstBlockTitle, firstBlockContent string, firstBlockOptions []string, privacy bool) int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+
+	mm.lastFBID++
+	now := time.Now()
+	firstBlock := FirstBlock{
+		ID:                mm.lastFBID,
+		StoryTitle:        firstBlockTitle,
+		UserID:            userid,
+		Privacy:           privacy,
+		FirstBlockContent: firstBlockContent,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	var options []map[int]string
+	for _, option := range firstBlockOptions {
+		block := mm.createBlock(firstBlock.ID, userid)
+		options = append(options, map[int]string{block.ID: option})
+	}
+	firstBlock.FirstBlockOptions, _ = json.Marshal(options)
+	mm.firstBlocks[firstBlock.ID] = firstBlock
+	return firstBlock.ID
+}
+
+// CreatedFBView gets the data of the story needed to render it.
+func (mm *MemoryDialogueModel) CreatedFBView(ctx context.Context, id int) (data DialoguesData) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	data.FirstBlock = mm.firstBlocks[id]
+	json.Unmarshal(data.FirstBlock.FirstBlockOptions, &data.OptionsToBlocks)
+	data.RelatedToStoryBlocks = mm.retrieveBlocks(id)
+	return data
+}
+
+// EditFB updates the first block of the story. Blank title and content are left as they are, as a database
+// update skips zero values.
+func (mm *MemoryDialogueModel) EditFB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+
+	editingFB, ok := mm.firstBlocks[id]
+	var retrievedOptions []map[int]string
+	json.Unmarshal(editingFB.FirstBlockOptions, &retrievedOptions)
+	result := mm.recreateOptions(blockOptions, retrievedOptions, editingFB.ID, userID)
+	if !ok {
+		return
+	}
+
+	if blockTitle != "" {
+		editingFB.StoryTitle = blockTitle
+	}
+	if blockContent != "" {
+		editingFB.FirstBlockContent = blockContent
+	}
+	editingFB.FirstBlockOptions = result
+	editingFB.UpdatedAt = time.Now()
+	mm.firstBlocks[id] = editingFB
+}
+
+// DeleteFB deletes the whole story with ID.
+func (mm *MemoryDialogueModel) DeleteFB(ctx context.Context, id int) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	delete(mm.firstBlocks, id)
+	delete(mm.tags, id)
+	for _, block := range mm.storyBlocks(id) {
+		delete(mm.blocks, block.ID)
+	}
+	for key := range mm.ratings {
+		if key[0] == id {
+			delete(mm.ratings, key)
+		}
+	}
+	for key := range mm.favorites {
+		if key[0] == id {
+			delete(mm.favorites, key)
+		}
+	}
+	for key := range mm.collaborators {
+		if key[0] == id {
+			delete(mm.collaborators, key)
+		}
+	}
+	mm.deleteComments(func(comment Comment) bool { return comment.StoryID == id })
+	mm.deleteReadings(id)
+}
+
+// EditBView gets the data of the block and its story needed to render the block.
+func (mm *MemoryDialogueModel) EditBView(ctx context.Context, id int) (data DialoguesData) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	data.Block = mm.blocks[id]
+	json.Unmarshal(data.Block.BlockOptions, &data.OptionsToBlocks)
+	data.RelatedToStoryBlocks = mm.retrieveBlocks(data.Block.StoryID)
+	return data
+}
+
+// EditB updates the block, the title is ignored since only first blocks have one. Blank content is left as it is.
+func (mm *MemoryDialogueModel) EditB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+
+	editingBlock, ok := mm.blocks[id]
+	var retrievedOptions []map[int]string
+	json.Unmarshal(editingBlock.BlockOptions, &retrievedOptions)
+	result := mm.recreateOptions(blockOptions, retrievedOptions, editingBlock.StoryID, userID)
+	if !ok {
+		return
+	}
+
+	//Commands may have changed the block meanwhile, or deleted it.
+	editingBlock, ok = mm.blocks[id]
+	if !ok {
+		return
+	}
+	if blockContent != "" {
+		editingBlock.BlockContent = blockContent
+	}
+	editingBlock.BlockOptions = result
+	editingBlock.UpdatedAt = time.Now()
+	mm.blocks[id] = editingBlock
+}
+
+// DeleteB deletes block and it's appearances in other blocks with provided ID.
+func (mm *MemoryDialogueModel) DeleteB(ctx context.Context, id int) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	mm.deleteBlock(id, mm.blocks[id].StoryID)
+}
+
+// Latest gathers 10 latest stories that user is able to see.
+func (mm *MemoryDialogueModel) Latest(ctx context.Context, userID int, hidden []string) []FirstBlock {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var stories []FirstBlock
+	for _, story := range mm.firstBlocks {
+		if (!story.Privacy || story.UserID == userID) && !mm.hidden(story, userID, hidden) {
+			stories = append(stories, story)
+		}
+	}
+	sort.Slice(stories, func(i, j int) bool { return stories[i].ID > stories[j].ID })
+	if len(stories) > 10 {
+		stories = stories[:10]
+	}
+	return stories
+}
+
+// CountPlay counts one more reader who started the story with ID.
+func (mm *MemoryDialogueModel) CountPlay(ctx context.Context, id int) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	if story, ok := mm.firstBlocks[id]; ok {
+		story.Plays++
+		mm.firstBlocks[id] = story
+	}
+}
+
+// MostPlayed returns the number of plays of the most popular public story written by the user.
+func (mm *MemoryDialogueModel) MostPlayed(ctx context.Context, userID int) (int, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	plays := 0
+	for _, story := range mm.firstBlocks {
+		if story.UserID == userID && !story.Privacy {
+			plays = max(plays, story.Plays)
+		}
+	}
+	return plays, nil
+}
+
+// recreateOptions applies the option commands to the options of a block, see DialogueModel.recreateOptions.
+func (mm *MemoryDialogueModel) recreateOptions(blockOptions []string, retrievedOptions []map[int]string, id, userID int) []byte {
+	for _, v := range blockOptions {
+		command, newOption, _ := strings.Cut(v, " ")
+		switch command {
+		case "add":
+			block := mm.createBlock(id, userID)
+			retrievedOptions = append(retrievedOptions, map[int]string{block.ID: newOption})
+		case "addTo":
+			idString, text, _ := strings.Cut(newOption, " ")
+			id, _ := strconv.Atoi(idString)
+			retrievedOptions = append(retrievedOptions, map[int]string{id: text})
+		case "change":
+			idString, newOption, _ := strings.Cut(newOption, " ")
+			id, _ := strconv.Atoi(idString)
+			for _, k := range retrievedOptions {
+				if _, ok := k[id]; ok {
+					k[id] = newOption
+					break
+				}
+			}
+		case "delete":
+			idString, _, _ := strings.Cut(newOption, " ")
+			id, _ := strconv.Atoi(idString)
+			mm.deleteBlock(id, mm.blocks[id].StoryID)
+			retrievedOptions = remove(retrievedOptions, id)
+		}
+	}
+	jsonData, _ := json.Marshal(retrievedOptions)
+	return jsonData
+}
+
+// deleteBlock deletes block with ID and all blocks related to it if they no longer have connections to other blocks.
+func (mm *MemoryDialogueModel) deleteBlock(targetID, storyID int) {
+	parentCount := make(map[int]int)
+	for _, block := range mm.storyBlocks(storyID) {
+		for _, id := range optionTargets(block.BlockOptions) {
+			parentCount[id]++
+		}
+	}
+	var cascadeDelete func(int)
+	cascadeDelete = func(blockID int) {
+		block, ok := mm.blocks[blockID]
+		if !ok {
+			return
+		}
+		delete(mm.blocks, blockID)
+		mm.deleteComments(func(comment Comment) bool { return comment.StoryID == storyID && comment.BlockID == blockID })
+		for _, id := range optionTargets(block.BlockOptions) {
+			parentCount[id]--
+			if parentCount[id] == 0 {
+				cascadeDelete(id)
+			}
+		}
+	}
+	cascadeDelete(targetID)
+	mm.clearOptions(targetID, storyID)
+}
+
+// optionTargets returns IDs of the blocks the options lead to, in order.
+func optionTargets(options JSON) []int {
+	var unmarshaledOpts []map[int]string
+	json.Unmarshal(options, &unmarshaledOpts)
+	var ids []int
+	for _, v := range unmarshaledOpts {
+		for key := range v {
+			ids = append(ids, key)
+			break
+		}
+	}
+	return ids
+}
+
+// clearOptions removes options leading to the deleted block from other blocks of the story.
+func (mm *MemoryDialogueModel) clearOptions(id, storyID int) {
+	for _, b := range mm.storyBlocks(storyID) {
+		var unmarshaledOpts []map[int]string
+		json.Unmarshal(b.BlockOptions, &unmarshaledOpts)
+		newOpts := unmarshaledOpts
+		for _, target := range optionTargets(b.BlockOptions) {
+			if target == id {
+				newOpts = remove(newOpts, id)
+			}
+		}
+		b.BlockOptions, _ = json.Marshal(newOpts)
+		b.UpdatedAt = time.Now()
+		mm.blocks[b.ID] = b
+	}
+}
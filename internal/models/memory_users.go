@@ -0,0 +1,289 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryUserModel keeps users in memory and behaves like UserModel, it is meant for tests.
+type MemoryUserModel struct {
+	// RequireVerified makes Authenticate refuse accounts whose email address has not been verified yet.
+	RequireVerified bool
+
+	// BcryptCost is the cost of new password hashes, bcrypt.DefaultCost if zero. Tests set bcrypt.MinCost.
+	BcryptCost int
+
+	mu         sync.Mutex
+	users      map[int]User
+	identities map[[2]string]Identity
+	lastID     int
+
+	follows            map[[2]int]Follow //By follower and author ID.
+	notifications      map[int]Notification
+	lastNotificationID int
+}
+
+// init creates the maps on first use, so the zero value is ready to use. It must be called with mu held.
+func (um *MemoryUserModel) init() {
+	if um.users == nil {
+		um.users = make(map[int]User)
+		um.identities = make(map[[2]string]Identity)
+		um.follows = make(map[[2]int]Follow)
+		um.notifications = make(map[int]Notification)
+	}
+}
+
+func (um *MemoryUserModel) bcryptCost() int {
+	if um.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return um.BcryptCost
+}
+
+// insert adds the user, emails and nicknames are unique like in the database. External users get a free nickname
+// made of their name instead of an error.
+func (um *MemoryUserModel) insert(user User, external bool) (int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	if external {
+		user.NickName, _ = freeNickname(user.NickName, um.nicknameTaken)
+	} else if err := checkNickname(user.NickName, um.nicknameTaken); err != nil {
+		return 0, err
+	}
+	for _, u := range um.users {
+		if u.Email == user.Email {
+			return 0, ErrDuplicateEmail
+		}
+	}
+	um.lastID++
+	now := time.Now()
+	user.ID = um.lastID
+	user.RecoveryCodes = JSON("[]")
+	user.HiddenWarnings = JSON("[]")
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	um.users[user.ID] = user
+	return user.ID, nil
+}
+
+// update changes the user with ID, if it exists.
+func (um *MemoryUserModel) update(id int, change func(user *User)) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	if user, ok := um.users[id]; ok {
+		change(&user)
+		user.UpdatedAt = time.Now()
+		um.users[id] = user
+	}
+}
+
+// Insert adds a new user and returns ID of the user.
+func (um *MemoryUserModel) Insert(ctx context.Context, name, email, password string) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), um.bcryptCost())
+	if err != nil {
+		return 0, err
+	}
+	return um.insert(User{NickName: name, Email: email, HashedPassword: hashedPassword}, false)
+}
+
+// InsertExternal creates a user signing up through a provider which verified the email, with a random password.
+func (um *MemoryUserModel) InsertExternal(ctx context.Context, name, email string) (int, error) {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword(password, um.bcryptCost())
+	if err != nil {
+		return 0, err
+	}
+	return um.insert(User{NickName: name, Email: email, HashedPassword: hashedPassword, EmailVerified: true}, true)
+}
+
+// Authenticate authenticates a user with given data.
+func (um *MemoryUserModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+	user, err := um.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrNoRecord) {
+			return 0, ErrInvalidCredentials
+		}
+		return 0, err
+	}
+	err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return 0, ErrInvalidCredentials
+		}
+		return 0, err
+	}
+	if um.RequireVerified && !user.EmailVerified {
+		return 0, ErrUnverifiedEmail
+	}
+	return user.ID, nil
+}
+
+// Exists checks if user with provided ID exists.
+func (um *MemoryUserModel) Exists(ctx context.Context, id int) (bool, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	_, ok := um.users[id]
+	return ok, nil
+}
+
+// GetUser gets user with provided ID if exists.
+func (um *MemoryUserModel) GetUser(ctx context.Context, id int) (*User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	user, ok := um.users[id]
+	if !ok {
+		return nil, ErrNoRecord
+	}
+	return &user, nil
+}
+
+// GetByEmail gets user with provided email if exists.
+func (um *MemoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for _, user := range um.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrNoRecord
+}
+
+// GetByIdentity gets the user linked to the subject at the provider.
+func (um *MemoryUserModel) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	um.mu.Lock()
+	identity, ok := um.identities[[2]string{provider, subject}]
+	um.mu.Unlock()
+	if !ok {
+		return nil, ErrNoRecord
+	}
+	return um.GetUser(ctx, identity.UserID)
+}
+
+// LinkIdentity links the user to the subject at the provider.
+func (um *MemoryUserModel) LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	key := [2]string{provider, subject}
+	if _, ok := um.identities[key]; ok {
+		return errors.New("models: identity is already linked")
+	}
+	um.identities[key] = Identity{
+		ID:        len(um.identities) + 1,
+		UserID:    userID,
+		Provider:  provider,
+		Subject:   subject,
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+	return nil
+}
+
+// PasswordUpdate updates user's password.
+func (um *MemoryUserModel) PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error {
+	um.mu.Lock()
+	currentHashedPassword := um.users[id].HashedPassword
+	um.mu.Unlock()
+	err := bcrypt.CompareHashAndPassword(currentHashedPassword, []byte(currentPassword))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	return um.PasswordReset(ctx, id, newPassword)
+}
+
+// PasswordReset sets a new password without checking the current one.
+func (um *MemoryUserModel) PasswordReset(ctx context.Context, id int, newPassword string) error {
+	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), um.bcryptCost())
+	if err != nil {
+		return err
+	}
+	um.update(id, func(user *User) { user.HashedPassword = newHashedPassword })
+	return nil
+}
+
+// MarkVerified marks email address of the user as verified.
+func (um *MemoryUserModel) MarkVerified(ctx context.Context, id int) error {
+	um.update(id, func(user *User) { user.EmailVerified = true })
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication for the user with the secret and plain text recovery codes.
+func (um *MemoryUserModel) EnableTOTP(ctx context.Context, id int, secret string, recoveryCodes []string) error {
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	jsonData, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	um.update(id, func(user *User) {
+		user.TOTPEnabled = true
+		user.TOTPSecret = secret
+		user.RecoveryCodes = jsonData
+	})
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication for the user and forgets the secret and recovery codes.
+func (um *MemoryUserModel) DisableTOTP(ctx context.Context, id int) error {
+	um.update(id, func(user *User) {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.RecoveryCodes = JSON("[]")
+	})
+	return nil
+}
+
+// SetHiddenWarnings replaces the content warnings of stories the user doesn't want to see.
+func (um *MemoryUserModel) SetHiddenWarnings(ctx context.Context, id int, warnings []string) error {
+	jsonData, err := json.Marshal(append([]string{}, warnings...))
+	if err != nil {
+		return err
+	}
+	um.update(id, func(user *User) { user.HiddenWarnings = jsonData })
+	return nil
+}
+
+// UseRecoveryCode checks the code against the user's recovery codes and removes it if it matches.
+func (um *MemoryUserModel) UseRecoveryCode(ctx context.Context, id int, code string) (bool, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	user, ok := um.users[id]
+	if !ok {
+		return false, ErrNoRecord
+	}
+	var hashes []string
+	json.Unmarshal(user.RecoveryCodes, &hashes)
+	hash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			jsonData, err := json.Marshal(hashes)
+			if err != nil {
+				return false, err
+			}
+			user.RecoveryCodes = jsonData
+			user.UpdatedAt = time.Now()
+			um.users[id] = user
+			return true, nil
+		}
+	}
+	return false, nil
+}
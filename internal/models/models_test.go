@@ -0,0 +1,890 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/glebarez/sqlite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// embeddedPostgres is started by the first test needing it and stopped by TestMain.
+var embeddedPostgres struct {
+	once sync.Once
+	db   *gorm.DB
+	err  error
+	stop func()
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if embeddedPostgres.stop != nil {
+		embeddedPostgres.stop()
+	}
+	os.Exit(code)
+}
+
+// openPostgres connects to the server in DIALOGUE_TEST_POSTGRES if it is set, otherwise it starts a throwaway
+// PostgreSQL server, its binaries are downloaded on the first run.
+func openPostgres() (*gorm.DB, error) {
+	embeddedPostgres.once.Do(func() {
+		if dsn := os.Getenv("DIALOGUE_TEST_POSTGRES"); dsn != "" {
+			embeddedPostgres.db, embeddedPostgres.err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+			return
+		}
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			embeddedPostgres.err = err
+			return
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		dir, err := os.MkdirTemp("", "dialogue-postgres")
+		if err != nil {
+			embeddedPostgres.err = err
+			return
+		}
+		server := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(uint32(port)).
+			Database("dialogue").
+			RuntimePath(dir).
+			Logger(nil))
+		if err := server.Start(); err != nil {
+			os.RemoveAll(dir)
+			embeddedPostgres.err = err
+			return
+		}
+		embeddedPostgres.stop = func() {
+			server.Stop()
+			os.RemoveAll(dir)
+		}
+		dsn := fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=dialogue sslmode=disable", port)
+		embeddedPostgres.db, embeddedPostgres.err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	})
+	return embeddedPostgres.db, embeddedPostgres.err
+}
+
+// repositories are the models a test works with, all of them empty.
+type repositories struct {
+	stories StoryRepository
+	users   UserRepository
+}
+
+// forEachBackend runs the test against the in-memory models and the database models on SQLite and PostgreSQL.
+// PostgreSQL is skipped in short mode or with DIALOGUE_SKIP_POSTGRES set, e.g. as root where the embedded server
+// can't run; otherwise failing to start it fails the test, so PostgreSQL-only SQL is never silently left out.
+func forEachBackend(t *testing.T, test func(t *testing.T, r repositories)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, repositories{
+			stories: &MemoryDialogueModel{},
+			users:   &MemoryUserModel{RequireVerified: true, BcryptCost: bcrypt.MinCost},
+		})
+	})
+
+	databases := []struct {
+		name string
+		open func(t *testing.T) *gorm.DB
+	}{
+		{"sqlite", func(t *testing.T) *gorm.DB {
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if sqlDB, err := db.DB(); err == nil {
+					sqlDB.Close()
+				}
+			})
+			return db
+		}},
+		{"postgres", func(t *testing.T) *gorm.DB {
+			if testing.Short() {
+				t.Skip("PostgreSQL is skipped in short mode")
+			}
+			if os.Getenv("DIALOGUE_SKIP_POSTGRES") != "" {
+				t.Skip("PostgreSQL is skipped with DIALOGUE_SKIP_POSTGRES")
+			}
+			db, err := openPostgres()
+			if err != nil {
+				t.Fatalf("PostgreSQL is not available, set DIALOGUE_SKIP_POSTGRES to skip it: %v", err)
+			}
+			//The server is shared by all tests, every test starts with empty tables.
+			if err := db.Migrator().DropTable(&FirstBlock{}, &Block{}, &User{}, &AuditEntry{}, &Token{}, &Identity{}, &StoryTag{},
+				&Rating{}, &Favorite{}, &Collaborator{}, &Comment{}, &Follow{}, &Notification{}, &Reading{}, &Pick{}); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}},
+	}
+	for _, database := range databases {
+		t.Run(database.name, func(t *testing.T) {
+			db := database.open(t)
+			if err := Migrate(db); err != nil {
+				t.Fatal(err)
+			}
+			test(t, repositories{
+				stories: &DialogueModel{DB: db},
+				users:   &UserModel{DB: db, RequireVerified: true, BcryptCost: bcrypt.MinCost},
+			})
+		})
+	}
+}
+
+// options returns the option texts of the story or block by the IDs of the blocks they lead to.
+func options(data DialoguesData) map[int]string {
+	result := make(map[int]string)
+	for _, option := range data.OptionsToBlocks {
+		for id, text := range option {
+			result[id] = text
+		}
+	}
+	return result
+}
+
+// blockIDs returns the IDs of all blocks of the story except the first one.
+func blockIDs(related RelatedToStoryBlocks) []int {
+	var ids []int
+	for _, block := range related.OtherBlocks {
+		ids = append(ids, block.ID)
+	}
+	return ids
+}
+
+func TestStories(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		id := r.stories.CreateFB(ctx, 1, "The crossroads", "Where do you go?", []string{"Left", "Right"}, false)
+		story := r.stories.CreatedFBView(ctx, id)
+		if story.FirstBlock.StoryTitle != "The crossroads" || story.FirstBlock.UserID != 1 {
+			t.Errorf("story saved as %+v", story.FirstBlock)
+		}
+		if got := options(story); len(got) != 2 || got[1] != "Left" || got[2] != "Right" {
+			t.Fatalf("first block options are %v", got)
+		}
+
+		//Left leads to 3, Right to 4, which 3 leads to as well.
+		r.stories.EditB(ctx, 1, 1, "", "A dark forest.", []string{"add Deeper"})
+		r.stories.EditB(ctx, 2, 1, "", "A river.", []string{"add Shared"})
+		r.stories.EditB(ctx, 3, 1, "", "A cave.", []string{"addTo 4 Swim", "change 4 Dive"})
+		block := r.stories.EditBView(ctx, 3)
+		if block.Block.BlockContent != "A cave." || block.Block.StoryID != id {
+			t.Errorf("block saved as %+v", block.Block)
+		}
+		if got := options(block); len(got) != 1 || got[4] != "Dive" {
+			t.Errorf("block 3 options are %v", got)
+		}
+
+		//Deleting Left cascades to 3 only, 4 has another parent.
+		r.stories.EditFB(ctx, id, 1, "The crossroads", "Where now?", []string{"delete 1"})
+		story = r.stories.CreatedFBView(ctx, id)
+		if story.FirstBlock.FirstBlockContent != "Where now?" {
+			t.Errorf("content is %q", story.FirstBlock.FirstBlockContent)
+		}
+		if got := options(story); len(got) != 1 || got[2] != "Right" {
+			t.Errorf("first block options are %v", got)
+		}
+		if got := blockIDs(story.RelatedToStoryBlocks); len(got) != 2 || got[0] != 2 || got[1] != 4 {
+			t.Errorf("story has blocks %v; want [2 4]", got)
+		}
+
+		r.stories.DeleteB(ctx, 2)
+		if got := blockIDs(r.stories.RetrieveBlocks(ctx, id)); len(got) != 0 {
+			t.Errorf("story has blocks %v; want none", got)
+		}
+
+		r.stories.DeleteFB(ctx, id)
+		if story := r.stories.CreatedFBView(ctx, id); story.FirstBlock.ID != 0 {
+			t.Errorf("deleted story is still there: %+v", story.FirstBlock)
+		}
+	})
+}
+
+func TestLatestAndPlays(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		public := r.stories.CreateFB(ctx, 1, "Public tale", "Once.", []string{"Go"}, false)
+		private := r.stories.CreateFB(ctx, 1, "Secret diary", "Dear.", []string{"Go"}, true)
+
+		if got := r.stories.Latest(ctx, 1, nil); len(got) != 2 || got[0].ID != private || got[1].ID != public {
+			t.Errorf("author sees %v", got)
+		}
+		if got := r.stories.Latest(ctx, 2, nil); len(got) != 1 || got[0].ID != public {
+			t.Errorf("reader sees %v", got)
+		}
+
+		r.stories.CountPlay(ctx, public)
+		r.stories.CountPlay(ctx, public)
+		r.stories.CountPlay(ctx, private)
+		if plays, err := r.stories.MostPlayed(ctx, 1); err != nil || plays != 2 {
+			t.Errorf("got %d plays and %v; want 2, private stories don't count", plays, err)
+		}
+		if plays, err := r.stories.MostPlayed(ctx, 2); err != nil || plays != 0 {
+			t.Errorf("user without stories got %d plays and %v", plays, err)
+		}
+	})
+}
+
+// catalogueIDs returns IDs of the stories on all pages of the catalogue, following the cursors.
+func catalogueIDs(t *testing.T, stories StoryRepository, q CatalogueQuery) []int {
+	t.Helper()
+	var ids []int
+	for {
+		page, err := stories.Catalogue(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, story := range page.Stories {
+			ids = append(ids, story.ID)
+		}
+		if page.Next == "" {
+			return ids
+		}
+		q.Cursor = page.Next
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		var ids []int
+		for i := range 5 {
+			ids = append(ids, r.stories.CreateFB(ctx, 1+i%2, fmt.Sprint("Story ", i), "Once.", []string{"Go"}, i == 4))
+		}
+		private := ids[4]
+		r.stories.SetDetails(ctx, ids[1], StoryDetails{Language: "en"})
+		r.stories.CountPlay(ctx, ids[0])
+		r.stories.CountPlay(ctx, ids[0])
+		r.stories.CountPlay(ctx, ids[2])
+		time.Sleep(time.Millisecond)
+		r.stories.EditFB(ctx, ids[1], 2, "Story 1 edited", "", nil)
+		long := r.stories.RetrieveBlocks(ctx, ids[3]).OtherBlocks[0].ID
+		for range shortStory {
+			r.stories.EditB(ctx, long, 2, "", "", []string{"add Further"})
+		}
+
+		tests := []struct {
+			name  string
+			query CatalogueQuery
+			want  []int
+		}{
+			{"newest", CatalogueQuery{Limit: 2}, []int{ids[3], ids[2], ids[1], ids[0]}},
+			{"updated", CatalogueQuery{Sort: SortUpdated, Limit: 2}, []int{ids[1], ids[3], ids[2], ids[0]}},
+			{"most played", CatalogueQuery{Sort: SortPlayed, Limit: 1}, []int{ids[0], ids[2], ids[3], ids[1]}},
+			{"mine", CatalogueQuery{UserID: 1, Mine: true, Limit: 2}, []int{private, ids[2], ids[0]}},
+			{"others don't see private stories", CatalogueQuery{UserID: 2, Mine: true}, []int{ids[3], ids[1]}},
+			{"author", CatalogueQuery{AuthorID: 2}, []int{ids[3], ids[1]}},
+			{"language", CatalogueQuery{Language: "en"}, []int{ids[1]}},
+			{"short", CatalogueQuery{Length: LengthShort}, []int{ids[2], ids[1], ids[0]}},
+			{"medium", CatalogueQuery{Length: LengthMedium}, []int{ids[3]}},
+			{"long", CatalogueQuery{Length: LengthLong}, nil},
+		}
+		for _, tt := range tests {
+			if got := catalogueIDs(t, r.stories, tt.query); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+			}
+		}
+
+		page, _ := r.stories.Catalogue(ctx, CatalogueQuery{Limit: 1})
+		if _, err := r.stories.Catalogue(ctx, CatalogueQuery{Sort: SortPlayed, Cursor: page.Next}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor of another order got %v", err)
+		}
+		if _, err := r.stories.Catalogue(ctx, CatalogueQuery{Cursor: "garbage"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("garbage cursor got %v", err)
+		}
+	})
+}
+
+func TestTags(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		dragons := r.stories.CreateFB(ctx, 1, "Dragons", "Once.", []string{"Go"}, false)
+		duel := r.stories.CreateFB(ctx, 1, "Duel", "Once.", []string{"Go"}, false)
+		diary := r.stories.CreateFB(ctx, 1, "Diary", "Dear.", []string{"Go"}, true)
+		r.stories.SetDetails(ctx, dragons, StoryDetails{Genre: "fantasy", Tags: []string{"dragons", "dark"}})
+		r.stories.SetDetails(ctx, duel, StoryDetails{Language: "en", Tags: []string{"duel", "dragons"}, Warnings: []string{"violence"}})
+		r.stories.SetDetails(ctx, diary, StoryDetails{Tags: []string{"dragons", "diary"}})
+
+		details, err := r.stories.Details(ctx, duel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(details) != fmt.Sprint(StoryDetails{Language: "en", Tags: []string{"dragons", "duel"}, Warnings: []string{"violence"}}) {
+			t.Errorf("got details %+v", details)
+		}
+
+		tags, err := r.stories.SuggestTags(ctx, "d", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(tags) != "[{dragons 2} {dark 1} {duel 1}]" {
+			t.Errorf("got suggestions %v; want the public tags starting with d, the most used first", tags)
+		}
+
+		tests := []struct {
+			name  string
+			query CatalogueQuery
+			want  []int
+		}{
+			{"tag", CatalogueQuery{Tag: "dragons"}, []int{duel, dragons}},
+			{"genre", CatalogueQuery{Genre: "fantasy"}, []int{dragons}},
+			{"hidden warnings", CatalogueQuery{UserID: 2, Tag: "dragons", HideWarnings: []string{"violence", "gore"}}, []int{dragons}},
+			{"own hidden warnings", CatalogueQuery{UserID: 1, Tag: "dragons", HideWarnings: []string{"violence"}}, []int{duel, dragons}},
+		}
+		for _, tt := range tests {
+			if got := catalogueIDs(t, r.stories, tt.query); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+			}
+		}
+
+		//Other lists hide the warnings too.
+		hidden := []string{"violence"}
+		if got := r.stories.Latest(ctx, 2, hidden); len(got) != 1 || got[0].ID != dragons {
+			t.Errorf("got latest %v; want only the story without hidden warnings", got)
+		}
+		if got, _ := r.stories.Search(ctx, "once", 2, hidden); len(got) != 1 || got[0].StoryID != dragons {
+			t.Errorf("got search results %v; want only the story without hidden warnings", got)
+		}
+		if got, _ := r.stories.Search(ctx, "once", 1, hidden); len(got) != 2 {
+			t.Errorf("got search results %v; want the author's stories with hidden warnings too", got)
+		}
+		r.stories.SetFavorite(ctx, duel, 2, true)
+		if got, _ := r.stories.Favorites(ctx, 2, hidden); len(got) != 0 {
+			t.Errorf("got favorites %v; want none", got)
+		}
+
+		//Replacing the details drops the old tags, deleting the story drops all.
+		r.stories.SetDetails(ctx, dragons, StoryDetails{Genre: "horror"})
+		r.stories.DeleteFB(ctx, duel)
+		if tags, _ := r.stories.SuggestTags(ctx, "", 10); len(tags) != 0 {
+			t.Errorf("got suggestions %v; want none", tags)
+		}
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		id, err := r.users.Insert(ctx, "Jane-Doe", "jane@example.com", "pa55word-long")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.users.Insert(ctx, "jane-doe", "other@example.com", "pa55word-long"); !errors.Is(err, ErrDuplicateNickname) {
+			t.Errorf("nickname differing in case got %v", err)
+		}
+		if _, err := r.users.Insert(ctx, "jane/doe", "other@example.com", "pa55word-long"); !errors.Is(err, ErrInvalidNickname) {
+			t.Errorf("nickname with a slash got %v", err)
+		}
+		external, err := r.users.InsertExternal(ctx, "Jane Doe", "sso-jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := r.users.GetUser(ctx, external); user.NickName != "Jane-Doe-2" {
+			t.Errorf("external user got nickname %q; want Jane-Doe-2", user.NickName)
+		}
+
+		if err := r.users.UpdateProfile(ctx, id, "Writes about dragons.", "https://example.com/jane.png"); err != nil {
+			t.Fatal(err)
+		}
+		user, err := r.users.GetByNickname(ctx, "JANE-DOE")
+		if err != nil || user.ID != id || user.Bio != "Writes about dragons." || user.AvatarURL != "https://example.com/jane.png" {
+			t.Errorf("got %+v and %v", user, err)
+		}
+		if _, err := r.users.GetByNickname(ctx, "nobody"); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("unknown nickname got %v", err)
+		}
+
+		public := r.stories.CreateFB(ctx, id, "Public tale", "Once.", []string{"Go"}, false)
+		r.stories.CreateFB(ctx, id, "Another tale", "Once.", []string{"Go"}, false)
+		private := r.stories.CreateFB(ctx, id, "Secret diary", "Dear.", []string{"Go"}, true)
+		r.stories.CountPlay(ctx, public)
+		r.stories.CountPlay(ctx, public)
+		r.stories.CountPlay(ctx, private)
+		if stats, err := r.stories.AuthorStats(ctx, id); err != nil || stats != (AuthorStats{Stories: 2, Plays: 2}) {
+			t.Errorf("got %+v and %v; want 2 public stories played twice", stats, err)
+		}
+	})
+}
+
+func TestRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		tale := r.stories.CreateFB(ctx, 1, "Rated tale", "Once.", []string{"Go"}, false)
+		other := r.stories.CreateFB(ctx, 1, "Unrated tale", "Once.", []string{"Go"}, false)
+		private := r.stories.CreateFB(ctx, 1, "Secret diary", "Dear.", []string{"Go"}, true)
+
+		if err := r.stories.Rate(ctx, tale, 1, 5, ""); !errors.Is(err, ErrOwnStory) {
+			t.Errorf("author rating own story got %v", err)
+		}
+		if err := r.stories.Rate(ctx, private, 2, 5, ""); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("rating a private story got %v", err)
+		}
+		if err := r.stories.Rate(ctx, tale, 2, 2, "Too short."); err != nil {
+			t.Fatal(err)
+		}
+		//Rating again replaces the rating.
+		if err := r.stories.Rate(ctx, tale, 2, 4, "Short but sweet."); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.stories.Rate(ctx, tale, 3, 5, ""); err != nil {
+			t.Fatal(err)
+		}
+		story := r.stories.RetrieveBlocks(ctx, tale).FirstBlock
+		if story.Rating != 4.5 || story.Ratings != 2 {
+			t.Errorf("got average %v of %d ratings; want 4.5 of 2", story.Rating, story.Ratings)
+		}
+		if rating, err := r.stories.UserRating(ctx, tale, 2); err != nil || rating.Stars != 4 {
+			t.Errorf("got %+v and %v; want 4 stars", rating, err)
+		}
+		if _, err := r.stories.UserRating(ctx, other, 2); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("missing rating got %v", err)
+		}
+		reviews, err := r.stories.Reviews(ctx, tale, 10)
+		if err != nil || len(reviews) != 1 || reviews[0].Review != "Short but sweet." {
+			t.Errorf("got %+v and %v; want the one review", reviews, err)
+		}
+
+		page, err := r.stories.Catalogue(ctx, CatalogueQuery{Sort: SortRated, Limit: 1})
+		if err != nil || len(page.Stories) != 1 || page.Stories[0].ID != tale {
+			t.Fatalf("got %+v and %v; want the rated tale first", page, err)
+		}
+		page, err = r.stories.Catalogue(ctx, CatalogueQuery{Sort: SortRated, Limit: 1, Cursor: page.Next})
+		if err != nil || len(page.Stories) != 1 || page.Stories[0].ID != other {
+			t.Errorf("got %+v and %v; want the unrated tale next", page, err)
+		}
+
+		if err := r.stories.SetFavorite(ctx, private, 2, true); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("favoring a private story got %v", err)
+		}
+		for _, id := range []int{tale, other, other} {
+			if err := r.stories.SetFavorite(ctx, id, 2, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.stories.SetFavorite(ctx, tale, 2, false); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := r.stories.IsFavorite(ctx, tale, 2); err != nil || ok {
+			t.Errorf("removed favorite got %v and %v", ok, err)
+		}
+		favorites, err := r.stories.Favorites(ctx, 2, nil)
+		if err != nil || len(favorites) != 1 || favorites[0].ID != other {
+			t.Errorf("got %+v and %v; want the unrated tale", favorites, err)
+		}
+
+		r.stories.DeleteFB(ctx, other)
+		if favorites, _ := r.stories.Favorites(ctx, 2, nil); len(favorites) != 0 {
+			t.Errorf("deleted story is still a favorite: %+v", favorites)
+		}
+	})
+}
+
+func TestComments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		story := r.stories.CreateFB(ctx, 1, "Draft", "Once.", []string{"Go"}, false)
+		block := r.stories.RetrieveBlocks(ctx, story).OtherBlocks[0].ID
+
+		if err := r.stories.AddCollaborator(ctx, story, 2); err != nil {
+			t.Fatal(err)
+		}
+		r.stories.AddCollaborator(ctx, story, 2)
+		if ok, err := r.stories.IsCollaborator(ctx, story, 2); err != nil || !ok {
+			t.Errorf("invited user got %v and %v", ok, err)
+		}
+		if ids, err := r.stories.Collaborators(ctx, story); err != nil || len(ids) != 1 || ids[0] != 2 {
+			t.Errorf("got collaborators %v and %v; want [2]", ids, err)
+		}
+
+		first := Comment{StoryID: story, BlockID: block, UserID: 2, Body: "Typo here, @author.", Mentions: JSON("[1]")}
+		if err := r.stories.AddComment(ctx, &first); err != nil || first.ID == 0 {
+			t.Fatalf("got ID %d and %v", first.ID, err)
+		}
+		reply := Comment{StoryID: story, BlockID: block, ParentID: first.ID, UserID: 1, Body: "Fixed."}
+		if err := r.stories.AddComment(ctx, &reply); err != nil {
+			t.Fatal(err)
+		}
+		//Replies to replies join the thread.
+		nested := Comment{StoryID: story, BlockID: block, ParentID: reply.ID, UserID: 2, Body: "Thanks."}
+		if err := r.stories.AddComment(ctx, &nested); err != nil || nested.ParentID != first.ID {
+			t.Errorf("got parent %d and %v; want %d", nested.ParentID, err, first.ID)
+		}
+		elsewhere := Comment{StoryID: story, BlockID: 0, ParentID: first.ID, UserID: 2, Body: "Wrong block."}
+		if err := r.stories.AddComment(ctx, &elsewhere); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("reply on another block got %v", err)
+		}
+		opening := Comment{StoryID: story, UserID: 1, Body: "Needs a hook."}
+		r.stories.AddComment(ctx, &opening)
+
+		comments, err := r.stories.Comments(ctx, story, block)
+		if err != nil || len(comments) != 3 || comments[0].Body != "Typo here, @author." || comments[0].Mentioned()[0] != 1 {
+			t.Fatalf("got %+v and %v", comments, err)
+		}
+		if err := r.stories.SetResolved(ctx, first.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if comment, err := r.stories.GetComment(ctx, first.ID); err != nil || !comment.Resolved {
+			t.Errorf("got %+v and %v; want the thread resolved", comment, err)
+		}
+		counts, err := r.stories.CommentCounts(ctx, story)
+		if err != nil || counts[block] != (CommentCount{Comments: 3}) || counts[0] != (CommentCount{Comments: 1, Open: 1}) {
+			t.Errorf("got %+v and %v", counts, err)
+		}
+
+		r.stories.DeleteB(ctx, block)
+		if comments, _ := r.stories.Comments(ctx, story, block); len(comments) != 0 {
+			t.Errorf("comments of the deleted block remain: %+v", comments)
+		}
+		r.stories.DeleteFB(ctx, story)
+		if _, err := r.stories.GetComment(ctx, opening.ID); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("comment of the deleted story got %v", err)
+		}
+		if ok, _ := r.stories.IsCollaborator(ctx, story, 2); ok {
+			t.Error("collaborator of the deleted story remains")
+		}
+	})
+}
+
+func TestNotifications(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		author, _ := r.users.Insert(ctx, "author", "author@example.com", "pa55word-long")
+		reader, _ := r.users.Insert(ctx, "reader", "reader@example.com", "pa55word-long")
+
+		for range 2 {
+			if err := r.users.Follow(ctx, reader, author); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ids, err := r.users.Followers(ctx, author); err != nil || len(ids) != 1 || ids[0] != reader {
+			t.Errorf("got followers %v and %v; want the reader", ids, err)
+		}
+		if count, err := r.users.FollowerCount(ctx, author); err != nil || count != 1 {
+			t.Errorf("got %d followers and %v; want 1", count, err)
+		}
+		if ok, err := r.users.IsFollowing(ctx, author, reader); err != nil || ok {
+			t.Errorf("following goes both ways: %v and %v", ok, err)
+		}
+
+		err := r.users.Notify(ctx,
+			Notification{UserID: reader, Kind: NotifyStory, ActorID: author, ActorName: "author", StoryID: 1, StoryTitle: "First"},
+			Notification{UserID: reader, Kind: NotifyStory, ActorID: author, ActorName: "author", StoryID: 2, StoryTitle: "Second"},
+			Notification{UserID: author, Kind: NotifyReview, ActorID: reader, ActorName: "reader", StoryID: 1, StoryTitle: "First"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifications, err := r.users.Notifications(ctx, reader, 10)
+		if err != nil || len(notifications) != 2 || notifications[0].StoryTitle != "Second" || notifications[0].Read {
+			t.Fatalf("got %+v and %v; want the latest story first", notifications, err)
+		}
+		if count, err := r.users.UnreadCount(ctx, reader); err != nil || count != 2 {
+			t.Errorf("got %d unread and %v; want 2", count, err)
+		}
+
+		//Digests go to users who asked for them, once.
+		if err := r.users.SetDigest(ctx, reader, true); err != nil {
+			t.Fatal(err)
+		}
+		digests, err := r.users.PendingDigests(ctx)
+		if err != nil || len(digests) != 1 || len(digests[reader]) != 2 {
+			t.Fatalf("got digests %+v and %v; want the reader's two notifications", digests, err)
+		}
+		if err := r.users.MarkEmailed(ctx, []int{digests[reader][0].ID, digests[reader][1].ID}); err != nil {
+			t.Fatal(err)
+		}
+		if digests, _ := r.users.PendingDigests(ctx); len(digests) != 0 {
+			t.Errorf("emailed notifications are pending again: %+v", digests)
+		}
+
+		if err := r.users.MarkRead(ctx, reader); err != nil {
+			t.Fatal(err)
+		}
+		if count, _ := r.users.UnreadCount(ctx, reader); count != 0 {
+			t.Errorf("got %d unread after marking all read", count)
+		}
+		if count, _ := r.users.UnreadCount(ctx, author); count != 1 {
+			t.Errorf("marking read reached another user, author has %d unread", count)
+		}
+		r.users.Unfollow(ctx, reader, author)
+		if count, _ := r.users.FollowerCount(ctx, author); count != 0 {
+			t.Errorf("got %d followers after unfollowing", count)
+		}
+	})
+}
+
+func TestSitemapStories(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		public := r.stories.CreateFB(ctx, 1, "Public tale", "Once.", []string{"Go"}, false)
+		r.stories.CreateFB(ctx, 1, "Secret diary", "Dear.", []string{"Go"}, true)
+		deleted := r.stories.CreateFB(ctx, 1, "Withdrawn tale", "Once.", []string{"Go"}, false)
+		//Only the database models soft delete stories.
+		want := []int{deleted, public}
+		if dm, ok := r.stories.(*DialogueModel); ok {
+			if err := dm.DB.Model(&FirstBlock{}).Where("id = ?", deleted).Update("deleted_at", time.Now()).Error; err != nil {
+				t.Fatal(err)
+			}
+			want = []int{public}
+		}
+
+		stories, err := r.stories.SitemapStories(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, story := range stories {
+			ids = append(ids, story.ID)
+		}
+		if !slices.Equal(ids, want) {
+			t.Errorf("got stories %v; want %v", ids, want)
+		}
+		page, err := r.stories.Catalogue(ctx, CatalogueQuery{})
+		if err != nil || len(page.Stories) != len(want) {
+			t.Errorf("got %+v and %v; want the catalogue to match the sitemap", page, err)
+		}
+	})
+}
+
+func TestReadingStats(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		story := r.stories.CreateFB(ctx, 1, "Crossroads", "Left or right?", []string{"Left", "Right"}, false)
+		blocks := r.stories.RetrieveBlocks(ctx, story).OtherBlocks
+		left, right := blocks[0].ID, blocks[1].ID
+		other := r.stories.CreateFB(ctx, 1, "Elsewhere", "Go.", []string{"Go"}, false)
+
+		for _, reading := range []string{"a", "b", "c"} {
+			if err := r.stories.StartReading(ctx, story, reading); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, pick := range []struct {
+			reading  string
+			from, to int
+		}{{"a", 0, left}, {"b", 0, left}, {"b", 0, right}} {
+			if err := r.stories.RecordPick(ctx, pick.reading, story, pick.from, pick.to); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.stories.RecordPick(ctx, "a", other, 0, left); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("got %v for a pick in another story; want ErrNoRecord", err)
+		}
+
+		stats, err := r.stories.ReadingStats(ctx, story, []int{right})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Readings != 3 || stats.Steps != 3 || stats.Completed != 1 {
+			t.Errorf("got %d readings, %d steps, %d completed; want 3, 3, 1", stats.Readings, stats.Steps, stats.Completed)
+		}
+		if stats.Picks[[2]int{0, left}] != 2 || stats.Picks[[2]int{0, right}] != 1 {
+			t.Errorf("got picks %v; want 2 left and 1 right", stats.Picks)
+		}
+		if stats.Reached[0] != 3 || stats.Reached[left] != 2 || stats.Left[0] != 2 {
+			t.Errorf("got reached %v and left %v; want 3 at the start, 2 on the left and 2 leaving the start", stats.Reached, stats.Left)
+		}
+
+		r.stories.DeleteFB(ctx, story)
+		if stats, err := r.stories.ReadingStats(ctx, story, nil); err != nil || stats.Readings != 0 || stats.Steps != 0 {
+			t.Errorf("got %+v and %v; want the readings gone with the story", stats, err)
+		}
+	})
+}
+
+func TestSearch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		lair := r.stories.CreateFB(ctx, 1, "Dragon lair", "A dragon sleeps on gold.", []string{"Wake it"}, false)
+		block := r.stories.RetrieveBlocks(ctx, lair).OtherBlocks[0].ID
+		r.stories.EditB(ctx, block, 1, "", "The dragon opens one eye.", nil)
+		r.stories.CreateFB(ctx, 1, "Dragon diary", "Dear dragon.", []string{"Go"}, true)
+		r.stories.CreateFB(ctx, 1, "Quiet meadow", "Nothing here.", []string{"Go"}, false)
+
+		results, err := r.stories.Search(ctx, "DRAGON", 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].StoryID != lair || results[0].BlockID != 0 || results[1].BlockID != block {
+			t.Fatalf("got %+v; want the first block ranked above the block, without the private story", results)
+		}
+		var marked []string
+		for _, part := range results[1].Snippet {
+			if part.Match {
+				marked = append(marked, part.Text)
+			}
+		}
+		if len(marked) != 1 || !strings.EqualFold(marked[0], "dragon") {
+			t.Errorf("snippet %+v marks %q", results[1].Snippet, marked)
+		}
+
+		if results, _ := r.stories.Search(ctx, "dragon", 1, nil); len(results) != 3 {
+			t.Errorf("author got %d results; want 3 with the private story", len(results))
+		}
+		if results, _ := r.stories.Search(ctx, "dragon eye", 2, nil); len(results) != 1 || results[0].BlockID != block {
+			t.Errorf("got %+v; want only the block having both words", results)
+		}
+		if results, _ := r.stories.Search(ctx, "  ", 2, nil); len(results) != 0 {
+			t.Errorf("blank query got %+v", results)
+		}
+	})
+}
+
+// TestRenameNicknames checks that migrating a database older than the nickname index renames the users who would
+// break it.
+func TestRenameNicknames(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, nickname := range []string{"Jane", "jane", "jane-2", "Jane Doe", "x", "JANE"} {
+		db.Create(&User{NickName: nickname, Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var nicknames []string
+	db.Model(&User{}).Order("id").Pluck("nick_name", &nicknames)
+	if want := "[Jane jane-3 jane-2 Jane-Doe reader JANE-4]"; fmt.Sprint(nicknames) != want {
+		t.Errorf("got nicknames %v; want %v", nicknames, want)
+	}
+}
+
+// TestUserCreateError checks the unique violations Insert can only hit in a race, after the checks passed.
+func TestUserCreateError(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&User{NickName: "reader", Email: "reader@example.com"})
+
+	tests := []struct {
+		name string
+		user User
+		want error
+	}{
+		{"nickname", User{NickName: "READER", Email: "other@example.com"}, ErrDuplicateNickname},
+		{"email", User{NickName: "other", Email: "reader@example.com"}, ErrDuplicateEmail},
+	}
+	for _, tt := range tests {
+		if err := userCreateError(db.Create(&tt.user).Error); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v; want %v", tt.name, err, tt.want)
+		}
+	}
+	if err := userCreateError(gorm.ErrInvalidDB); err != gorm.ErrInvalidDB {
+		t.Errorf("other error got %v", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, r repositories) {
+		ctx := context.Background()
+		id, err := r.users.Insert(ctx, "reader", "reader@example.com", "pa55word-long")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.users.Insert(ctx, "copycat", "reader@example.com", "pa55word-long"); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("duplicate email got %v", err)
+		}
+		if exists, err := r.users.Exists(ctx, id); !exists || err != nil {
+			t.Errorf("existing user got %v, %v", exists, err)
+		}
+		if exists, err := r.users.Exists(ctx, id+1); exists || err != nil {
+			t.Errorf("missing user got %v, %v", exists, err)
+		}
+		if _, err := r.users.GetUser(ctx, id+1); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("missing user got %v", err)
+		}
+
+		if _, err := r.users.Authenticate(ctx, "reader@example.com", "pa55word-long"); !errors.Is(err, ErrUnverifiedEmail) {
+			t.Errorf("unverified login got %v", err)
+		}
+		if err := r.users.MarkVerified(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := r.users.Authenticate(ctx, "reader@example.com", "pa55word-long"); err != nil || got != id {
+			t.Errorf("login got %d, %v", got, err)
+		}
+		if err := r.users.PasswordUpdate(ctx, id, "wrong-password", "n3w-password"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("update with a wrong password got %v", err)
+		}
+		if err := r.users.PasswordUpdate(ctx, id, "pa55word-long", "n3w-password"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.users.Authenticate(ctx, "reader@example.com", "pa55word-long"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("login with the old password got %v", err)
+		}
+
+		if err := r.users.EnableTOTP(ctx, id, "SECRET", []string{"abcd-efgh"}); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := r.users.GetUser(ctx, id); !user.TOTPEnabled || user.TOTPSecret != "SECRET" {
+			t.Errorf("two-factor authentication saved as %v, %q", user.TOTPEnabled, user.TOTPSecret)
+		}
+		if ok, err := r.users.UseRecoveryCode(ctx, id, "ABCDEFGH"); !ok || err != nil {
+			t.Errorf("first use of the recovery code got %v, %v", ok, err)
+		}
+		if ok, _ := r.users.UseRecoveryCode(ctx, id, "abcd-efgh"); ok {
+			t.Error("recovery code worked twice")
+		}
+
+		//A code sent several times at once works once.
+		r.users.EnableTOTP(ctx, id, "SECRET", []string{"1111-1111", "2222-2222"})
+		var wg sync.WaitGroup
+		var used atomic.Int32
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := r.users.UseRecoveryCode(ctx, id, "1111-1111"); ok {
+					used.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if used.Load() != 1 {
+			t.Errorf("recovery code worked %d times at once", used.Load())
+		}
+		if ok, err := r.users.UseRecoveryCode(ctx, id, "2222-2222"); !ok || err != nil {
+			t.Errorf("other recovery code got %v, %v", ok, err)
+		}
+
+		external, err := r.users.InsertExternal(ctx, "sso", "sso@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.users.LinkIdentity(ctx, external, "mock", "subject-1", "sso@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.users.LinkIdentity(ctx, id, "mock", "subject-1", "reader@example.com"); err == nil {
+			t.Error("the same identity was linked twice")
+		}
+		if user, err := r.users.GetByIdentity(ctx, "mock", "subject-1"); err != nil || user.ID != external || !user.EmailVerified {
+			t.Errorf("identity lookup got %+v, %v", user, err)
+		}
+		if _, err := r.users.GetByIdentity(ctx, "mock", "subject-2"); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("unknown identity got %v", err)
+		}
+	})
+}
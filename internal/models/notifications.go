@@ -0,0 +1,322 @@
+package models
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of notifications.
+const (
+	NotifyStory   = "story"   //A followed author published a story.
+	NotifyComment = "comment" //Somebody commented on a block of the user's story.
+	NotifyMention = "mention" //Somebody mentioned the user in a comment.
+	NotifyReview  = "review"  //Somebody reviewed the user's story.
+	NotifyInvite  = "invite"  //An author invited the user to comment on a story.
+)
+
+// Follow makes the follower notified of new stories of the author.
+type Follow struct {
+	FollowerID int `gorm:"primaryKey;autoIncrement:false"`
+	AuthorID   int `gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt  time.Time
+}
+
+// Notification tells the user about something another user did. The nickname of the actor and the title of the
+// story are copied, so the inbox reads the same after they change or go away.
+type Notification struct {
+	ID         int `gorm:"primaryKey"`
+	UserID     int `gorm:"index"`
+	Kind       string
+	ActorID    int
+	ActorName  string `gorm:"type:text"`
+	StoryID    int
+	StoryTitle string `gorm:"type:text"`
+	BlockID    int    //The commented block, 0 for the first block or none.
+	Read       bool   `gorm:"default:false"`
+	Emailed    bool   `gorm:"default:false"` //Sent in a digest.
+	CreatedAt  time.Time
+}
+
+// Follow makes the follower follow the author.
+func (um *UserModel) Follow(ctx context.Context, followerID, authorID int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.Follow")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Follow{FollowerID: followerID, AuthorID: authorID}).Error
+}
+
+// Unfollow makes the follower stop following the author.
+func (um *UserModel) Unfollow(ctx context.Context, followerID, authorID int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.Unfollow")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Where("follower_id = ? AND author_id = ?", followerID, authorID).Delete(&Follow{}).Error
+}
+
+// IsFollowing reports whether the follower follows the author.
+func (um *UserModel) IsFollowing(ctx context.Context, followerID, authorID int) (bool, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.IsFollowing")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&Follow{}).Where("follower_id = ? AND author_id = ?", followerID, authorID).Count(&count).Error
+	return count > 0, err
+}
+
+// Followers returns the IDs of the users following the author.
+func (um *UserModel) Followers(ctx context.Context, authorID int) ([]int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.Followers")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var ids []int
+	err := db.Model(&Follow{}).Where("author_id = ?", authorID).Order("follower_id").Pluck("follower_id", &ids).Error
+	return ids, err
+}
+
+// FollowerCount counts the users following the author.
+func (um *UserModel) FollowerCount(ctx context.Context, authorID int) (int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.FollowerCount")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&Follow{}).Where("author_id = ?", authorID).Count(&count).Error
+	return int(count), err
+}
+
+// Notify adds the notifications to the inboxes of their users.
+func (um *UserModel) Notify(ctx context.Context, notifications ...Notification) error {
+	ctx, span := tracer.Start(ctx, "UserModel.Notify")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	if len(notifications) == 0 {
+		return nil
+	}
+	return db.Create(&notifications).Error
+}
+
+// Notifications returns the latest notifications of the user.
+func (um *UserModel) Notifications(ctx context.Context, userID, limit int) ([]Notification, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.Notifications")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var notifications []Notification
+	err := db.Where("user_id = ?", userID).Order("id DESC").Limit(limit).Find(&notifications).Error
+	return notifications, err
+}
+
+// UnreadCount counts the notifications the user hasn't read.
+func (um *UserModel) UnreadCount(ctx context.Context, userID int) (int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.UnreadCount")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&Notification{}).Where("user_id = ? AND read = false", userID).Count(&count).Error
+	return int(count), err
+}
+
+// MarkRead marks all notifications of the user as read.
+func (um *UserModel) MarkRead(ctx context.Context, userID int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.MarkRead")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Model(&Notification{}).Where("user_id = ? AND read = false", userID).Update("read", true).Error
+}
+
+// SetDigest turns the email digest of unread notifications on or off for the user.
+func (um *UserModel) SetDigest(ctx context.Context, id int, enabled bool) error {
+	ctx, span := tracer.Start(ctx, "UserModel.SetDigest")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Model(&User{}).Where("id = ?", id).Update("digest_emails", enabled).Error
+}
+
+// PendingDigests returns the unread notifications not emailed yet of the users receiving digests, by user ID.
+func (um *UserModel) PendingDigests(ctx context.Context) (map[int][]Notification, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.PendingDigests")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var notifications []Notification
+	err := db.Where("read = false AND emailed = false AND user_id IN (?)", db.Model(&User{}).Select("id").Where("digest_emails = true")).
+		Order("user_id, id").Find(&notifications).Error
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[int][]Notification)
+	for _, n := range notifications {
+		digests[n.UserID] = append(digests[n.UserID], n)
+	}
+	return digests, nil
+}
+
+// MarkEmailed records that the notifications with IDs were sent in a digest.
+func (um *UserModel) MarkEmailed(ctx context.Context, ids []int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.MarkEmailed")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Model(&Notification{}).Where("id IN ?", ids).Update("emailed", true).Error
+}
+
+// Follow makes the follower follow the author.
+func (um *MemoryUserModel) Follow(ctx context.Context, followerID, authorID int) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	key := [2]int{followerID, authorID}
+	if _, ok := um.follows[key]; !ok {
+		um.follows[key] = Follow{FollowerID: followerID, AuthorID: authorID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+// Unfollow makes the follower stop following the author.
+func (um *MemoryUserModel) Unfollow(ctx context.Context, followerID, authorID int) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	delete(um.follows, [2]int{followerID, authorID})
+	return nil
+}
+
+// IsFollowing reports whether the follower follows the author.
+func (um *MemoryUserModel) IsFollowing(ctx context.Context, followerID, authorID int) (bool, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	_, ok := um.follows[[2]int{followerID, authorID}]
+	return ok, nil
+}
+
+// Followers returns the IDs of the users following the author.
+func (um *MemoryUserModel) Followers(ctx context.Context, authorID int) ([]int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	var ids []int
+	for key := range um.follows {
+		if key[1] == authorID {
+			ids = append(ids, key[0])
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// FollowerCount counts the users following the author.
+func (um *MemoryUserModel) FollowerCount(ctx context.Context, authorID int) (int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	count := 0
+	for key := range um.follows {
+		if key[1] == authorID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Notify adds the notifications to the inboxes of their users.
+func (um *MemoryUserModel) Notify(ctx context.Context, notifications ...Notification) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	for _, n := range notifications {
+		um.lastNotificationID++
+		n.ID = um.lastNotificationID
+		n.CreatedAt = time.Now()
+		um.notifications[n.ID] = n
+	}
+	return nil
+}
+
+// Notifications returns the latest notifications of the user.
+func (um *MemoryUserModel) Notifications(ctx context.Context, userID, limit int) ([]Notification, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	var notifications []Notification
+	for _, n := range um.notifications {
+		if n.UserID == userID {
+			notifications = append(notifications, n)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].ID > notifications[j].ID })
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+	return notifications, nil
+}
+
+// UnreadCount counts the notifications the user hasn't read.
+func (um *MemoryUserModel) UnreadCount(ctx context.Context, userID int) (int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	count := 0
+	for _, n := range um.notifications {
+		if n.UserID == userID && !n.Read {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// MarkRead marks all notifications of the user as read.
+func (um *MemoryUserModel) MarkRead(ctx context.Context, userID int) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	for id, n := range um.notifications {
+		if n.UserID == userID {
+			n.Read = true
+			um.notifications[id] = n
+		}
+	}
+	return nil
+}
+
+// SetDigest turns the email digest of unread notifications on or off for the user.
+func (um *MemoryUserModel) SetDigest(ctx context.Context, id int, enabled bool) error {
+	um.update(id, func(user *User) {
+		user.DigestEmails = enabled
+	})
+	return nil
+}
+
+// PendingDigests returns the unread notifications not emailed yet of the users receiving digests, by user ID.
+func (um *MemoryUserModel) PendingDigests(ctx context.Context) (map[int][]Notification, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	digests := make(map[int][]Notification)
+	for _, n := range um.notifications {
+		if !n.Read && !n.Emailed && um.users[n.UserID].DigestEmails {
+			digests[n.UserID] = append(digests[n.UserID], n)
+		}
+	}
+	for _, digest := range digests {
+		sort.Slice(digest, func(i, j int) bool { return digest[i].ID < digest[j].ID })
+	}
+	return digests, nil
+}
+
+// MarkEmailed records that the notifications with IDs were sent in a digest.
+func (um *MemoryUserModel) MarkEmailed(ctx context.Context, ids []int) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.init()
+	for _, id := range ids {
+		if n, ok := um.notifications[id]; ok {
+			n.Emailed = true
+			um.notifications[id] = n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidNickname   = errors.New("models: invalid nickname")
+	ErrDuplicateNickname = errors.New("models: duplicate nickname")
+)
+
+// NicknameRX matches nicknames: 3 to 30 letters, digits, dashes and underscores, so they are safe in URLs.
+var NicknameRX = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,30}$`)
+
+// nicknameSeparatorRX matches what can't be in a nickname.
+var nicknameSeparatorRX = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// nicknameIndex makes nicknames unique regardless of their case, both databases index expressions.
+const nicknameIndex = `CREATE UNIQUE INDEX IF NOT EXISTS idx_users_nick_name ON users (lower(nick_name))`
+
+// renameNicknames gives users whose nickname is invalid, or taken in another case by an older user, a free one made
+// of it, so the unique index can be created on databases older than the index.
+func renameNicknames(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&User{}, "idx_users_nick_name") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var users []User
+		if err := tx.Select("id, nick_name").Order("id").Find(&users).Error; err != nil {
+			return err
+		}
+		//Nicknames which stay are taken first, renamed users get what is left.
+		taken := make(map[string]bool, len(users))
+		var renamed []User
+		for _, user := range users {
+			if key := strings.ToLower(user.NickName); NicknameRX.MatchString(user.NickName) && !taken[key] {
+				taken[key] = true
+				continue
+			}
+			renamed = append(renamed, user)
+		}
+		for _, user := range renamed {
+			nickname, _ := freeNickname(user.NickName, func(nickname string) (bool, error) {
+				return taken[strings.ToLower(nickname)], nil
+			})
+			taken[strings.ToLower(nickname)] = true
+			if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("nick_name", nickname).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AuthorStats sum up the public stories of an author.
+type AuthorStats struct {
+	Stories int
+	Plays   int
+}
+
+// nicknameFrom turns the name given by a provider into a nickname, e.g. "Jane Doe" into "Jane-Doe".
+func nicknameFrom(name string) string {
+	nickname := strings.Trim(nicknameSeparatorRX.ReplaceAllString(name, "-"), "-")
+	if len(nickname) > 24 {
+		nickname = strings.TrimRight(nickname[:24], "-")
+	}
+	if len(nickname) < 3 {
+		nickname = "reader"
+	}
+	return nickname
+}
+
+// freeNickname returns the nickname made of the name, numbered if it is taken.
+func freeNickname(name string, taken func(nickname string) (bool, error)) (string, error) {
+	base := nicknameFrom(name)
+	nickname := base
+	for i := 2; ; i++ {
+		isTaken, err := taken(nickname)
+		if err != nil || !isTaken {
+			return nickname, err
+		}
+		nickname = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// nicknameTaken reports whether a user has the nickname in any case.
+func nicknameTaken(db *gorm.DB, nickname string) (bool, error) {
+	var count int64
+	err := db.Model(&User{}).Where("lower(nick_name) = lower(?)", nickname).Count(&count).Error
+	return count > 0, err
+}
+
+// checkNickname checks that the nickname is valid and nobody has it yet.
+func checkNickname(nickname string, taken func(nickname string) (bool, error)) error {
+	if !NicknameRX.MatchString(nickname) {
+		return ErrInvalidNickname
+	}
+	isTaken, err := taken(nickname)
+	if err != nil {
+		return err
+	}
+	if isTaken {
+		return ErrDuplicateNickname
+	}
+	return nil
+}
+
+// GetByNickname gets the user with the nickname in any case.
+func (um *UserModel) GetByNickname(ctx context.Context, nickname string) (*User, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.GetByNickname")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var user User
+	err := db.Where("lower(nick_name) = lower(?)", nickname).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateProfile sets the bio and the avatar shown on the public profile of the user.
+func (um *UserModel) UpdateProfile(ctx context.Context, id int, bio, avatarURL string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.UpdateProfile")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Model(&User{}).Where("id = ?", id).Updates(map[string]any{"bio": bio, "avatar_url": avatarURL}).Error
+}
+
+// AuthorStats counts the public stories of the user and their plays.
+func (dm *DialogueModel) AuthorStats(ctx context.Context, userID int) (stats AuthorStats, err error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.AuthorStats")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	err = db.Model(&FirstBlock{}).Select("count(*) AS stories, coalesce(sum(plays), 0) AS plays").
+		Where("user_id = ? AND privacy = false", userID).Scan(&stats).Error
+	return stats, err
+}
+
+// GetByNickname gets the user with the nickname in any case.
+func (um *MemoryUserModel) GetByNickname(ctx context.Context, nickname string) (*User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for _, user := range um.users {
+		if strings.EqualFold(user.NickName, nickname) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNoRecord
+}
+
+// UpdateProfile sets the bio and the avatar shown on the public profile of the user.
+func (um *MemoryUserModel) UpdateProfile(ctx context.Context, id int, bio, avatarURL string) error {
+	um.update(id, func(user *User) {
+		user.Bio = bio
+		user.AvatarURL = avatarURL
+	})
+	return nil
+}
+
+// nicknameTaken reports whether a user has the nickname in any case. It must be called with mu held.
+func (um *MemoryUserModel) nicknameTaken(nickname string) (bool, error) {
+	for _, user := range um.users {
+		if strings.EqualFold(user.NickName, nickname) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AuthorStats counts the public stories of the user and their plays.
+func (mm *MemoryDialogueModel) AuthorStats(ctx context.Context, userID int) (stats AuthorStats, err error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	for _, story := range mm.firstBlocks {
+		if story.UserID == userID && !story.Privacy {
+			stats.Stories++
+			stats.Plays += story.Plays
+		}
+	}
+	return stats, nil
+}
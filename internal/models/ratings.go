@@ -0,0 +1,260 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrOwnStory is returned when authors rate their own stories.
+var ErrOwnStory = errors.New("models: authors can't rate their own stories")
+
+// Rating is the stars and the optional review a reader gave a story. Every reader has one rating per story, rating
+// again replaces it.
+type Rating struct {
+	StoryID int `gorm:"primaryKey;autoIncrement:false"`
+	UserID  int `gorm:"primaryKey;autoIncrement:false"`
+	Stars   int
+	Review  string `gorm:"type:text"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Favorite marks a story the reader wants to come back to.
+type Favorite struct {
+	StoryID   int `gorm:"primaryKey;autoIncrement:false"`
+	UserID    int `gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time
+}
+
+// rateable returns the story if the user may rate it: it exists, the user sees it and didn't write it.
+func rateable(story FirstBlock, userID int) error {
+	switch {
+	case story.ID == 0 || story.Privacy && story.UserID != userID:
+		return ErrNoRecord
+	case story.UserID == userID:
+		return ErrOwnStory
+	}
+	return nil
+}
+
+// Rate saves the stars and review of the user for the story and updates the story's average.
+func (dm *DialogueModel) Rate(ctx context.Context, storyID, userID, stars int, review string) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Rate")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	return db.Transaction(func(tx *gorm.DB) error {
+		var story FirstBlock
+		if err := tx.Where("id = ?", storyID).Find(&story).Error; err != nil {
+			return err
+		}
+		if err := rateable(story, userID); err != nil {
+			return err
+		}
+		rating := Rating{StoryID: storyID, UserID: userID, Stars: stars, Review: review}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "story_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"stars", "review", "updated_at"}),
+		}).Create(&rating).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&FirstBlock{}).Where("id = ?", storyID).UpdateColumns(map[string]any{
+			"rating":  gorm.Expr("(SELECT coalesce(avg(stars), 0) FROM ratings WHERE story_id = ?)", storyID),
+			"ratings": gorm.Expr("(SELECT count(*) FROM ratings WHERE story_id = ?)", storyID),
+		}).Error
+	})
+}
+
+// UserRating gets the rating the user gave the story.
+func (dm *DialogueModel) UserRating(ctx context.Context, storyID, userID int) (*Rating, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.UserRating")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var rating Rating
+	err := db.Where("story_id = ? AND user_id = ?", storyID, userID).First(&rating).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return &rating, nil
+}
+
+// Reviews returns the latest ratings of the story which come with a review.
+func (dm *DialogueModel) Reviews(ctx context.Context, storyID, limit int) ([]Rating, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Reviews")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var reviews []Rating
+	err := db.Where("story_id = ? AND review <> ''", storyID).Order("updated_at DESC, user_id").Limit(limit).Find(&reviews).Error
+	return reviews, err
+}
+
+// SetFavorite adds the story to the favorites of the user or removes it.
+func (dm *DialogueModel) SetFavorite(ctx context.Context, storyID, userID int, favorite bool) error {
+	ctx, span := tracer.Start(ctx, "DialogueModel.SetFavorite")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	if !favorite {
+		return db.Where("story_id = ? AND user_id = ?", storyID, userID).Delete(&Favorite{}).Error
+	}
+	var story FirstBlock
+	if err := db.Where("id = ?", storyID).Find(&story).Error; err != nil {
+		return err
+	}
+	if story.ID == 0 || story.Privacy && story.UserID != userID {
+		return ErrNoRecord
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Favorite{StoryID: storyID, UserID: userID}).Error
+}
+
+// IsFavorite reports whether the story is among the favorites of the user.
+func (dm *DialogueModel) IsFavorite(ctx context.Context, storyID, userID int) (bool, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.IsFavorite")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&Favorite{}).Where("story_id = ? AND user_id = ?", storyID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// Favorites returns the stories the user marked as favorite and still sees, the latest marked first.
+func (dm *DialogueModel) Favorites(ctx context.Context, userID int, hidden []string) ([]FirstBlock, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Favorites")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	var stories []FirstBlock
+	tx := db.Joins("JOIN favorites ON favorites.story_id = first_blocks.id").
+		Where("favorites.user_id = ? AND (first_blocks.privacy = false OR first_blocks.user_id = ?)", userID, userID)
+	err := hideWarnings(tx, userID, hidden).
+		Order("favorites.created_at DESC, first_blocks.id DESC").
+		Find(&stories).Error
+	return stories, err
+}
+
+// Rate saves the stars and review of the user for the story and updates the story's average.
+func (mm *MemoryDialogueModel) Rate(ctx context.Context, storyID, userID, stars int, review string) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	story := mm.firstBlocks[storyID]
+	if err := rateable(story, userID); err != nil {
+		return err
+	}
+	key := [2]int{storyID, userID}
+	now := time.Now()
+	rating, ok := mm.ratings[key]
+	if !ok {
+		rating = Rating{StoryID: storyID, UserID: userID, CreatedAt: now}
+	}
+	rating.Stars, rating.Review, rating.UpdatedAt = stars, review, now
+	mm.ratings[key] = rating
+
+	sum := 0
+	story.Ratings = 0
+	for _, r := range mm.ratings {
+		if r.StoryID == storyID {
+			sum += r.Stars
+			story.Ratings++
+		}
+	}
+	story.Rating = float64(sum) / float64(story.Ratings)
+	mm.firstBlocks[storyID] = story
+	return nil
+}
+
+// UserRating gets the rating the user gave the story.
+func (mm *MemoryDialogueModel) UserRating(ctx context.Context, storyID, userID int) (*Rating, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	rating, ok := mm.ratings[[2]int{storyID, userID}]
+	if !ok {
+		return nil, ErrNoRecord
+	}
+	return &rating, nil
+}
+
+// Reviews returns the latest ratings of the story which come with a review.
+func (mm *MemoryDialogueModel) Reviews(ctx context.Context, storyID, limit int) ([]Rating, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var reviews []Rating
+	for _, r := range mm.ratings {
+		if r.StoryID == storyID && r.Review != "" {
+			reviews = append(reviews, r)
+		}
+	}
+	sort.Slice(reviews, func(i, j int) bool {
+		if !reviews[i].UpdatedAt.Equal(reviews[j].UpdatedAt) {
+			return reviews[i].UpdatedAt.After(reviews[j].UpdatedAt)
+		}
+		return reviews[i].UserID < reviews[j].UserID
+	})
+	if len(reviews) > limit {
+		reviews = reviews[:limit]
+	}
+	return reviews, nil
+}
+
+// SetFavorite adds the story to the favorites of the user or removes it.
+func (mm *MemoryDialogueModel) SetFavorite(ctx context.Context, storyID, userID int, favorite bool) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	key := [2]int{storyID, userID}
+	if !favorite {
+		delete(mm.favorites, key)
+		return nil
+	}
+	story := mm.firstBlocks[storyID]
+	if story.ID == 0 || story.Privacy && story.UserID != userID {
+		return ErrNoRecord
+	}
+	if _, ok := mm.favorites[key]; !ok {
+		mm.favorites[key] = Favorite{StoryID: storyID, UserID: userID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+// IsFavorite reports whether the story is among the favorites of the user.
+func (mm *MemoryDialogueModel) IsFavorite(ctx context.Context, storyID, userID int) (bool, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	_, ok := mm.favorites[[2]int{storyID, userID}]
+	return ok, nil
+}
+
+// Favorites returns the stories the user marked as favorite and still sees, the latest marked first.
+func (mm *MemoryDialogueModel) Favorites(ctx context.Context, userID int, hidden []string) ([]FirstBlock, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	var favorites []Favorite
+	for _, f := range mm.favorites {
+		story, ok := mm.firstBlocks[f.StoryID]
+		if f.UserID == userID && ok && (!story.Privacy || story.UserID == userID) && !mm.hidden(story, userID, hidden) {
+			favorites = append(favorites, f)
+		}
+	}
+	sort.Slice(favorites, func(i, j int) bool {
+		if !favorites[i].CreatedAt.Equal(favorites[j].CreatedAt) {
+			return favorites[i].CreatedAt.After(favorites[j].CreatedAt)
+		}
+		return favorites[i].StoryID > favorites[j].StoryID
+	})
+	stories := make([]FirstBlock, len(favorites))
+	for i, f := range favorites {
+		stories[i] = mm.firstBlocks[f.StoryID]
+	}
+	return stories, nil
+}
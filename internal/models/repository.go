@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// Migrate creates or updates the tables of all models.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(&FirstBlock{}, &Block{}, &User{}, &AuditEntry{}, &Token{}, &Identity{}, &StoryTag{},
+		&Rating{}, &Favorite{}, &Collaborator{}, &Comment{}, &Follow{}, &Notification{},
+		&Reading{}, &Pick{})
+	if err != nil {
+		return err
+	}
+	if err := renameNicknames(db); err != nil {
+		return err
+	}
+	if err := db.Exec(nicknameIndex).Error; err != nil {
+		return err
+	}
+	return migrateSearch(db)
+}
+
+// StoryRepository stores stories and their blocks. DialogueModel keeps them in the database, MemoryDialogueModel
+// in memory for tests.
+type StoryRepository interface {
+	RetrieveBlocks(ctx context.Context, id int) RelatedToStoryBlocks
+	CreateFB(ctx context.Context, userid int, firstBlockTitle, firstBlockContent string, firstBlockOptions []string, privacy bool) int
+	CreatedFBView(ctx context.Context, id int) DialoguesData
+	EditFB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string)
+	DeleteFB(ctx context.Context, id int)
+	EditBView(ctx context.Context, id int) DialoguesData
+	EditB(ctx context.Context, id, userID int, blockTitle, blockContent string, blockOptions []string)
+	DeleteB(ctx context.Context, id int)
+	Latest(ctx context.Context, userID int, hidden []string) []FirstBlock
+	CountPlay(ctx context.Context, id int)
+	MostPlayed(ctx context.Context, userID int) (int, error)
+	Search(ctx context.Context, query string, userID int, hidden []string) ([]SearchResult, error)
+	Catalogue(ctx context.Context, q CatalogueQuery) (CataloguePage, error)
+	SetDetails(ctx context.Context, id int, details StoryDetails) error
+	Details(ctx context.Context, id int) (StoryDetails, error)
+	AuthorStats(ctx context.Context, userID int) (AuthorStats, error)
+	SuggestTags(ctx context.Context, prefix string, limit int) ([]TagCount, error)
+	Rate(ctx context.Context, storyID, userID, stars int, review string) error
+	UserRating(ctx context.Context, storyID, userID int) (*Rating, error)
+	Reviews(ctx context.Context, storyID, limit int) ([]Rating, error)
+	SetFavorite(ctx context.Context, storyID, userID int, favorite bool) error
+	IsFavorite(ctx context.Context, storyID, userID int) (bool, error)
+	Favorites(ctx context.Context, userID int, hidden []string) ([]FirstBlock, error)
+	AddCollaborator(ctx context.Context, storyID, userID int) error
+	RemoveCollaborator(ctx context.Context, storyID, userID int) error
+	Collaborators(ctx context.Context, storyID int) ([]int, error)
+	IsCollaborator(ctx context.Context, storyID, userID int) (bool, error)
+	AddComment(ctx context.Context, comment *Comment) error
+	GetComment(ctx context.Context, id int) (*Comment, error)
+	Comments(ctx context.Context, storyID, blockID int) ([]Comment, error)
+	SetResolved(ctx context.Context, id int, resolved bool) error
+	CommentCounts(ctx context.Context, storyID int) (map[int]CommentCount, error)
+	SitemapStories(ctx context.Context, limit int) ([]FirstBlock, error)
+	StartReading(ctx context.Context, storyID int, readingID string) error
+	RecordPick(ctx context.Context, readingID string, storyID, fromBlock, toBlock int) error
+	ReadingStats(ctx context.Context, storyID int, endings []int) (ReadingStats, error)
+}
+
+// UserRepository stores users and their links to external identities. UserModel keeps them in the database,
+// MemoryUserModel in memory for tests.
+type UserRepository interface {
+	Insert(ctx context.Context, name, email, password string) (int, error)
+	InsertExternal(ctx context.Context, name, email string) (int, error)
+	Authenticate(ctx context.Context, email, password string) (int, error)
+	Exists(ctx context.Context, id int) (bool, error)
+	GetUser(ctx context.Context, id int) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error
+	PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error
+	PasswordReset(ctx context.Context, id int, newPassword string) error
+	MarkVerified(ctx context.Context, id int) error
+	EnableTOTP(ctx context.Context, id int, secret string, recoveryCodes []string) error
+	DisableTOTP(ctx context.Context, id int) error
+	UseRecoveryCode(ctx context.Context, id int, code string) (bool, error)
+	SetHiddenWarnings(ctx context.Context, id int, warnings []string) error
+	GetByNickname(ctx context.Context, nickname string) (*User, error)
+	UpdateProfile(ctx context.Context, id int, bio, avatarURL string) error
+	Follow(ctx context.Context, followerID, authorID int) error
+	Unfollow(ctx context.Context, followerID, authorID int) error
+	IsFollowing(ctx context.Context, followerID, authorID int) (bool, error)
+	Followers(ctx context.Context, authorID int) ([]int, error)
+	FollowerCount(ctx context.Context, authorID int) (int, error)
+	Notify(ctx context.Context, notifications ...Notification) error
+	Notifications(ctx context.Context, userID, limit int) ([]Notification, error)
+	UnreadCount(ctx context.Context, userID int) (int, error)
+	MarkRead(ctx context.Context, userID int) error
+	SetDigest(ctx context.Context, id int, enabled bool) error
+	PendingDigests(ctx context.Context) (map[int][]Notification, error)
+	MarkEmailed(ctx context.Context, ids []int) error
+}
+
+var (
+	_ StoryRepository = (*DialogueModel)(nil)
+	_ StoryRepository = (*MemoryDialogueModel)(nil)
+	_ UserRepository  = (*UserModel)(nil)
+	_ UserRepository  = (*MemoryUserModel)(nil)
+)
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// SearchResult is a story whose title or first block, or one of its blocks, matches a search.
+type SearchResult struct {
+	StoryID    int
+	StoryTitle string
+	BlockID    int //Zero if the title or the first block matched.
+	Rank       float64
+	Snippet    []SnippetPart
+}
+
+// SnippetPart is a piece of the text around the match, Match marks the words searched for.
+type SnippetPart struct {
+	Text  string
+	Match bool
+}
+
+// searchLimit is how many results a search returns at most.
+const searchLimit = 20
+
+// searchSchema adds to PostgreSQL tables the tsvector columns the search uses, kept up to date by the database.
+// The simple configuration doesn't stem words, stories are written in any language.
+var searchSchema = []string{
+	`ALTER TABLE first_blocks ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('simple', coalesce(story_title, '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce(first_block_content, '')), 'B')) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_first_blocks_search ON first_blocks USING GIN (search)`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+		to_tsvector('simple', coalesce(block_content, ''))) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_blocks_search ON blocks USING GIN (search)`,
+}
+
+// postgresVisible leaves out of postgresSearch the stories carrying the hidden warnings which the user didn't write.
+const postgresVisible = `(f.user_id = @user OR NOT EXISTS (
+	SELECT 1 FROM story_tags t WHERE t.story_id = f.id AND t.kind = @warning AND t.name IN @hidden))`
+
+// Markers ts_headline puts around matches, they are split into snippet parts afterwards.
+const (
+	matchStart = "\x02"
+	matchStop  = "\x03"
+)
+
+// postgresSearch ranks matches of both tables in one query. Stories only the user can see are private ones the user
+// wrote, stories carrying the hidden warnings are left out unless the user wrote them.
+const postgresSearch = `
+SELECT f.id AS story_id, f.story_title, 0 AS block_id, ts_rank(f.search, q) AS rank,
+	ts_headline('simple', f.first_block_content, q, @options) AS snippet
+FROM first_blocks f, websearch_to_tsquery('simple', @query) q
+WHERE f.search @@ q AND (f.privacy = false OR f.user_id = @user) AND ` + postgresVisible + `
+UNION ALL
+SELECT b.story_id, f.story_title, b.id, ts_rank(b.search, q),
+	ts_headline('simple', b.block_content, q, @options)
+FROM blocks b JOIN first_blocks f ON f.id = b.story_id, websearch_to_tsquery('simple', @query) q
+WHERE b.search @@ q AND (f.privacy = false OR f.user_id = @user) AND ` + postgresVisible + `
+ORDER BY rank DESC, story_id DESC, block_id
+LIMIT @limit`
+
+// Search finds stories and blocks containing the words of the query, best matches first. PostgreSQL uses its full
+// text search, other databases look for the words with LIKE.
+func (dm *DialogueModel) Search(ctx context.Context, query string, userID int, hidden []string) ([]SearchResult, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Search")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	if db.Dialector.Name() == "postgres" {
+		var rows []struct {
+			StoryID    int
+			StoryTitle string
+			BlockID    int
+			Rank       float64
+			Snippet    string
+		}
+		err := db.Raw(postgresSearch, map[string]any{
+			"query":   query,
+			"user":    userID,
+			"warning": kindWarning,
+			"hidden":  append([]string{""}, hidden...), //Never empty, which not every driver takes in IN.
+			"limit":   searchLimit,
+			"options": "StartSel=" + matchStart + ", StopSel=" + matchStop + ", MaxWords=30, MinWords=10",
+		}).Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		results := make([]SearchResult, len(rows))
+		for i, row := range rows {
+			results[i] = SearchResult{
+				StoryID:    row.StoryID,
+				StoryTitle: row.StoryTitle,
+				BlockID:    row.BlockID,
+				Rank:       row.Rank,
+				Snippet:    splitHeadline(row.Snippet),
+			}
+		}
+		return results, nil
+	}
+
+	//Every word has to be in the title or the content.
+	stories := hideWarnings(db.Model(&FirstBlock{}).Where("(privacy = false OR user_id = ?)", userID), userID, hidden)
+	blocks := hideWarnings(db.Model(&Block{}).Joins("JOIN first_blocks ON first_blocks.id = blocks.story_id").
+		Where("(first_blocks.privacy = false OR first_blocks.user_id = ?)", userID), userID, hidden)
+	for _, term := range terms {
+		pattern := "%" + likeEscaper.Replace(term) + "%"
+		stories = stories.Where(`(lower(story_title) LIKE ? ESCAPE '\' OR lower(first_block_content) LIKE ? ESCAPE '\')`, pattern, pattern)
+		blocks = blocks.Where(`lower(blocks.block_content) LIKE ? ESCAPE '\'`, pattern)
+	}
+	var (
+		firstBlocks []FirstBlock
+		otherBlocks []struct {
+			Block
+			StoryTitle string
+		}
+	)
+	if err := stories.Find(&firstBlocks).Error; err != nil {
+		return nil, err
+	}
+	if err := blocks.Select("blocks.*, first_blocks.story_title").Scan(&otherBlocks).Error; err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, fb := range firstBlocks {
+		results = append(results, matchStory(terms, fb))
+	}
+	for _, b := range otherBlocks {
+		results = append(results, matchBlock(terms, b.Block, b.StoryTitle))
+	}
+	return rankResults(results), nil
+}
+
+// Search finds stories and blocks containing the words of the query, best matches first.
+func (mm *MemoryDialogueModel) Search(ctx context.Context, query string, userID int, hidden []string) ([]SearchResult, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var results []SearchResult
+	for _, fb := range mm.firstBlocks {
+		if fb.Privacy && fb.UserID != userID || mm.hidden(fb, userID, hidden) {
+			continue
+		}
+		text := strings.ToLower(fb.StoryTitle + " " + fb.FirstBlockContent)
+		if containsAll(text, terms) {
+			results = append(results, matchStory(terms, fb))
+		}
+	}
+	for _, b := range mm.blocks {
+		fb, ok := mm.firstBlocks[b.StoryID]
+		if !ok || fb.Privacy && fb.UserID != userID || mm.hidden(fb, userID, hidden) {
+			continue
+		}
+		if containsAll(strings.ToLower(b.BlockContent), terms) {
+			results = append(results, matchBlock(terms, b, fb.StoryTitle))
+		}
+	}
+	return rankResults(results), nil
+}
+
+// searchTerms splits the query into lower case words, dropping the quotes, excluded words and "or" of the web
+// search syntax PostgreSQL understands.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.Fields(strings.ToLower(query)) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+		field = strings.Trim(field, `"'`)
+		if field != "" && field != "or" {
+			terms = append(terms, field)
+		}
+	}
+	return terms
+}
+
+// likeEscaper escapes the wildcards of LIKE in a search term.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func containsAll(text string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchStory ranks a matching first block, words in the title count more like the weights of the tsvector.
+func matchStory(terms []string, fb FirstBlock) SearchResult {
+	title, content := strings.ToLower(fb.StoryTitle), strings.ToLower(fb.FirstBlockContent)
+	var rank float64
+	for _, term := range terms {
+		rank += float64(2*strings.Count(title, term) + strings.Count(content, term))
+	}
+	return SearchResult{
+		StoryID:    fb.ID,
+		StoryTitle: fb.StoryTitle,
+		Rank:       rank,
+		Snippet:    snippet(fb.FirstBlockContent, terms),
+	}
+}
+
+func matchBlock(terms []string, b Block, storyTitle string) SearchResult {
+	content := strings.ToLower(b.BlockContent)
+	var rank float64
+	for _, term := range terms {
+		rank += float64(strings.Count(content, term))
+	}
+	return SearchResult{
+		StoryID:    b.StoryID,
+		StoryTitle: storyTitle,
+		BlockID:    b.ID,
+		Rank:       rank,
+		Snippet:    snippet(b.BlockContent, terms),
+	}
+}
+
+// rankResults orders results like the PostgreSQL query does and cuts them to the limit.
+func rankResults(results []SearchResult) []SearchResult {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		if a.StoryID != b.StoryID {
+			return a.StoryID > b.StoryID
+		}
+		return a.BlockID < b.BlockID
+	})
+	if len(results) > searchLimit {
+		results = results[:searchLimit]
+	}
+	return results
+}
+
+// snippetWords is how many words around the first match a snippet shows.
+const snippetWords = 30
+
+// snippet cuts the words around the first match out of the text and marks the terms in them.
+func snippet(text string, terms []string) []SnippetPart {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	termsRX := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+
+	words := strings.Fields(text)
+	start := 0
+	for i, word := range words {
+		if termsRX.MatchString(word) {
+			start = max(0, i-snippetWords/3)
+			break
+		}
+	}
+	end := min(len(words), start+snippetWords)
+	window := strings.Join(words[start:end], " ")
+	if start > 0 {
+		window = "… " + window
+	}
+	if end < len(words) {
+		window += " …"
+	}
+
+	var parts []SnippetPart
+	last := 0
+	for _, loc := range termsRX.FindAllStringIndex(window, -1) {
+		if loc[0] > last {
+			parts = append(parts, SnippetPart{Text: window[last:loc[0]]})
+		}
+		parts = append(parts, SnippetPart{Text: window[loc[0]:loc[1]], Match: true})
+		last = loc[1]
+	}
+	if last < len(window) {
+		parts = append(parts, SnippetPart{Text: window[last:]})
+	}
+	return parts
+}
+
+// splitHeadline turns the markers of ts_headline into snippet parts.
+func splitHeadline(headline string) []SnippetPart {
+	var parts []SnippetPart
+	for headline != "" {
+		before, rest, found := strings.Cut(headline, matchStart)
+		if before != "" {
+			parts = append(parts, SnippetPart{Text: before})
+		}
+		if !found {
+			break
+		}
+		match, after, _ := strings.Cut(rest, matchStop)
+		parts = append(parts, SnippetPart{Text: match, Match: true})
+		headline = after
+	}
+	return parts
+}
+
+// migrateSearch creates the full text search columns and indexes on PostgreSQL, other databases have none.
+func migrateSearch(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, statement := range searchSchema {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// Genres are the curated genres a story can belong to.
+var Genres = []string{
+	"adventure",
+	"comedy",
+	"drama",
+	"fantasy",
+	"historical",
+	"horror",
+	"mystery",
+	"romance",
+	"science-fiction",
+	"slice-of-life",
+	"thriller",
+}
+
+// ContentWarnings are the standardized warnings authors put on stories and readers may hide stories by.
+var ContentWarnings = []string{
+	"abuse",
+	"death",
+	"gore",
+	"self-harm",
+	"sexual-content",
+	"strong-language",
+	"substance-use",
+	"violence",
+}
+
+// Limits of free-form tags.
+const (
+	MaxTags      = 10
+	MaxTagLength = 30
+)
+
+// Kinds of story tags.
+const (
+	kindTag     = "tag"
+	kindWarning = "warning"
+)
+
+// StoryTag is a free-form tag or a content warning of a story.
+type StoryTag struct {
+	StoryID int    `gorm:"primaryKey;autoIncrement:false"`
+	Kind    string `gorm:"primaryKey;type:varchar(10)"`
+	Name    string `gorm:"primaryKey;type:varchar(30);index"`
+}
+
+// TagCount is a tag and the number of public stories carrying it.
+type TagCount struct {
+	Name    string
+	Stories int
+}
+
+// NormalizeTag lower cases the tag and joins its words with dashes, so it is safe in URLs. It reports false if
+// nothing is left of the tag, it is too long or has other characters than letters, digits and dashes.
+func NormalizeTag(tag string) (string, bool) {
+	tag = strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(tag, "_", " "))), "-")
+	if tag == "" || utf8.RuneCountInString(tag) > MaxTagLength {
+		return "", false
+	}
+	for _, r := range tag {
+		if r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+// storyTags returns rows of the tags and warnings of the details.
+func storyTags(id int, details StoryDetails) []StoryTag {
+	var tags []StoryTag
+	for _, name := range details.Tags {
+		tags = append(tags, StoryTag{StoryID: id, Kind: kindTag, Name: name})
+	}
+	for _, name := range details.Warnings {
+		tags = append(tags, StoryTag{StoryID: id, Kind: kindWarning, Name: name})
+	}
+	return tags
+}
+
+// Details gets the language, genre, tags and warnings of the story with ID.
+func (dm *DialogueModel) Details(ctx context.Context, id int) (StoryDetails, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.Details")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+
+	var story FirstBlock
+	var details StoryDetails
+	if err := db.Select("language, genre").Where("id = ?", id).Find(&story).Error; err != nil {
+		return details, err
+	}
+	details.Language, details.Genre = story.Language, story.Genre
+	var tags []StoryTag
+	if err := db.Where("story_id = ?", id).Order("name").Find(&tags).Error; err != nil {
+		return details, err
+	}
+	for _, tag := range tags {
+		if tag.Kind == kindWarning {
+			details.Warnings = append(details.Warnings, tag.Name)
+		} else {
+			details.Tags = append(details.Tags, tag.Name)
+		}
+	}
+	return details, nil
+}
+
+// SuggestTags returns tags of public stories starting with the prefix, the most used first.
+func (dm *DialogueModel) SuggestTags(ctx context.Context, prefix string, limit int) ([]TagCount, error) {
+	ctx, span := tracer.Start(ctx, "DialogueModel.SuggestTags")
+	defer span.End()
+	db := dm.DB.WithContext(ctx)
+
+	var tags []TagCount
+	err := db.Model(&StoryTag{}).
+		Select("story_tags.name, count(*) AS stories").
+		Joins("JOIN first_blocks ON first_blocks.id = story_tags.story_id").
+		Where(`story_tags.kind = ? AND first_blocks.privacy = false AND story_tags.name LIKE ? ESCAPE '\'`, kindTag, likeEscaper.Replace(prefix)+"%").
+		Group("story_tags.name").
+		Order("stories DESC, story_tags.name").
+		Limit(limit).
+		Scan(&tags).Error
+	return tags, err
+}
+
+// Details gets the language, genre, tags and warnings of the story with ID.
+func (mm *MemoryDialogueModel) Details(ctx context.Context, id int) (StoryDetails, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	story := mm.firstBlocks[id]
+	details := StoryDetails{Language: story.Language, Genre: story.Genre}
+	for _, tag := range mm.tags[id] {
+		if tag.Kind == kindWarning {
+			details.Warnings = append(details.Warnings, tag.Name)
+		} else {
+			details.Tags = append(details.Tags, tag.Name)
+		}
+	}
+	sort.Strings(details.Tags)
+	sort.Strings(details.Warnings)
+	return details, nil
+}
+
+// SuggestTags returns tags of public stories starting with the prefix, the most used first.
+func (mm *MemoryDialogueModel) SuggestTags(ctx context.Context, prefix string, limit int) ([]TagCount, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.init()
+	counts := make(map[string]int)
+	for id, tags := range mm.tags {
+		if mm.firstBlocks[id].Privacy {
+			continue
+		}
+		for _, tag := range tags {
+			if tag.Kind == kindTag && strings.HasPrefix(tag.Name, prefix) {
+				counts[tag.Name]++
+			}
+		}
+	}
+	var tags []TagCount
+	for name, stories := range counts {
+		tags = append(tags, TagCount{Name: name, Stories: stories})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Stories != tags[j].Stories {
+			return tags[i].Stories > tags[j].Stories
+		}
+		return tags[i].Name < tags[j].Name
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return tags, nil
+}
+
+// hasTag reports whether the story with ID has a tag of the kind with one of the names.
+func (mm *MemoryDialogueModel) hasTag(id int, kind string, names ...string) bool {
+	for _, tag := range mm.tags[id] {
+		if tag.Kind == kind && slices.Contains(names, tag.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hideWarnings leaves the stories carrying any of the warnings out of the query on first_blocks, except the ones
+// the user wrote.
+func hideWarnings(tx *gorm.DB, userID int, warnings []string) *gorm.DB {
+	if len(warnings) == 0 {
+		return tx
+	}
+	return tx.Where("(first_blocks.user_id = ? OR NOT EXISTS (SELECT 1 FROM story_tags WHERE story_tags.story_id = first_blocks.id AND kind = ? AND name IN ?))",
+		userID, kindWarning, warnings)
+}
+
+// hidden reports whether the story carries one of the warnings and the user didn't write it. It must be called
+// with mu held.
+func (mm *MemoryDialogueModel) hidden(fb FirstBlock, userID int, warnings []string) bool {
+	return fb.UserID != userID && mm.hasTag(fb.ID, kindWarning, warnings...)
+}
+
+// replaceTags replaces the tags and warnings of the story in the transaction.
+func replaceTags(tx *gorm.DB, id int, details StoryDetails) error {
+	if err := tx.Where("story_id = ?", id).Delete(&StoryTag{}).Error; err != nil {
+		return err
+	}
+	if tags := storyTags(id, details); len(tags) > 0 {
+		return tx.Create(&tags).Error
+	}
+	return nil
+}
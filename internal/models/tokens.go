@@ -0,0 +1,98 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Token scopes.
+const (
+	ScopeVerification  = "verification"
+	ScopePasswordReset = "password-reset"
+)
+
+// Token is a single-use token sent to the user by email. Only the hash of its random part is stored.
+type Token struct {
+	ID     int    `gorm:"primary_key"`
+	Hash   []byte `gorm:"uniqueIndex"`
+	UserID int    `gorm:"index"`
+	Scope  string `gorm:"type:text"`
+	Expiry time.Time
+
+	CreatedAt time.Time
+}
+
+type TokenModel struct {
+	DB *gorm.DB
+
+	// Secret signs tokens, so forged or mangled ones are rejected without a database lookup.
+	Secret []byte
+}
+
+// New creates a token for the user valid for ttl and returns its plain text form "nonce.signature".
+func (tm *TokenModel) New(userID int, scope string, ttl time.Duration) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(nonce)
+	hash := sha256.Sum256([]byte(encoded))
+	token := Token{
+		Hash:   hash[:],
+		UserID: userID,
+		Scope:  scope,
+		Expiry: time.Now().Add(ttl),
+	}
+	if err := tm.DB.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return encoded + "." + tm.sign(scope, encoded), nil
+}
+
+// Consume checks the token and deletes it, so it can't be used again. It returns ID of the user the token
+// was issued to.
+func (tm *TokenModel) Consume(plaintext, scope string) (int, error) {
+	encoded, signature, ok := strings.Cut(plaintext, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(tm.sign(scope, encoded))) {
+		return 0, ErrInvalidToken
+	}
+
+	hash := sha256.Sum256([]byte(encoded))
+	var token Token
+	err := tm.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("hash = ? AND scope = ?", hash[:], scope).First(&token).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&token).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+	if time.Now().After(token.Expiry) {
+		return 0, ErrInvalidToken
+	}
+	return token.UserID, nil
+}
+
+// DeleteAllForUser deletes all tokens of the user with scope, e.g. after the password was reset.
+func (tm *TokenModel) DeleteAllForUser(scope string, userID int) error {
+	return tm.DB.Where("scope = ? AND user_id = ?", scope, userID).Delete(&Token{}).Error
+}
+
+// sign returns the signature binding the token's nonce to its scope.
+func (tm *TokenModel) sign(scope, encoded string) string {
+	mac := hmac.New(sha256.New, tm.Secret)
+	mac.Write([]byte(scope + "|" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,6 @@
+package models
+
+import "go.opentelemetry.io/otel"
+
+// tracer starts a span for every model method, SQL statements executed by the method become its children.
+var tracer = otel.Tracer("dialogue/internal/models")
@@ -1,7 +1,14 @@
 package models
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -10,39 +17,87 @@ import (
 
 type User struct {
 	ID             int    `gorm:"primary_key"`
-	NickName       string `gorm:"type:text"`
+	NickName       string `gorm:"type:text"` //Unique regardless of case, see NicknameRX.
 	Email          string `gorm:"uniqueIndex"`
 	HashedPassword []byte `gorm:"type:varchar(100)"`
+	EmailVerified  bool
+
+	//Two-factor authentication, recovery codes are stored as SHA-256 hashes.
+	TOTPEnabled   bool
+	TOTPSecret    string `gorm:"type:text"`
+	RecoveryCodes JSON   `gorm:"default:'[]'"`
+
+	//HiddenWarnings are the content warnings of stories the user doesn't want to see in lists.
+	HiddenWarnings JSON `gorm:"default:'[]'"`
+
+	//Public profile.
+	Bio       string `gorm:"type:text"`
+	AvatarURL string `gorm:"type:text"`
+
+	//DigestEmails sends the user unread notifications by email.
+	DigestEmails bool `gorm:"default:false"`
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt *time.Time `sql:"index"`
 }
 
+// Hidden returns the content warnings of stories the user doesn't want to see.
+func (u *User) Hidden() []string {
+	var warnings []string
+	json.Unmarshal(u.HiddenWarnings, &warnings)
+	return warnings
+}
+
 type UserModel struct {
 	DB *gorm.DB
+
+	// RequireVerified makes Authenticate refuse accounts whose email address has not been verified yet.
+	RequireVerified bool
+
+	// BcryptCost is the cost of new password hashes, bcrypt.DefaultCost if zero.
+	BcryptCost int
+}
+
+func (um *UserModel) bcryptCost() int {
+	if um.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return um.BcryptCost
 }
 
-// Insert insets a new user into the database.
-func (um *UserModel) Insert(name, email, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+// Insert insets a new user into the database and returns ID of the user.
+func (um *UserModel) Insert(ctx context.Context, name, email, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.Insert")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	if err := checkNickname(name, func(nickname string) (bool, error) { return nicknameTaken(db, nickname) }); err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), um.bcryptCost())
 	if err != nil {
-		return err
+		return 0, err
+	}
+	user := User{
+		NickName:       name,
+		Email:          email,
+		HashedPassword: hashedPassword,
 	}
-	stmt := `INSERT INTO users (nick_name, email, hashed_password)
-    VALUES(?, ?, ?)`
-	if result := um.DB.Exec(stmt, name, email, hashedPassword); result.Error != nil {
-		return ErrDuplicateEmail
+	if err := db.Create(&user).Error; err != nil {
+		return 0, userCreateError(err)
 	}
-	return nil
+	return user.ID, nil
 }
 
 // Authenticate authenticates a user with given data.
-func (um *UserModel) Authenticate(email, password string) (int, error) {
+func (um *UserModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.Authenticate")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
 
 	// Retrieve ID and hashed password associated with the given email. If no matching email exists then return an error.
 	var userInfo User
-	result := um.DB.Model(&User{}).Where("email = ?", email).Find(&userInfo)
+	result := db.Model(&User{}).Where("email = ?", email).First(&userInfo)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return 0, ErrInvalidCredentials
@@ -60,20 +115,29 @@ func (um *UserModel) Authenticate(email, password string) (int, error) {
 			return 0, err
 		}
 	}
+	if um.RequireVerified && !userInfo.EmailVerified {
+		return 0, ErrUnverifiedEmail
+	}
 	return userInfo.ID, nil
 }
 
 // Exists checks if user with provided ID exists in the database.
-func (um *UserModel) Exists(id int) (bool, error) {
-	var exists bool
-	err := um.DB.Model(&User{}).Select("count(*) > 0").Where("id = ?", id).Find(&exists).Error
-	return exists, err
+func (um *UserModel) Exists(ctx context.Context, id int) (bool, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.Exists")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var count int64
+	err := db.Model(&User{}).Where("id = ?", id).Count(&count).Error
+	return count > 0, err
 }
 
 // GetUser gets user with provided ID if exists.
-func (um *UserModel) GetUser(id int) (*User, error) {
+func (um *UserModel) GetUser(ctx context.Context, id int) (*User, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.GetUser")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
 	var user User
-	err := um.DB.Model(&User{}).Where("id = ?", id).First(&user).Error
+	err := db.Model(&User{}).Where("id = ?", id).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrNoRecord
@@ -85,9 +149,12 @@ func (um *UserModel) GetUser(id int) (*User, error) {
 }
 
 // PasswordUpdate updates user's password.
-func (um *UserModel) PasswordUpdate(id int, currentPassword, newPassword string) error {
+func (um *UserModel) PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.PasswordUpdate")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
 	var currentHashedPassword User
-	err := um.DB.Model(&User{}).Select("hashed_password").Where("id = ?", id).Scan(&currentHashedPassword).Error
+	err := db.Model(&User{}).Select("hashed_password").Where("id = ?", id).Scan(&currentHashedPassword).Error
 	if err != nil {
 		return err
 	}
@@ -99,10 +166,132 @@ func (um *UserModel) PasswordUpdate(id int, currentPassword, newPassword string)
 			return err
 		}
 	}
-	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), um.bcryptCost())
 	if err != nil {
 		return err
 	}
-	err = um.DB.Model(&User{}).Where("id = ?", id).Update("hashed_password", &newHashedPassword).Error
+	err = db.Model(&User{}).Where("id = ?", id).Update("hashed_password", &newHashedPassword).Error
 	return err
 }
+
+// GetByEmail gets user with provided email if exists.
+func (um *UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.GetByEmail")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	var user User
+	err := db.Model(&User{}).Where("email = ?", email).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// MarkVerified marks email address of the user as verified.
+func (um *UserModel) MarkVerified(ctx context.Context, id int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.MarkVerified")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Model(&User{}).Where("id = ?", id).Update("email_verified", true).Error
+}
+
+// PasswordReset sets a new password without checking the current one, the user is proven by a reset token.
+func (um *UserModel) PasswordReset(ctx context.Context, id int, newPassword string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.PasswordReset")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), um.bcryptCost())
+	if err != nil {
+		return err
+	}
+	return db.Model(&User{}).Where("id = ?", id).Update("hashed_password", &newHashedPassword).Error
+}
+
+// EnableTOTP turns on two-factor authentication for the user with the secret and plain text recovery codes.
+func (um *UserModel) EnableTOTP(ctx context.Context, id int, secret string, recoveryCodes []string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.EnableTOTP")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	jsonData, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	return db.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+		"totp_enabled":   true,
+		"totp_secret":    secret,
+		"recovery_codes": JSON(jsonData),
+	}).Error
+}
+
+// DisableTOTP turns off two-factor authentication for the user and forgets the secret and recovery codes.
+func (um *UserModel) DisableTOTP(ctx context.Context, id int) error {
+	ctx, span := tracer.Start(ctx, "UserModel.DisableTOTP")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	return db.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"recovery_codes": JSON("[]"),
+	}).Error
+}
+
+// SetHiddenWarnings replaces the content warnings of stories the user doesn't want to see.
+func (um *UserModel) SetHiddenWarnings(ctx context.Context, id int, warnings []string) error {
+	ctx, span := tracer.Start(ctx, "UserModel.SetHiddenWarnings")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	jsonData, err := json.Marshal(append([]string{}, warnings...))
+	if err != nil {
+		return err
+	}
+	return db.Model(&User{}).Where("id = ?", id).Update("hidden_warnings", JSON(jsonData)).Error
+}
+
+// UseRecoveryCode checks the code against the user's recovery codes and removes it if it matches.
+func (um *UserModel) UseRecoveryCode(ctx context.Context, id int, code string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "UserModel.UseRecoveryCode")
+	defer span.End()
+	db := um.DB.WithContext(ctx)
+	hash := hashRecoveryCode(code)
+	for {
+		user, err := um.GetUser(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		var hashes []string
+		json.Unmarshal(user.RecoveryCodes, &hashes)
+		i := slices.IndexFunc(hashes, func(h string) bool { return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 })
+		if i < 0 {
+			return false, nil
+		}
+		jsonData, err := json.Marshal(slices.Delete(hashes, i, i+1))
+		if err != nil {
+			return false, err
+		}
+		//The codes are only replaced if nobody changed them since they were read, so a code works once even when it
+		//is sent twice at the same time. Whoever loses reads them again.
+		result := db.Model(&User{}).Where("id = ? AND CAST(recovery_codes AS TEXT) = ?", id, string(user.RecoveryCodes)).
+			Update("recovery_codes", JSON(jsonData))
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return true, nil
+		}
+	}
+}
+
+// hashRecoveryCode hashes the normalized code. Codes are random enough for a plain hash to be safe.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,88 @@
+// Package ratelimit throttles expensive or sensitive actions such as logging in. Every key (an IP address,
+// an email, ...) gets a token bucket, and keys which keep failing get locked out for a while.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps the state of buckets, failure counters and lockouts.
+type Store interface {
+	// Take removes one token from the bucket with key. If the bucket is empty it reports how long to wait.
+	Take(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, time.Duration, error)
+
+	// Incr increments the counter with key and returns the new value. The counter is reset after window.
+	Incr(ctx context.Context, key string, window time.Duration) (int, error)
+
+	// Lock locks the key out for d.
+	Lock(ctx context.Context, key string, d time.Duration) error
+
+	// LockedFor returns how long the key remains locked out, zero if it is not.
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+
+	// Reset removes the counter or the lock stored under the key.
+	Reset(ctx context.Context, key string) error
+}
+
+// Throttle combines token buckets with lockouts after repeated failures.
+type Throttle struct {
+	Store Store
+
+	//Rate is how many attempts per second are refilled, Burst is how many attempts can be made at once.
+	Rate  float64
+	Burst int
+
+	//After MaxFailures failures within FailureWindow the key is locked for LockoutDuration.
+	MaxFailures     int
+	FailureWindow   time.Duration
+	LockoutDuration time.Duration
+}
+
+// Allow checks every key for a lockout and takes a token from each key's bucket. If any of them is locked or
+// exhausted the attempt is not allowed, and the longest wait among the keys is returned.
+func (t *Throttle) Allow(ctx context.Context, keys ...string) (bool, time.Duration, error) {
+	now := time.Now()
+	allowed := true
+	var wait time.Duration
+	for _, key := range keys {
+		locked, err := t.Store.LockedFor(ctx, "lock:"+key)
+		if err != nil {
+			return false, 0, err
+		}
+		if locked > 0 {
+			allowed = false
+			wait = max(wait, locked)
+			continue
+		}
+		ok, retry, err := t.Store.Take(ctx, "bucket:"+key, t.Rate, t.Burst, now)
+		if err != nil {
+			return false, 0, err
+		}
+		if !ok {
+			allowed = false
+			wait = max(wait, retry)
+		}
+	}
+	return allowed, wait, nil
+}
+
+// Fail records a failed attempt for the key. It reports true when the failure caused a lockout.
+func (t *Throttle) Fail(ctx context.Context, key string) (bool, error) {
+	failures, err := t.Store.Incr(ctx, "failures:"+key, t.FailureWindow)
+	if err != nil {
+		return false, err
+	}
+	if failures < t.MaxFailures {
+		return false, nil
+	}
+	if err := t.Store.Lock(ctx, "lock:"+key, t.LockoutDuration); err != nil {
+		return false, err
+	}
+	return true, t.Store.Reset(ctx, "failures:"+key)
+}
+
+// Succeed forgets previous failures of the key.
+func (t *Throttle) Succeed(ctx context.Context, key string) error {
+	return t.Store.Reset(ctx, "failures:"+key)
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleBucket(t *testing.T) {
+	th := &Throttle{Store: NewMemoryStore(), Rate: 1, Burst: 3, MaxFailures: 100, FailureWindow: time.Minute, LockoutDuration: time.Minute}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ok, _, err := th.Allow(ctx, "ip:1.2.3.4")
+		if err != nil || !ok {
+			t.Fatalf("attempt %d: got %v, %v; want allowed", i+1, ok, err)
+		}
+	}
+	ok, wait, err := th.Allow(ctx, "ip:1.2.3.4")
+	if err != nil || ok {
+		t.Fatalf("got %v, %v; want denied", ok, err)
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("got wait %v; want within a second", wait)
+	}
+
+	//Other keys have their own buckets.
+	if ok, _, _ := th.Allow(ctx, "ip:5.6.7.8"); !ok {
+		t.Error("other key is throttled")
+	}
+}
+
+func TestThrottleLockout(t *testing.T) {
+	th := &Throttle{Store: NewMemoryStore(), Rate: 100, Burst: 100, MaxFailures: 3, FailureWindow: time.Minute, LockoutDuration: time.Hour}
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		locked, err := th.Fail(ctx, "email:a@b.c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == 3) {
+			t.Fatalf("failure %d: got locked %v", i, locked)
+		}
+	}
+	ok, wait, _ := th.Allow(ctx, "ip:1.2.3.4", "email:a@b.c")
+	if ok {
+		t.Fatal("locked key is allowed")
+	}
+	if wait < 59*time.Minute {
+		t.Errorf("got wait %v; want about an hour", wait)
+	}
+}
+
+func TestThrottleSucceedResetsFailures(t *testing.T) {
+	th := &Throttle{Store: NewMemoryStore(), Rate: 100, Burst: 100, MaxFailures: 2, FailureWindow: time.Minute, LockoutDuration: time.Hour}
+	ctx := context.Background()
+
+	th.Fail(ctx, "email:a@b.c")
+	th.Succeed(ctx, "email:a@b.c")
+	if locked, _ := th.Fail(ctx, "email:a@b.c"); locked {
+		t.Error("failures were not reset by a success")
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now()
+	s.Take(ctx, "ip:1.2.3.4", 1, 3, now)
+	s.Incr(ctx, "email:a@b.c", time.Minute)
+	s.Lock(ctx, "email:a@b.c", time.Minute)
+
+	s.Cleanup(now)
+	if len(s.buckets) != 1 || len(s.counters) != 1 || len(s.locks) != 1 {
+		t.Fatalf("live state was dropped: %d buckets, %d counters, %d locks", len(s.buckets), len(s.counters), len(s.locks))
+	}
+	s.Cleanup(now.Add(2 * time.Minute))
+	if len(s.buckets) != 0 || len(s.counters) != 0 || len(s.locks) != 0 {
+		t.Errorf("expired state is kept: %d buckets, %d counters, %d locks", len(s.buckets), len(s.counters), len(s.locks))
+	}
+}
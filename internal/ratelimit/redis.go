@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills the bucket for the time passed since the last call and takes a token atomically.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return wait
+`)
+
+// RedisStore keeps the throttling state in Redis, next to the sessions, so it is shared by all instances.
+type RedisStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	wait, err := takeScript.Run(ctx, s.Client, []string{s.Prefix + key}, rate, burst, now.UnixMilli()).Int64()
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, window time.Duration) (int, error) {
+	pipe := s.Client.TxPipeline()
+	incr := pipe.Incr(ctx, s.Prefix+key)
+	pipe.ExpireNX(ctx, s.Prefix+key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (s *RedisStore) Lock(ctx context.Context, key string, d time.Duration) error {
+	return s.Client.Set(ctx, s.Prefix+key, 1, d).Err()
+}
+
+func (s *RedisStore) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.Client.PTTL(ctx, s.Prefix+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (s *RedisStore) Reset(ctx context.Context, key string) error {
+	return s.Client.Del(ctx, s.Prefix+key).Err()
+}
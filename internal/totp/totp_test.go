@@ -0,0 +1,51 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B, truncated to 6 digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("time %d: got %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	previous, _ := Code(secret, Step(now)-1)
+	if _, ok := Validate(secret, previous, now, 1); !ok {
+		t.Error("code of the previous step is refused")
+	}
+	old, _ := Code(secret, Step(now)-3)
+	if _, ok := Validate(secret, old, now, 1); ok {
+		t.Error("code three steps old is accepted")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Error("short code is accepted")
+	}
+}
@@ -0,0 +1,71 @@
+// Package tracing sets up OpenTelemetry tracing and traces SQL statements executed through gorm.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Options select where spans are exported to.
+type Options struct {
+	// Exporter is "otlp", "stdout" or empty to disable tracing.
+	Exporter string
+
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g. http://localhost:4318.
+	Endpoint string
+
+	// SampleRatio is the fraction of traces started by the app which are recorded. Traces started by callers
+	// are recorded if the caller records them.
+	SampleRatio float64
+
+	ServiceName string
+	Version     string
+
+	// Output receives spans of the stdout exporter.
+	Output io.Writer
+}
+
+// Setup installs the global tracer provider and propagator. The returned function flushes remaining spans and
+// must be called before the app exits. With no exporter nothing is installed and spans are no-ops.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(opts.Output))
+	default:
+		err = fmt.Errorf("unknown tracing exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+		semconv.ServiceVersion(opts.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
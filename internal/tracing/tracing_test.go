@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Options{Exporter: "zipkin"}); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}
+
+// TestStdoutExporter traces a statement through the gorm plugin and checks that the exported span carries the SQL.
+func TestStdoutExporter(t *testing.T) {
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Options{Exporter: "stdout", SampleRatio: 1, ServiceName: "test", Output: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(GormPlugin{System: "postgresql"}); err != nil {
+		t.Fatal(err)
+	}
+	type Story struct {
+		ID    int
+		Title string
+	}
+	ctx, span := otel.Tracer("test").Start(context.Background(), "request")
+	db.WithContext(ctx).Where("title = ?", "secret title").Find(&[]Story{})
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if !strings.Contains(got, `"Name":"gorm.query"`) || !strings.Contains(got, `SELECT * FROM \"stories\" WHERE title = $1`) {
+		t.Errorf("statement span not exported: %s", got)
+	}
+	if strings.Contains(got, "secret title") {
+		t.Error("query arguments leaked into the span")
+	}
+}
@@ -53,6 +53,15 @@ func PermittedInt(value int, permittedValues ...int) bool {
 	return false
 }
 
+func PermittedString(value string, permittedValues ...string) bool {
+	for i := range permittedValues {
+		if value == permittedValues[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func MinChars(value string, n int) bool {
 	return utf8.RuneCountInString(value) >= n
 }
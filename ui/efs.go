@@ -0,0 +1,7 @@
+// Package ui holds the templates and static files of the app, which are compiled into the binary.
+package ui
+
+import "embed"
+
+//go:embed "html" "static"
+var Files embed.FS
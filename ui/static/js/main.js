@@ -5,4 +5,32 @@ for (var i = 0; i < navLinks.length; i++) {
 		link.classList.add("live");
 		break;
 	}
-}
\ No newline at end of file
+}
+// Suggests tags used by other stories for the last tag typed into the tags field.
+var tagsInput = document.getElementById("tags");
+if (tagsInput && tagsInput.list) {
+	var suggestionTimer;
+	tagsInput.addEventListener("input", function () {
+		clearTimeout(suggestionTimer);
+		suggestionTimer = setTimeout(function () {
+			var parts = tagsInput.value.split(",");
+			var typed = parts.pop().trim();
+			var before = parts.map(function (p) { return p.trim(); }).filter(Boolean);
+			if (typed === "") {
+				return;
+			}
+			fetch("/tags/suggest?q=" + encodeURIComponent(typed), {headers: {"Accept": "application/json"}})
+				.then(function (response) { return response.json(); })
+				.then(function (result) {
+					var list = tagsInput.list;
+					list.textContent = "";
+					(result.tags || []).forEach(function (tag) {
+						var option = document.createElement("option");
+						option.value = before.concat(tag.name).join(", ");
+						option.label = tag.name + " (" + tag.stories + ")";
+						list.appendChild(option);
+					});
+				});
+		}, 200);
+	});
+}